@@ -6,7 +6,6 @@ import (
 	"h5-backend/models"
 	"net/http"
 	"golang.org/x/crypto/bcrypt"
-	"time"
 	"strconv"
 	"strings"
 )
@@ -20,7 +19,38 @@ func SetupAdminRoutes(r *gin.Engine, db *gorm.DB) {
 		admin.POST("/cs", func(c *gin.Context) { addCustomerService(c, db) })
 		admin.GET("/cs", func(c *gin.Context) { getCustomerServices(c, db) })
 		admin.POST("/assign", func(c *gin.Context) { assignMiniAppToCS(c, db) })
+		admin.PUT("/miniapp/:id/routing", func(c *gin.Context) { updateMiniAppRouting(c, db) })
+		admin.GET("/miniapp/:id/business-hours", func(c *gin.Context) { getBusinessHours(c, db) })
+		admin.PUT("/miniapp/:id/business-hours", func(c *gin.Context) { updateBusinessHours(c, db) })
+		admin.POST("/miniapp/:id/holidays", func(c *gin.Context) { addBusinessHoliday(c, db) })
+		admin.DELETE("/holiday/:id", func(c *gin.Context) { deleteBusinessHoliday(c, db) })
+		admin.GET("/miniapp/:id/auto-replies", func(c *gin.Context) { getAutoReplyRules(c, db) })
+		admin.POST("/miniapp/:id/auto-replies", func(c *gin.Context) { addAutoReplyRule(c, db) })
+		admin.POST("/miniapp/:id/auto-replies/test", func(c *gin.Context) { testAutoReplyRules(c, db) })
+		admin.PUT("/auto-reply/:id", func(c *gin.Context) { updateAutoReplyRule(c, db) })
+		admin.DELETE("/auto-reply/:id", func(c *gin.Context) { deleteAutoReplyRule(c, db) })
+		admin.PUT("/miniapp/:id/responder", func(c *gin.Context) { updateMiniAppResponder(c, db) })
+		admin.POST("/miniapp/:id/responder/test", func(c *gin.Context) { testResponder(c, db) })
+		admin.GET("/miniapp/:id/faqs", func(c *gin.Context) { getFAQEntries(c, db) })
+		admin.POST("/miniapp/:id/faqs", func(c *gin.Context) { addFAQEntry(c, db) })
+		admin.PUT("/faq/:id", func(c *gin.Context) { updateFAQEntry(c, db) })
+		admin.DELETE("/faq/:id", func(c *gin.Context) { deleteFAQEntry(c, db) })
+		admin.GET("/miniapp/:id/canned", func(c *gin.Context) { getSharedCanned(c, db) })
+		admin.POST("/miniapp/:id/canned", func(c *gin.Context) { addSharedCanned(c, db) })
+		admin.PUT("/canned/:id", func(c *gin.Context) { updateSharedCanned(c, db) })
+		admin.DELETE("/canned/:id", func(c *gin.Context) { deleteSharedCanned(c, db) })
+		admin.GET("/tags", func(c *gin.Context) { getTags(c, db) })
+		admin.POST("/tags", func(c *gin.Context) { addTag(c, db) })
+		admin.PUT("/tag/:id", func(c *gin.Context) { updateTag(c, db) })
+		admin.DELETE("/tag/:id", func(c *gin.Context) { deleteTag(c, db) })
+		admin.GET("/csat", func(c *gin.Context) { getCSATReport(c, db) })
+		admin.GET("/ratings", func(c *gin.Context) { getRatings(c, db) })
+		admin.GET("/miniapp/:id/team", func(c *gin.Context) { getMiniAppTeam(c, db) })
 		admin.GET("/assignments", func(c *gin.Context) { getAssignments(c, db) })
+		admin.GET("/conversations", func(c *gin.Context) { getConversations(c, db) })
+		admin.GET("/message/:id/revisions", func(c *gin.Context) { getMessageRevisions(c, db) })
+		admin.GET("/queue", func(c *gin.Context) { getQueue(c, db) })
+		admin.POST("/queue/:id/pick", func(c *gin.Context) { pickFromQueue(c, db) })
 		admin.DELETE("/miniapp/:id", func(c *gin.Context) { deleteMiniApp(c, db) })
 		admin.DELETE("/cs/:id", func(c *gin.Context) { deleteCustomerService(c, db) })
 		admin.DELETE("/assign/:id", func(c *gin.Context) { deleteAssignment(c, db) })
@@ -30,6 +60,8 @@ func SetupAdminRoutes(r *gin.Engine, db *gorm.DB) {
 		admin.GET("/cs/:id/users", func(c *gin.Context) { getCSUsers(c, db) })
 		admin.PUT("/cs/:id/qrcode", func(c *gin.Context) { updateCSQRCodePath(c, db) })
 		admin.PUT("/cs/:id/welcome", func(c *gin.Context) { updateCSWelcomeMessage(c, db) })
+		admin.PUT("/cs/:id/status", func(c *gin.Context) { updateCSStatus(c, db) })
+		admin.PUT("/cs/:id/capacity", func(c *gin.Context) { updateCSCapacity(c, db) })
 		admin.GET("/cs/:id/welcome", func(c *gin.Context) { getCSWelcomeMessage(c, db) })
 		admin.DELETE("/cs/:id/user/:userId", func(c *gin.Context) { deleteUser(c, db) })
 		admin.PUT("/config/global-qrcode", func(c *gin.Context) { updateGlobalQRCodePath(c, db) })
@@ -51,6 +83,10 @@ func addMiniApp(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "App ID 不能为空"})
 		return
 	}
+	if miniApp.RoutingStrategy != "" && !isValidRoutingStrategy(miniApp.RoutingStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的分配策略，可选值: round_robin/least_active/sticky"})
+		return
+	}
 	
 	// 检查 AppID 是否已存在
 	var existingApp models.MiniApp
@@ -114,17 +150,10 @@ func assignMiniAppToCS(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	// 检查该小程序是否已经分配给其他客服
-	var existingAssignment1 models.Assignment
-	if err := db.Where("mini_app_id = ?", assignment.MiniAppID).First(&existingAssignment1).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "该小程序已分配给其他客服，每个小程序只能分配一个客服"})
-		return
-	}
-	
-	// 检查该客服是否已经分配了其他小程序
-	var existingAssignment2 models.Assignment
-	if err := db.Where("customer_service_id = ?", assignment.CustomerServiceID).First(&existingAssignment2).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "该客服已分配了其他小程序，每个客服只能分配一个小程序"})
+	// 一个小程序可以由多个客服组成团队接待，一个客服也可以负责多个小程序，只需避免重复分配
+	var existingAssignment models.Assignment
+	if err := db.Where("mini_app_id = ? AND customer_service_id = ?", assignment.MiniAppID, assignment.CustomerServiceID).First(&existingAssignment).Error; err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该客服已在该小程序的客服团队中"})
 		return
 	}
 	
@@ -132,6 +161,8 @@ func assignMiniAppToCS(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "分配失败: " + err.Error()})
 		return
 	}
+	// 新成员加入团队后可接待排队中的会话
+	dispatchForAgent(db, assignment.CustomerServiceID)
 	c.JSON(http.StatusOK, assignment)
 }
 
@@ -207,7 +238,7 @@ func getMiniApps(c *gin.Context, db *gorm.DB) {
 // getCustomerServices 获取客服列表
 func getCustomerServices(c *gin.Context, db *gorm.DB) {
 	var csList []models.CustomerService
-	db.Select("id, name, is_admin, qr_code_path, welcome_message, created_at, updated_at").Find(&csList)
+	db.Select("id, name, is_admin, qr_code_path, welcome_message, last_active_time, status, max_concurrent, created_at, updated_at").Find(&csList)
 	c.JSON(http.StatusOK, csList)
 }
 
@@ -315,13 +346,28 @@ func deleteMiniApp(c *gin.Context, db *gorm.DB) {
 		}
 		// 硬删除消息（不是软删除）
 		db.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.Message{})
+		db.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.InternalNote{})
+		db.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.UserTag{})
+		db.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.Rating{})
+		db.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.MessageRevision{})
+		db.Where("user_id IN ?", userIDs).Delete(&models.MessageAttachment{})
 	}
 	
+	// 删除该小程序的所有会话及转接记录（硬删除）
+	db.Unscoped().Where("conversation_id IN (?)", db.Model(&models.Conversation{}).Select("id").Where("mini_app_id = ?", miniAppID)).Delete(&models.ConversationTransfer{})
+	db.Unscoped().Where("conversation_id IN (?)", db.Model(&models.Conversation{}).Select("id").Where("mini_app_id = ?", miniAppID)).Delete(&models.ConversationTag{})
+	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.Conversation{})
+	
 	// 3. 删除该小程序下的所有用户（硬删除）
 	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.User{})
 	
-	// 4. 删除该小程序的所有分配关系（硬删除）
+	// 4. 删除该小程序的所有分配关系、工作时间设置、自动回复规则、问题库和共享快捷回复（硬删除）
 	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.Assignment{})
+	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.BusinessHours{})
+	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.BusinessHoliday{})
+	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.AutoReplyRule{})
+	db.Unscoped().Where("mini_app_id = ?", miniAppID).Delete(&models.FAQEntry{})
+	db.Unscoped().Where("scope = ? AND mini_app_id = ?", models.CannedShared, miniAppID).Delete(&models.CannedResponse{})
 	
 	// 5. 最后删除小程序本身（硬删除）
 	if err := db.Unscoped().Delete(&miniApp).Error; err != nil {
@@ -353,11 +399,23 @@ func deleteCustomerService(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	// 1. 删除该客服的所有消息（硬删除）
-	db.Unscoped().Where("customer_service_id = ?", csID).Delete(&models.Message{})
+	// 1. 删除该客服的所有消息和会话（硬删除）。会话按当前接待客服确定，其中其他客服（转接前）和用户的消息一并删除，
+	// 不留下指向已删除会话的消息
+	var convIDs []uint
+	db.Model(&models.Conversation{}).Where("customer_service_id = ?", csID).Pluck("id", &convIDs)
+	messageIDs := db.Model(&models.Message{}).Select("id").Where("customer_service_id = ? OR conversation_id IN ?", csID, convIDs)
+	db.Unscoped().Where("message_id IN (?)", messageIDs).Delete(&models.MessageRevision{})
+	db.Where("message_id IN (?)", messageIDs).Delete(&models.MessageAttachment{})
+	db.Unscoped().Where("customer_service_id = ? OR conversation_id IN ?", csID, convIDs).Delete(&models.Message{})
+	db.Unscoped().Where("conversation_id IN ?", convIDs).Delete(&models.ConversationTransfer{})
+	db.Unscoped().Where("conversation_id IN ?", convIDs).Delete(&models.ConversationTag{})
+	db.Unscoped().Where("conversation_id IN ?", convIDs).Delete(&models.Rating{})
+	db.Unscoped().Where("conversation_id IN ?", convIDs).Delete(&models.InternalNote{})
+	db.Unscoped().Where("id IN ?", convIDs).Delete(&models.Conversation{})
 	
-	// 2. 删除该客服的所有分配关系（硬删除）
+	// 2. 删除该客服的所有分配关系和个人快捷回复（硬删除）
 	db.Unscoped().Where("customer_service_id = ?", csID).Delete(&models.Assignment{})
+	db.Unscoped().Where("scope = ? AND customer_service_id = ?", models.CannedPersonal, csID).Delete(&models.CannedResponse{})
 	
 	// 3. 最后删除客服本身（硬删除）
 	if err := db.Unscoped().Delete(&cs).Error; err != nil {
@@ -428,9 +486,24 @@ func getCSUsers(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	// 获取这些小程序下的所有用户
+	// 获取这些小程序下的所有用户，可按标签筛选（?tag=标签ID或名称，多个用逗号分隔，满足任意一个即可）
 	var users []models.User
-	db.Where("mini_app_id IN ?", miniAppIDs).Find(&users)
+	query := db.Where("mini_app_id IN ?", miniAppIDs)
+	if q := c.Query("tag"); q != "" {
+		tagIDs, ok := parseTagFilter(db, q)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "标签不存在"})
+			return
+		}
+		query = query.Where("id IN (?)", db.Model(&models.UserTag{}).Select("user_id").Where("tag_id IN ?", tagIDs))
+	}
+	query.Find(&users)
+
+	var userIDs []uint
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+	userTags := userTagsOf(db, userIDs)
 	
 	// 获取小程序信息
 	var miniApps []models.MiniApp
@@ -448,7 +521,8 @@ func getCSUsers(c *gin.Context, db *gorm.DB) {
 		LastMessageTime string `json:"LastMessageTime"`
 		UnreadCount int `json:"UnreadCount"`
 		Subscribed bool `json:"Subscribed"` // 是否已授权订阅消息
-		IsOnline bool `json:"IsOnline"` // 是否在线（5分钟内有活动）
+		IsOnline bool `json:"IsOnline"` // 是否在线（在线阈值内有活动）
+		Tags []models.Tag `json:"Tags"` // 用户标签
 	}
 	
 	var result []UserWithInfo
@@ -464,37 +538,26 @@ func getCSUsers(c *gin.Context, db *gorm.DB) {
 			}
 		}
 		
-		// 获取最后一条消息
+		// 获取最后一条消息（按用户查询，包括转接前其他客服的记录）
 		var lastMsg models.Message
-		db.Where("user_id = ? AND customer_service_id = ?", user.ID, csID).
+		db.Where("user_id = ?", user.ID).
 			Order("created_at DESC").First(&lastMsg)
 		
 		lastMessage := ""
 		lastMessageTime := ""
 		if lastMsg.ID > 0 {
-			if lastMsg.IsImage {
-				lastMessage = "[图片]"
-			} else {
-				lastMessage = lastMsg.Content
-				if len(lastMessage) > 30 {
-					lastMessage = lastMessage[:30] + "..."
-				}
-			}
+			lastMessage = truncateRunes(messageSummary(lastMsg), 30)
 			lastMessageTime = lastMsg.CreatedAt.Format("2006-01-02 15:04:05")
 		}
 		
 		// 统计未读消息数（用户发送的，客服未读的）
 		var unreadCount int64
 		db.Model(&models.Message{}).
-			Where("user_id = ? AND customer_service_id = ? AND from_user = ? AND is_read = ?", user.ID, csID, true, false).
+			Where("user_id = ? AND from_user = ? AND is_read = ?", user.ID, true, false).
 			Count(&unreadCount)
 		
-		// 判断用户是否在线（1分钟内有活动，实时检测）
-		isOnline := false
-		if user.LastActiveTime != nil {
-			timeSinceActive := time.Since(*user.LastActiveTime)
-			isOnline = timeSinceActive < 1*time.Minute
-		}
+		// 判断用户是否在线（在线阈值由 presence 统一配置）
+		isOnline := presence.IsUserOnline(user)
 		
 		result = append(result, UserWithInfo{
 			User: user,
@@ -504,6 +567,7 @@ func getCSUsers(c *gin.Context, db *gorm.DB) {
 			UnreadCount: int(unreadCount),
 			Subscribed: user.Subscribed,
 			IsOnline: isOnline,
+			Tags: userTags[user.ID],
 		})
 	}
 	
@@ -536,8 +600,16 @@ func deleteUser(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	// 删除用户的所有消息（硬删除）
+	// 删除用户的所有消息、会话、备注和标签（硬删除）
 	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.Message{})
+	db.Unscoped().Where("conversation_id IN (?)", db.Model(&models.Conversation{}).Select("id").Where("user_id = ?", uint(userID))).Delete(&models.ConversationTransfer{})
+	db.Unscoped().Where("conversation_id IN (?)", db.Model(&models.Conversation{}).Select("id").Where("user_id = ?", uint(userID))).Delete(&models.ConversationTag{})
+	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.InternalNote{})
+	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.UserTag{})
+	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.Rating{})
+	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.MessageRevision{})
+	db.Where("user_id = ?", uint(userID)).Delete(&models.MessageAttachment{})
+	db.Unscoped().Where("user_id = ?", uint(userID)).Delete(&models.Conversation{})
 	
 	// 删除用户（硬删除）
 	if err := db.Unscoped().Delete(&user).Error; err != nil {
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"h5-backend/models"
+)
+
+func TestDeleteCustomerServiceConversations(t *testing.T) {
+	db := newTestDB(t, &models.CustomerService{}, &models.Assignment{}, &models.CannedResponse{},
+		&models.Conversation{}, &models.Message{}, &models.MessageRevision{}, &models.MessageAttachment{},
+		&models.ConversationTransfer{}, &models.ConversationTag{}, &models.Rating{}, &models.InternalNote{})
+	db.Create(&models.CustomerService{Name: "客服1"})
+	db.Create(&models.CustomerService{Name: "客服2"})
+
+	// 会话 1 由客服 1 转接给客服 2；会话 2 由客服 2 转接给客服 1
+	db.Create(&models.Conversation{UserID: 1, CustomerServiceID: 2})
+	db.Create(&models.Conversation{UserID: 2, CustomerServiceID: 1})
+	db.Create(&models.Message{UserID: 1, CustomerServiceID: 1, ConversationID: 1, Content: "转接前"})
+	db.Create(&models.Message{UserID: 1, CustomerServiceID: 2, ConversationID: 1, Content: "转接后"})
+	db.Create(&models.Message{UserID: 2, CustomerServiceID: 2, ConversationID: 2, Content: "转接前"})
+	db.Create(&models.Message{UserID: 2, CustomerServiceID: 1, ConversationID: 2, Content: "转接后"})
+	db.Create(&models.Rating{ConversationID: 1, UserID: 1, CustomerServiceID: 2, Score: 5})
+	db.Create(&models.Rating{ConversationID: 2, UserID: 2, CustomerServiceID: 1, Score: 4})
+	db.Create(&models.ConversationTransfer{ConversationID: 1})
+	db.Create(&models.InternalNote{UserID: 1, ConversationID: 1, CustomerServiceID: 1, Content: "备注"})
+
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest("DELETE", "/admin/cs/2", nil)
+	c.Params = gin.Params{{Key: "id", Value: "2"}}
+	deleteCustomerService(c, db)
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var dangling int64
+	db.Model(&models.Message{}).Where("conversation_id NOT IN (?)", db.Model(&models.Conversation{}).Select("id")).Count(&dangling)
+	if dangling != 0 {
+		t.Errorf("%d 条消息指向已删除的会话", dangling)
+	}
+	var msgs []models.Message
+	db.Find(&msgs)
+	if len(msgs) != 1 || msgs[0].ConversationID != 2 || msgs[0].CustomerServiceID != 1 {
+		t.Errorf("剩余消息 = %+v，want 会话 2 中客服 1 的消息", msgs)
+	}
+	for _, m := range []interface{}{&models.Rating{}, &models.ConversationTransfer{}, &models.InternalNote{}} {
+		var n int64
+		db.Model(m).Where("conversation_id = ?", 1).Count(&n)
+		if n != 0 {
+			t.Errorf("%T 仍有会话 1 的记录", m)
+		}
+	}
+	var ratings int64
+	db.Model(&models.Rating{}).Count(&ratings)
+	if ratings != 1 {
+		t.Errorf("ratings = %d，want 1", ratings)
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+var (
+	// autoAway 因长时间未操作被自动设为离开的客服，重新活动时恢复在线
+	autoAway   = make(map[uint]bool)
+	autoAwayMu sync.Mutex
+)
+
+// isValidCSStatus 检查客服状态是否合法
+func isValidCSStatus(status string) bool {
+	switch status {
+	case models.CSStatusOnline, models.CSStatusAway, models.CSStatusBusy, models.CSStatusOffline:
+		return true
+	}
+	return false
+}
+
+// setAgentStatus 更新客服状态并通知客服端（多个标签页同步）
+func setAgentStatus(db *gorm.DB, csID uint, status string) error {
+	if err := db.Model(&models.CustomerService{}).Where("id = ?", csID).Update("status", status).Error; err != nil {
+		return err
+	}
+	autoAwayMu.Lock()
+	delete(autoAway, csID)
+	autoAwayMu.Unlock()
+	notifyCS(csID, wsEvent{Type: "status", Data: gin.H{"status": status}})
+	if status == models.CSStatusOnline {
+		dispatchForAgent(db, csID)
+	}
+	return nil
+}
+
+// agentConnected 客服建立 WebSocket 连接：离线则自动上线，离开/忙碌保持不变
+func agentConnected(db *gorm.DB, csID uint) {
+	presence.TouchAgent(csID)
+	// 立即写入最后活动时间，断线检查据此判断是否已在其他实例重连
+	db.Model(&models.CustomerService{}).Where("id = ?", csID).UpdateColumn("last_active_time", time.Now())
+	res := db.Model(&models.CustomerService{}).
+		Where("id = ? AND status = ?", csID, models.CSStatusOffline).
+		Update("status", models.CSStatusOnline)
+	if res.Error == nil && res.RowsAffected > 0 {
+		notifyCS(csID, wsEvent{Type: "status", Data: gin.H{"status": models.CSStatusOnline}})
+		dispatchForAgent(db, csID)
+	}
+}
+
+// agentDisconnected 客服断开连接，宽限期内未重连则设为离线（客服端断线会立即重连）
+func agentDisconnected(db *gorm.DB, csID uint) {
+	presence.RemoveAgent(csID)
+	disconnectedAt := time.Now()
+	time.AfterFunc(envDuration("AGENT_OFFLINE_GRACE", 30*time.Second), func() {
+		connMutex.Lock()
+		_, ok := connections[csID]
+		connMutex.Unlock()
+		if ok {
+			return
+		}
+		var cs models.CustomerService
+		if err := db.First(&cs, csID).Error; err != nil {
+			return
+		}
+		// 已在其他实例重新连接
+		if cs.LastActiveTime != nil && cs.LastActiveTime.After(disconnectedAt) {
+			return
+		}
+		if cs.Status != models.CSStatusOffline {
+			if err := setAgentStatus(db, csID, models.CSStatusOffline); err != nil {
+				log.Printf("[客服状态] 设置离线失败，csID=%d, error=%v", csID, err)
+			}
+		}
+	})
+}
+
+// agentActive 客服有操作（发送消息等），自动离开的客服恢复在线
+func agentActive(db *gorm.DB, csID uint) {
+	presence.TouchAgent(csID)
+	autoAwayMu.Lock()
+	wasAutoAway := autoAway[csID]
+	delete(autoAway, csID)
+	autoAwayMu.Unlock()
+	if !wasAutoAway {
+		return
+	}
+	res := db.Model(&models.CustomerService{}).
+		Where("id = ? AND status = ?", csID, models.CSStatusAway).
+		Update("status", models.CSStatusOnline)
+	if res.Error == nil && res.RowsAffected > 0 {
+		notifyCS(csID, wsEvent{Type: "status", Data: gin.H{"status": models.CSStatusOnline}})
+		dispatchForAgent(db, csID)
+	}
+}
+
+// startAgentIdleCheck 在线客服超过 AGENT_IDLE_TIMEOUT 未操作则自动设为离开
+func startAgentIdleCheck(db *gorm.DB) {
+	idle := envDuration("AGENT_IDLE_TIMEOUT", 10*time.Minute)
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, csID := range presence.idleAgents(idle) {
+				res := db.Model(&models.CustomerService{}).
+					Where("id = ? AND status = ?", csID, models.CSStatusOnline).
+					Update("status", models.CSStatusAway)
+				if res.Error != nil || res.RowsAffected == 0 {
+					continue
+				}
+				autoAwayMu.Lock()
+				autoAway[csID] = true
+				autoAwayMu.Unlock()
+				notifyCS(csID, wsEvent{Type: "status", Data: gin.H{"status": models.CSStatusAway, "auto": true}})
+			}
+		}
+	}()
+}
+
+// agentLoad 客服当前接待中的会话数（已分配或等待用户回复）
+func agentLoad(db *gorm.DB, csID uint) int64 {
+	var n int64
+	db.Model(&models.Conversation{}).
+		Where("customer_service_id = ? AND status IN ?", csID,
+			[]string{models.ConversationAssigned, models.ConversationPendingUser}).
+		Count(&n)
+	return n
+}
+
+// isAgentAvailable 客服是否可以接待新会话：在线且未达到最大接待数
+func isAgentAvailable(db *gorm.DB, cs models.CustomerService) bool {
+	if cs.Status != models.CSStatusOnline {
+		return false
+	}
+	return cs.MaxConcurrent <= 0 || agentLoad(db, cs.ID) < int64(cs.MaxConcurrent)
+}
+
+// updateCSStatus 设置客服状态（客服端或管理员）
+func updateCSStatus(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("id"))
+	var req struct {
+		Status string `json:"Status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || csID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	if !isValidCSStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的状态，可选值: online/away/busy/offline"})
+		return
+	}
+
+	var cs models.CustomerService
+	if err := db.First(&cs, csID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "客服不存在"})
+		return
+	}
+	if err := setAgentStatus(db, csID, req.Status); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "更新成功", "Status": req.Status})
+}
+
+// updateCSCapacity 设置客服最大同时接待会话数
+func updateCSCapacity(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("id"))
+	var req struct {
+		MaxConcurrent int `json:"MaxConcurrent"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || csID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	if req.MaxConcurrent < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "最大接待数不能为负数"})
+		return
+	}
+
+	var cs models.CustomerService
+	if err := db.First(&cs, csID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "客服不存在"})
+		return
+	}
+	if err := db.Model(&cs).Update("max_concurrent", req.MaxConcurrent).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+		return
+	}
+	dispatchForAgent(db, csID)
+	c.JSON(http.StatusOK, gin.H{"message": "更新成功", "MaxConcurrent": req.MaxConcurrent})
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+// unreferencedAttachments 没有被任何消息引用的文件
+const unreferencedAttachments = "NOT EXISTS (SELECT 1 FROM message_attachments WHERE message_attachments.attachment_id = attachments.id)"
+
+// uploaderFromRequest 从上传表单识别上传者：客服传 csId，小程序用户传 appId 和 openId，都没有时为空
+func uploaderFromRequest(c *gin.Context, db *gorm.DB) (string, uint) {
+	csID, _ := strconv.ParseUint(c.PostForm("csId"), 10, 32)
+	return findUploader(db, uint(csID), c.PostForm("appId"), c.PostForm("openId"))
+}
+
+// findUploader 按客服 ID 或小程序用户查找上传者
+func findUploader(db *gorm.DB, csID uint, appID, openID string) (string, uint) {
+	if csID > 0 {
+		var cs models.CustomerService
+		if db.Select("id").First(&cs, csID).Error == nil {
+			return models.UploaderCS, cs.ID
+		}
+	}
+	if appID != "" && openID != "" {
+		var user models.User
+		if db.Select("id").Where("mini_app_id = ? AND open_id = ?", findMiniAppID(db, appID), openID).First(&user).Error == nil {
+			return models.UploaderUser, user.ID
+		}
+	}
+	return "", 0
+}
+
+// attachmentFile 已保存文件的上传结果
+func attachmentFile(a models.Attachment, name string) uploadedFile {
+	out := uploadedFile{
+		ID:       a.ID,
+		Key:      a.Key,
+		URL:      store.URL(a.Key),
+		Kind:     a.Kind,
+		MimeType: a.MimeType,
+		Size:     a.Size,
+		Name:     name,
+		Width:    a.Width,
+		Height:   a.Height,
+		Blurhash: a.Blurhash,
+	}
+	if a.Kind == UploadImage {
+		out.DisplayURL = out.URL
+		if a.DisplayKey != "" {
+			out.DisplayURL = store.URL(a.DisplayKey)
+		}
+		if a.ThumbKey != "" {
+			out.ThumbURL = store.URL(a.ThumbKey)
+		}
+	}
+	return out
+}
+
+// reuseAttachment 查找内容相同的已上传文件。记录存在但文件已丢失时删除记录，重新保存
+func reuseAttachment(ctx context.Context, db *gorm.DB, hash, kind string) (models.Attachment, bool) {
+	var a models.Attachment
+	if err := db.Where("hash = ? AND kind = ?", hash, kind).First(&a).Error; err != nil {
+		return a, false
+	}
+	if _, err := store.Stat(ctx, a.Key); errors.Is(err, storage.ErrNotFound) {
+		log.Printf("[附件] 文件已丢失，重新保存，attachmentID=%d, key=%s", a.ID, a.Key)
+		db.Unscoped().Delete(&a)
+		return a, false
+	}
+	touchAttachments(db, []uint{a.ID})
+	return a, true
+}
+
+// saveAttachment 保存文件记录。并发上传相同内容时唯一索引冲突，使用先保存的记录并删除本次写入的文件
+func saveAttachment(ctx context.Context, db *gorm.DB, a models.Attachment) (models.Attachment, error) {
+	now := time.Now()
+	a.LastUsedAt = &now
+	if err := db.Create(&a).Error; err != nil {
+		if existing, ok := reuseAttachment(ctx, db, a.Hash, a.Kind); ok {
+			deleteAttachmentObjects(ctx, a)
+			return existing, nil
+		}
+		log.Printf("[附件] 保存记录失败，key=%s, error=%v", a.Key, err)
+		deleteAttachmentObjects(ctx, a)
+		return a, uploadFail(http.StatusInternalServerError, UploadErrStorage, "保存文件失败")
+	}
+	return a, nil
+}
+
+// deleteAttachmentObjects 删除文件及图片的显示图、缩略图
+func deleteAttachmentObjects(ctx context.Context, a models.Attachment) {
+	for _, key := range []string{a.Key, a.DisplayKey, a.ThumbKey} {
+		if key == "" {
+			continue
+		}
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("[附件] 删除文件失败，key=%s, error=%v", key, err)
+		}
+	}
+}
+
+// touchAttachments 更新最近使用时间，避免刚被引用的文件在保留期边界被清理
+func touchAttachments(db *gorm.DB, ids []uint) {
+	if len(ids) > 0 {
+		db.Model(&models.Attachment{}).Where("id IN ?", ids).UpdateColumn("last_used_at", time.Now())
+	}
+}
+
+// resolveAttachments 查找消息 Payload 中引用的已上传文件，并用服务端记录覆盖客户端提供的文件信息
+// （图片尺寸、显示图、缩略图，文件大小和类型）。返回引用的文件，消息保存后由 linkAttachments 记录引用
+func resolveAttachments(db *gorm.DB, msg *models.Message) []uint {
+	if len(msg.Payload) == 0 || store == nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(msg.Payload, &fields) != nil {
+		return nil
+	}
+	var ids []uint
+	seen := map[uint]bool{}
+	for _, f := range mediaPayloadFields {
+		url, _ := fields[f].(string)
+		key, ok := storage.KeyFromURL(store, url)
+		if !ok {
+			continue
+		}
+		var a models.Attachment
+		if db.Where("`key` = ? OR display_key = ? OR thumb_key = ?", key, key, key).First(&a).Error != nil {
+			continue
+		}
+		if !seen[a.ID] {
+			seen[a.ID] = true
+			ids = append(ids, a.ID)
+		}
+		if f != "url" || a.Key != key {
+			continue
+		}
+		switch {
+		case msg.Type == models.MessageTypeImage && a.Kind == UploadImage:
+			file := attachmentFile(a, "")
+			fields["width"], fields["height"] = a.Width, a.Height
+			fields["displayUrl"], fields["thumbUrl"] = file.DisplayURL, file.ThumbURL
+			fields["blurhash"] = a.Blurhash
+		case msg.Type == models.MessageTypeFile:
+			fields["size"], fields["mimeType"] = a.Size, a.MimeType
+		}
+	}
+	if len(ids) > 0 {
+		msg.Payload, _ = json.Marshal(fields)
+		touchAttachments(db, ids)
+	}
+	return ids
+}
+
+// linkAttachments 记录消息引用的文件
+func linkAttachments(db *gorm.DB, msg models.Message, ids []uint) {
+	for _, id := range ids {
+		ref := models.MessageAttachment{MessageID: msg.ID, AttachmentID: id, UserID: msg.UserID}
+		if err := db.Create(&ref).Error; err != nil {
+			log.Printf("[附件] 记录引用失败，messageID=%d, attachmentID=%d, error=%v", msg.ID, id, err)
+		}
+	}
+}
+
+// attachmentInUse 文件是否被自动回复规则或用户头像使用（这些地址不经过消息发送，没有引用记录）
+func attachmentInUse(db *gorm.DB, a models.Attachment) bool {
+	var urls []string
+	for _, key := range []string{a.Key, a.DisplayKey, a.ThumbKey} {
+		if key != "" {
+			urls = append(urls, store.URL(key))
+		}
+	}
+	var count int64
+	db.Model(&models.AutoReplyRule{}).Where("reply_image_url IN ?", urls).Count(&count)
+	if count > 0 {
+		return true
+	}
+	db.Model(&models.User{}).Where("avatar_url IN ?", urls).Count(&count)
+	return count > 0
+}
+
+// collectAttachments 删除超过保留期且没有被引用的文件，返回删除的数量
+func collectAttachments(db *gorm.DB, grace time.Duration) int {
+	// 先清理消息已被删除的引用记录
+	db.Where("NOT EXISTS (SELECT 1 FROM messages WHERE messages.id = message_attachments.message_id)").Delete(&models.MessageAttachment{})
+
+	cutoff := time.Now().Add(-grace)
+	deleted := 0
+	lastID := uint(0)
+	for {
+		var list []models.Attachment
+		db.Where("id > ? AND last_used_at < ?", lastID, cutoff).Where(unreferencedAttachments).
+			Order("id").Limit(200).Find(&list)
+		for _, a := range list {
+			lastID = a.ID
+			if attachmentInUse(db, a) {
+				continue
+			}
+			// 带条件删除记录，多实例同时清理或文件刚被引用时只有删除成功的实例删除文件
+			res := db.Unscoped().Where("id = ? AND last_used_at < ?", a.ID, cutoff).Where(unreferencedAttachments).Delete(&models.Attachment{})
+			if res.Error != nil || res.RowsAffected == 0 {
+				continue
+			}
+			deleteAttachmentObjects(context.Background(), a)
+			deleted++
+		}
+		if len(list) < 200 {
+			return deleted
+		}
+	}
+}
+
+// startAttachmentGC 定期清理没有被引用的文件。
+// ATTACHMENT_GC_GRACE 为上传或最近引用后的保留期（默认 24 小时），ATTACHMENT_GC_INTERVAL 为清理间隔（默认 1 小时）
+func startAttachmentGC(db *gorm.DB) {
+	grace := envDuration("ATTACHMENT_GC_GRACE", 24*time.Hour)
+	interval := envDuration("ATTACHMENT_GC_INTERVAL", time.Hour)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := collectAttachments(db, grace); n > 0 {
+				log.Printf("[附件] 已清理 %d 个未引用的文件", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// regexCache 已编译的正则，避免每条消息都重新编译
+var regexCache sync.Map // pattern -> *regexp.Regexp
+
+func compileKeyword(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(pattern, re)
+	return re, nil
+}
+
+// pageCardPayload 小程序页面卡片内容
+type pageCardPayload struct {
+	Title    string `json:"title"`
+	PagePath string `json:"pagePath"`
+	ThumbURL string `json:"thumbUrl,omitempty"`
+	AppID    string `json:"appId"`
+}
+
+// ruleMatches 判断消息内容是否命中规则，exact/contains 忽略大小写
+func ruleMatches(rule models.AutoReplyRule, content string) bool {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return false
+	}
+	switch rule.MatchType {
+	case models.MatchExact:
+		return strings.EqualFold(content, strings.TrimSpace(rule.Keyword))
+	case models.MatchContains:
+		return strings.Contains(strings.ToLower(content), strings.ToLower(rule.Keyword))
+	case models.MatchRegex:
+		re, err := compileKeyword(rule.Keyword)
+		return err == nil && re.MatchString(content)
+	}
+	return false
+}
+
+// matchAutoReply 按优先级从高到低匹配小程序已启用的规则，优先级相同时先创建的优先，未命中返回 nil
+func matchAutoReply(db *gorm.DB, miniAppID uint, content string) *models.AutoReplyRule {
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	var rules []models.AutoReplyRule
+	db.Where("mini_app_id = ? AND enabled = ?", miniAppID, true).Order("priority DESC, id ASC").Find(&rules)
+	for i := range rules {
+		if ruleMatches(rules[i], content) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// validateAutoReplyRule 校验规则的匹配方式、关键词和回复内容
+func validateAutoReplyRule(rule *models.AutoReplyRule) error {
+	if rule.MatchType == "" {
+		rule.MatchType = models.MatchContains
+	}
+	if rule.ReplyType == "" {
+		rule.ReplyType = models.MessageTypeText
+	}
+	if strings.TrimSpace(rule.Keyword) == "" {
+		return fmt.Errorf("关键词不能为空")
+	}
+	switch rule.MatchType {
+	case models.MatchExact, models.MatchContains:
+	case models.MatchRegex:
+		if _, err := compileKeyword(rule.Keyword); err != nil {
+			return fmt.Errorf("正则表达式错误: %v", err)
+		}
+	default:
+		return fmt.Errorf("无效的匹配方式（可选 exact/contains/regex）")
+	}
+	switch rule.ReplyType {
+	case models.MessageTypeText:
+		if strings.TrimSpace(rule.ReplyContent) == "" {
+			return fmt.Errorf("回复内容不能为空")
+		}
+	case models.MessageTypeImage:
+		if rule.ReplyImageURL == "" {
+			return fmt.Errorf("回复图片不能为空")
+		}
+	case models.MessageTypeMiniProgram:
+		if rule.ReplyContent == "" || rule.ReplyPagePath == "" {
+			return fmt.Errorf("小程序卡片需要标题和页面路径")
+		}
+	default:
+		return fmt.Errorf("无效的回复类型（可选 text/image/miniprogram）")
+	}
+	return nil
+}
+
+// autoReplyMessage 根据规则生成回复消息（未保存）
+func autoReplyMessage(rule models.AutoReplyRule, appID string, conv models.Conversation, csID uint) models.Message {
+	msg := models.Message{
+		UserID:            conv.UserID,
+		CustomerServiceID: csID,
+		ConversationID:    conv.ID,
+		Content:           rule.ReplyContent,
+		Type:              rule.ReplyType,
+		IsBot:             true,
+	}
+	switch rule.ReplyType {
+	case models.MessageTypeImage:
+		msg.IsImage = true
+		msg.ImageURL = rule.ReplyImageURL
+	case models.MessageTypeMiniProgram:
+		msg.Payload, _ = json.Marshal(pageCardPayload{
+			Title:    rule.ReplyContent,
+			PagePath: rule.ReplyPagePath,
+			ThumbURL: rule.ReplyImageURL,
+			AppID:    appID,
+		})
+	}
+	return msg
+}
+
+// sendAutoReply 保存自动回复消息，已分配客服时同步推送给客服
+func sendAutoReply(db *gorm.DB, rule models.AutoReplyRule, ma models.MiniApp, conv models.Conversation, csID uint) models.Message {
+	msg := autoReplyMessage(rule, ma.AppID, conv, csID)
+	db.Create(&msg)
+	notifyCS(csID, msg)
+	return msg
+}
+
+// getAutoReplyRules 获取小程序的自动回复规则
+func getAutoReplyRules(c *gin.Context, db *gorm.DB) {
+	var rules []models.AutoReplyRule
+	db.Where("mini_app_id = ?", parseUint(c.Param("id"))).Order("priority DESC, id ASC").Find(&rules)
+	c.JSON(http.StatusOK, rules)
+}
+
+// addAutoReplyRule 添加自动回复规则
+func addAutoReplyRule(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	// Enabled 单独按指针解析，区分未传（默认启用）和显式传 false
+	var req struct {
+		models.AutoReplyRule
+		Enabled *bool `json:"Enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	rule := req.AutoReplyRule
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	if err := validateAutoReplyRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID = 0
+	rule.MiniAppID = miniAppID
+	rule.Enabled = true
+	if err := db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加失败: " + err.Error()})
+		return
+	}
+	if req.Enabled != nil && !*req.Enabled {
+		db.Model(&rule).Update("enabled", false)
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// updateAutoReplyRule 修改自动回复规则
+func updateAutoReplyRule(c *gin.Context, db *gorm.DB) {
+	var rule models.AutoReplyRule
+	if err := db.First(&rule, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "规则不存在"})
+		return
+	}
+	id, miniAppID, createdAt := rule.ID, rule.MiniAppID, rule.CreatedAt
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	rule.ID, rule.MiniAppID, rule.CreatedAt = id, miniAppID, createdAt
+	if err := validateAutoReplyRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "修改失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// deleteAutoReplyRule 删除自动回复规则
+func deleteAutoReplyRule(c *gin.Context, db *gorm.DB) {
+	if err := db.Unscoped().Delete(&models.AutoReplyRule{}, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
+
+// testAutoReplyRules 试运行：用一条消息内容匹配小程序的规则，返回命中的规则和将要发送的回复，不保存任何数据
+func testAutoReplyRules(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	var ma models.MiniApp
+	if err := db.First(&ma, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	rule := matchAutoReply(db, ma.ID, req.Content)
+	if rule == nil {
+		c.JSON(http.StatusOK, gin.H{"matched": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"matched":   true,
+		"rule":      rule,
+		"reply":     autoReplyMessage(*rule, ma.AppID, models.Conversation{}, 0),
+		"skipHuman": rule.SkipHuman,
+	})
+}
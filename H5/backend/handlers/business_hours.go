@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // alpine 镜像没有时区数据，内置一份
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// weekdayKeys 每周工作时间的 key
+var weekdayKeys = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// timeRange 一段工作时间，如 {"start":"09:00","end":"18:00"}
+type timeRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// minuteRange 当天从 0 点起的分钟区间 [start, end)
+type minuteRange struct {
+	start, end int
+}
+
+// businessCalendar 小程序的工作日历，nil 表示全天工作
+type businessCalendar struct {
+	loc      *time.Location
+	weekly   map[time.Weekday][]minuteRange
+	holidays map[string][]minuteRange // 日期 -> 当天工作时间，空表示全天休息
+	reply    string
+}
+
+// parseClock 解析 "15:04"，允许 "24:00" 表示当天结束
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("时间格式错误: %s", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("时间格式错误: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseRange(r timeRange) (minuteRange, error) {
+	start, err := parseClock(r.Start)
+	if err != nil {
+		return minuteRange{}, err
+	}
+	end, err := parseClock(r.End)
+	if err != nil {
+		return minuteRange{}, err
+	}
+	if end <= start {
+		return minuteRange{}, fmt.Errorf("结束时间必须晚于开始时间: %s-%s", r.Start, r.End)
+	}
+	return minuteRange{start, end}, nil
+}
+
+// parseWeeklySchedule 解析并校验每周工作时间 JSON
+func parseWeeklySchedule(raw string) (map[time.Weekday][]minuteRange, error) {
+	weekly := make(map[time.Weekday][]minuteRange)
+	if raw == "" {
+		return weekly, nil
+	}
+	var schedule map[string][]timeRange
+	if err := json.Unmarshal([]byte(raw), &schedule); err != nil {
+		return nil, fmt.Errorf("工作时间格式错误: %v", err)
+	}
+	for key, ranges := range schedule {
+		day, ok := weekdayKeys[strings.ToLower(key)]
+		if !ok {
+			return nil, fmt.Errorf("无效的星期: %s（可选 mon/tue/wed/thu/fri/sat/sun）", key)
+		}
+		for _, r := range ranges {
+			mr, err := parseRange(r)
+			if err != nil {
+				return nil, err
+			}
+			weekly[day] = append(weekly[day], mr)
+		}
+		sort.Slice(weekly[day], func(i, j int) bool { return weekly[day][i].start < weekly[day][j].start })
+	}
+	return weekly, nil
+}
+
+// loadCalendar 读取小程序的工作日历，未配置或未启用时返回 nil（全天工作）
+func loadCalendar(db *gorm.DB, miniAppID uint) *businessCalendar {
+	var bh models.BusinessHours
+	if err := db.Where("mini_app_id = ?", miniAppID).First(&bh).Error; err != nil || !bh.Enabled {
+		return nil
+	}
+	loc, err := time.LoadLocation(bh.TimeZone)
+	if err != nil {
+		loc = time.Local
+	}
+	weekly, err := parseWeeklySchedule(bh.WeeklySchedule)
+	if err != nil {
+		return nil
+	}
+	cal := &businessCalendar{loc: loc, weekly: weekly, holidays: make(map[string][]minuteRange), reply: bh.AfterHoursReply}
+
+	var holidays []models.BusinessHoliday
+	db.Where("mini_app_id = ?", miniAppID).Find(&holidays)
+	for _, h := range holidays {
+		cal.holidays[h.Date] = nil
+		if !h.Closed {
+			if mr, err := parseRange(timeRange{h.Start, h.End}); err == nil {
+				cal.holidays[h.Date] = []minuteRange{mr}
+			}
+		}
+	}
+	return cal
+}
+
+// rangesOn 某天（小程序时区）的工作时间，例外日期优先
+func (c *businessCalendar) rangesOn(day time.Time) []minuteRange {
+	if ranges, ok := c.holidays[day.Format("2006-01-02")]; ok {
+		return ranges
+	}
+	return c.weekly[day.Weekday()]
+}
+
+// at 某天（小程序时区）第 minute 分钟对应的时刻。按日期和钟点构造而不是零点加时长，夏令时切换当天也能得到正确的钟点
+func (c *businessCalendar) at(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, minute, 0, 0, c.loc)
+}
+
+// IsOpen 判断某时刻是否在工作时间内
+func (c *businessCalendar) IsOpen(t time.Time) bool {
+	if c == nil {
+		return true
+	}
+	local := t.In(c.loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range c.rangesOn(local) {
+		if minute >= r.start && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen 返回 t 之后最近的工作开始时间（t 在工作时间内时返回 t），两周内没有工作时间返回零值
+func (c *businessCalendar) nextOpen(t time.Time) time.Time {
+	if c == nil || c.IsOpen(t) {
+		return t
+	}
+	local := t.In(c.loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.loc)
+	for i := 0; i < 14; i++ {
+		day := midnight.AddDate(0, 0, i)
+		for _, r := range c.rangesOn(day) {
+			start := c.at(day, r.start)
+			if start.After(t) {
+				return start
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// addBusinessTime 从 start 开始经过 d 的工作时间后的时刻，用于计算 SLA 截止时间
+func (c *businessCalendar) addBusinessTime(start time.Time, d time.Duration) time.Time {
+	if c == nil {
+		return start.Add(d)
+	}
+	local := start.In(c.loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.loc)
+	remaining := d
+	for i := 0; i < 366; i++ {
+		day := midnight.AddDate(0, 0, i)
+		for _, r := range c.rangesOn(day) {
+			from := c.at(day, r.start)
+			to := c.at(day, r.end)
+			if to.Before(start) || to.Equal(start) {
+				continue
+			}
+			if from.Before(start) {
+				from = start
+			}
+			span := to.Sub(from)
+			if span >= remaining {
+				return from.Add(remaining)
+			}
+			remaining -= span
+		}
+	}
+	return start.Add(d)
+}
+
+// firstResponseDue 首次响应截止时间：SLA_FIRST_RESPONSE 按工作时间累计
+func firstResponseDue(db *gorm.DB, miniAppID uint, from time.Time) time.Time {
+	return loadCalendar(db, miniAppID).addBusinessTime(from, envDuration("SLA_FIRST_RESPONSE", 5*time.Minute))
+}
+
+// sendAfterHoursReply 非工作时间自动回复，每个会话只发送一次
+func sendAfterHoursReply(db *gorm.DB, cal *businessCalendar, conv *models.Conversation) {
+	if cal == nil || cal.reply == "" || conv.AfterHoursReplied {
+		return
+	}
+	res := db.Model(&models.Conversation{}).
+		Where("id = ? AND after_hours_replied = ?", conv.ID, false).
+		Update("after_hours_replied", true)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	conv.AfterHoursReplied = true
+	db.Create(&models.Message{
+		UserID:         conv.UserID,
+		ConversationID: conv.ID,
+		Content:        cal.reply,
+		IsSystem:       true,
+	})
+}
+
+// getBusinessHours 获取小程序的工作时间和例外日期
+func getBusinessHours(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var bh models.BusinessHours
+	if err := db.Where("mini_app_id = ?", miniAppID).First(&bh).Error; err != nil {
+		bh = models.BusinessHours{MiniAppID: miniAppID, TimeZone: "Asia/Shanghai"}
+	}
+	var holidays []models.BusinessHoliday
+	db.Where("mini_app_id = ?", miniAppID).Order("date ASC").Find(&holidays)
+
+	now := time.Now()
+	cal := loadCalendar(db, miniAppID)
+	c.JSON(http.StatusOK, gin.H{
+		"businessHours": bh,
+		"holidays":      holidays,
+		"isOpen":        cal.IsOpen(now),
+		"nextOpen":      cal.nextOpen(now),
+	})
+}
+
+// updateBusinessHours 设置小程序的工作时间
+func updateBusinessHours(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var req struct {
+		Enabled         bool                   `json:"Enabled"`
+		TimeZone        string                 `json:"TimeZone"`
+		WeeklySchedule  map[string][]timeRange `json:"WeeklySchedule"`
+		AfterHoursReply string                 `json:"AfterHoursReply"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	if req.TimeZone == "" {
+		req.TimeZone = "Asia/Shanghai"
+	}
+	if _, err := time.LoadLocation(req.TimeZone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时区: " + req.TimeZone})
+		return
+	}
+	schedule, _ := json.Marshal(req.WeeklySchedule)
+	if _, err := parseWeeklySchedule(string(schedule)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var bh models.BusinessHours
+	db.Where("mini_app_id = ?", miniAppID).First(&bh)
+	bh.MiniAppID = miniAppID
+	bh.Enabled = req.Enabled
+	bh.TimeZone = req.TimeZone
+	bh.WeeklySchedule = string(schedule)
+	bh.AfterHoursReply = req.AfterHoursReply
+	if err := db.Save(&bh).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "设置成功", "businessHours": bh})
+}
+
+// addBusinessHoliday 添加节假日或调休例外
+func addBusinessHoliday(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var holiday models.BusinessHoliday
+	if err := c.ShouldBindJSON(&holiday); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "日期格式错误，应为 2006-01-02"})
+		return
+	}
+	if !holiday.Closed {
+		if _, err := parseRange(timeRange{holiday.Start, holiday.End}); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	holiday.ID = 0
+	holiday.MiniAppID = miniAppID
+	if err := db.Create(&holiday).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, holiday)
+}
+
+// deleteBusinessHoliday 删除例外日期
+func deleteBusinessHoliday(c *gin.Context, db *gorm.DB) {
+	if err := db.Unscoped().Delete(&models.BusinessHoliday{}, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
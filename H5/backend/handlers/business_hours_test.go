@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return loc
+}
+
+// testCalendar 工作日 09:00-12:00、13:00-18:00，周日 20:00-24:00，周六休息
+func testCalendar(t *testing.T, tz string, holidays map[string][]minuteRange) *businessCalendar {
+	t.Helper()
+	weekly, err := parseWeeklySchedule(`{
+		"mon": [{"start":"09:00","end":"12:00"},{"start":"13:00","end":"18:00"}],
+		"tue": [{"start":"09:00","end":"12:00"},{"start":"13:00","end":"18:00"}],
+		"wed": [{"start":"09:00","end":"12:00"},{"start":"13:00","end":"18:00"}],
+		"thu": [{"start":"09:00","end":"12:00"},{"start":"13:00","end":"18:00"}],
+		"fri": [{"start":"13:00","end":"18:00"},{"start":"09:00","end":"12:00"}],
+		"sun": [{"start":"20:00","end":"24:00"}]
+	}`)
+	if err != nil {
+		t.Fatalf("parseWeeklySchedule: %v", err)
+	}
+	if holidays == nil {
+		holidays = map[string][]minuteRange{}
+	}
+	return &businessCalendar{loc: mustLocation(t, tz), weekly: weekly, holidays: holidays}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"00:00", 0, false},
+		{"09:30", 570, false},
+		{"24:00", 1440, false},
+		{"24:01", 0, true},
+		{"12:60", 0, true},
+		{"-1:00", 0, true},
+		{"9", 0, true},
+		{"ab:cd", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseClock(%q) = %d, %v; want %d, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseWeeklyScheduleErrors(t *testing.T) {
+	for _, raw := range []string{
+		`{"xyz":[{"start":"09:00","end":"18:00"}]}`,
+		`{"mon":[{"start":"18:00","end":"09:00"}]}`,
+		`{"mon":[{"start":"09:00","end":"09:00"}]}`,
+		`not json`,
+	} {
+		if _, err := parseWeeklySchedule(raw); err == nil {
+			t.Errorf("parseWeeklySchedule(%s) should fail", raw)
+		}
+	}
+}
+
+func TestIsOpen(t *testing.T) {
+	sh := mustLocation(t, "Asia/Shanghai")
+	cal := testCalendar(t, "Asia/Shanghai", map[string][]minuteRange{
+		"2026-10-20": nil,                      // 周二全天休息
+		"2026-10-24": {{start: 600, end: 660}}, // 周六调休上班 10:00-11:00
+	})
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{"工作时间内", time.Date(2026, 10, 19, 10, 0, 0, 0, sh), true},
+		{"开始时刻", time.Date(2026, 10, 19, 9, 0, 0, 0, sh), true},
+		{"开始前一分钟", time.Date(2026, 10, 19, 8, 59, 0, 0, sh), false},
+		{"结束时刻不含", time.Date(2026, 10, 19, 18, 0, 0, 0, sh), false},
+		{"午休", time.Date(2026, 10, 19, 12, 30, 0, 0, sh), false},
+		{"周六休息", time.Date(2026, 10, 31, 10, 0, 0, 0, sh), false},
+		{"例外日期全天休息", time.Date(2026, 10, 20, 10, 0, 0, 0, sh), false},
+		{"例外日期调休上班", time.Date(2026, 10, 24, 10, 30, 0, 0, sh), true},
+		{"例外日期调休之外", time.Date(2026, 10, 24, 11, 0, 0, 0, sh), false},
+		{"24:00 结束前", time.Date(2026, 10, 25, 23, 59, 0, 0, sh), true},
+		{"24:00 结束后跨到周一零点", time.Date(2026, 10, 26, 0, 0, 0, 0, sh), false},
+		{"按小程序时区换算", time.Date(2026, 10, 19, 2, 0, 0, 0, time.UTC), true},
+		{"UTC 周日 16:00 为上海周一零点", time.Date(2026, 10, 25, 16, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := cal.IsOpen(tt.t); got != tt.want {
+			t.Errorf("%s: IsOpen(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+
+	var none *businessCalendar
+	if !none.IsOpen(time.Now()) {
+		t.Error("未配置工作时间时应始终在线")
+	}
+}
+
+func TestNextOpen(t *testing.T) {
+	sh := mustLocation(t, "Asia/Shanghai")
+	cal := testCalendar(t, "Asia/Shanghai", map[string][]minuteRange{"2026-10-26": nil})
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"工作时间内返回原时刻", time.Date(2026, 10, 19, 10, 0, 0, 0, sh), time.Date(2026, 10, 19, 10, 0, 0, 0, sh)},
+		{"当天开始前", time.Date(2026, 10, 19, 7, 0, 0, 0, sh), time.Date(2026, 10, 19, 9, 0, 0, 0, sh)},
+		{"午休后", time.Date(2026, 10, 19, 12, 0, 0, 0, sh), time.Date(2026, 10, 19, 13, 0, 0, 0, sh)},
+		{"下班后到次日", time.Date(2026, 10, 19, 18, 0, 0, 0, sh), time.Date(2026, 10, 20, 9, 0, 0, 0, sh)},
+		{"周五下班到周日晚", time.Date(2026, 10, 23, 19, 0, 0, 0, sh), time.Date(2026, 10, 25, 20, 0, 0, 0, sh)},
+		{"跨过零点后跳过例外日期", time.Date(2026, 10, 26, 0, 0, 0, 0, sh), time.Date(2026, 10, 27, 9, 0, 0, 0, sh)},
+	}
+	for _, tt := range tests {
+		if got := cal.nextOpen(tt.t); !got.Equal(tt.want) {
+			t.Errorf("%s: nextOpen(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+
+	closed := &businessCalendar{loc: sh, weekly: map[time.Weekday][]minuteRange{}, holidays: map[string][]minuteRange{}}
+	if got := closed.nextOpen(time.Date(2026, 10, 19, 10, 0, 0, 0, sh)); !got.IsZero() {
+		t.Errorf("没有工作时间时应返回零值，got %v", got)
+	}
+}
+
+func TestNextOpenDaylightSaving(t *testing.T) {
+	ny := mustLocation(t, "America/New_York")
+	cal := testCalendar(t, "America/New_York", nil)
+	cal.weekly[time.Sunday] = []minuteRange{{start: 9 * 60, end: 17 * 60}}
+
+	// 2026-03-08 凌晨 2 点开始夏令时，当天零点到 9 点只有 8 个小时
+	got := cal.nextOpen(time.Date(2026, 3, 8, 0, 30, 0, 0, ny))
+	if want := time.Date(2026, 3, 8, 9, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("夏令时开始当天 nextOpen = %v, want %v", got, want)
+	}
+	// 2026-11-01 凌晨 2 点结束夏令时，当天零点到 9 点有 10 个小时
+	got = cal.nextOpen(time.Date(2026, 11, 1, 0, 30, 0, 0, ny))
+	if want := time.Date(2026, 11, 1, 9, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("夏令时结束当天 nextOpen = %v, want %v", got, want)
+	}
+}
+
+func TestAddBusinessTime(t *testing.T) {
+	sh := mustLocation(t, "Asia/Shanghai")
+	cal := testCalendar(t, "Asia/Shanghai", map[string][]minuteRange{"2026-10-20": nil})
+	tests := []struct {
+		name  string
+		start time.Time
+		d     time.Duration
+		want  time.Time
+	}{
+		{"同一时段内", time.Date(2026, 10, 19, 9, 30, 0, 0, sh), time.Hour, time.Date(2026, 10, 19, 10, 30, 0, 0, sh)},
+		{"恰好到时段结束", time.Date(2026, 10, 19, 16, 0, 0, 0, sh), 2 * time.Hour, time.Date(2026, 10, 19, 18, 0, 0, 0, sh)},
+		{"跨午休", time.Date(2026, 10, 19, 11, 30, 0, 0, sh), time.Hour, time.Date(2026, 10, 19, 13, 30, 0, 0, sh)},
+		{"开始于工作时间前", time.Date(2026, 10, 19, 8, 0, 0, 0, sh), 30 * time.Minute, time.Date(2026, 10, 19, 9, 30, 0, 0, sh)},
+		{"跨过例外日期", time.Date(2026, 10, 19, 17, 0, 0, 0, sh), 2 * time.Hour, time.Date(2026, 10, 21, 10, 0, 0, 0, sh)},
+		{"周五到周日晚上", time.Date(2026, 10, 23, 17, 30, 0, 0, sh), time.Hour, time.Date(2026, 10, 25, 20, 30, 0, 0, sh)},
+		{"周日跨零点到周一", time.Date(2026, 10, 25, 23, 0, 0, 0, sh), 2 * time.Hour, time.Date(2026, 10, 26, 10, 0, 0, 0, sh)},
+		{"时长为零", time.Date(2026, 10, 19, 10, 0, 0, 0, sh), 0, time.Date(2026, 10, 19, 10, 0, 0, 0, sh)},
+	}
+	for _, tt := range tests {
+		if got := cal.addBusinessTime(tt.start, tt.d); !got.Equal(tt.want) {
+			t.Errorf("%s: addBusinessTime(%v, %v) = %v, want %v", tt.name, tt.start, tt.d, got, tt.want)
+		}
+	}
+
+	var none *businessCalendar
+	start := time.Date(2026, 10, 19, 23, 0, 0, 0, sh)
+	if got := none.addBusinessTime(start, 2*time.Hour); !got.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("未配置工作时间时应按自然时间累计，got %v", got)
+	}
+}
+
+func TestAddBusinessTimeDaylightSaving(t *testing.T) {
+	ny := mustLocation(t, "America/New_York")
+	cal := testCalendar(t, "America/New_York", nil)
+	cal.weekly[time.Sunday] = []minuteRange{{start: 9 * 60, end: 17 * 60}}
+
+	got := cal.addBusinessTime(time.Date(2026, 3, 7, 12, 0, 0, 0, ny), time.Hour)
+	if want := time.Date(2026, 3, 8, 10, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("夏令时开始当天 addBusinessTime = %v, want %v", got, want)
+	}
+}
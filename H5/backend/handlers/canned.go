@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// cannedVarPattern 快捷回复中的变量，如 {{nickname}}
+var cannedVarPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// shortcutPattern 快捷码只允许字母、数字、下划线和中划线
+var shortcutPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,50}$`)
+
+// cannedView 快捷回复及按当前用户替换变量后的内容
+type cannedView struct {
+	models.CannedResponse
+	Rendered string `json:"Rendered"`
+}
+
+// userDisplayName 用户在快捷回复等场景中的称呼
+func userDisplayName(user models.User) string {
+	if user.Nickname != "" {
+		return user.Nickname
+	}
+	return "用户"
+}
+
+// cannedVars 快捷回复变量：客服名、用户称呼、用户所在小程序名称
+func cannedVars(db *gorm.DB, csID, userID uint) map[string]string {
+	vars := map[string]string{}
+	var cs models.CustomerService
+	if err := db.First(&cs, csID).Error; err == nil {
+		vars["agent"] = cs.Name
+	}
+	var user models.User
+	if userID != 0 && db.First(&user, userID).Error == nil {
+		vars["nickname"] = userDisplayName(user)
+		var ma models.MiniApp
+		if err := db.First(&ma, user.MiniAppID).Error; err == nil {
+			vars["miniapp"] = ma.Name
+		}
+	}
+	return vars
+}
+
+// renderCanned 替换快捷回复中的变量，未知或缺少取值的变量保持原样
+func renderCanned(content string, vars map[string]string) string {
+	return cannedVarPattern.ReplaceAllStringFunc(content, func(m string) string {
+		name := strings.ToLower(cannedVarPattern.FindStringSubmatch(m)[1])
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// visibleCanned 客服可用的快捷回复：自己的个人快捷回复和所负责小程序的共享快捷回复
+func visibleCanned(db *gorm.DB, csID uint) *gorm.DB {
+	return db.Where("(scope = ? AND customer_service_id = ?) OR (scope = ? AND mini_app_id IN (?))",
+		models.CannedPersonal, csID,
+		models.CannedShared, db.Model(&models.Assignment{}).Select("mini_app_id").Where("customer_service_id = ?", csID))
+}
+
+// validateCanned 校验快捷回复内容和快捷码，同一范围内快捷码不能重复
+func validateCanned(db *gorm.DB, canned *models.CannedResponse) error {
+	canned.Shortcut = strings.TrimPrefix(strings.TrimSpace(canned.Shortcut), "/")
+	canned.Folder = strings.TrimSpace(canned.Folder)
+	if strings.TrimSpace(canned.Content) == "" {
+		return fmt.Errorf("内容不能为空")
+	}
+	if canned.Shortcut == "" {
+		return nil
+	}
+	if !shortcutPattern.MatchString(canned.Shortcut) {
+		return fmt.Errorf("快捷码只能包含字母、数字、下划线和中划线")
+	}
+	query := db.Model(&models.CannedResponse{}).Where("scope = ? AND shortcut = ? AND id <> ?", canned.Scope, canned.Shortcut, canned.ID)
+	if canned.Scope == models.CannedShared {
+		query = query.Where("mini_app_id = ?", canned.MiniAppID)
+	} else {
+		query = query.Where("customer_service_id = ?", canned.CustomerServiceID)
+	}
+	var count int64
+	query.Count(&count)
+	if count > 0 {
+		return fmt.Errorf("快捷码 /%s 已存在", canned.Shortcut)
+	}
+	return nil
+}
+
+// searchCannedResponses 客服输入 /快捷码 时搜索快捷回复
+// q 匹配快捷码前缀或标题、内容；userId 指定时只返回该用户所在小程序的共享快捷回复，并按该用户替换变量
+func searchCannedResponses(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("csId"))
+	q := strings.TrimPrefix(strings.TrimSpace(c.Query("q")), "/")
+	userID := parseUint(c.Query("userId"))
+	miniAppID := parseUint(c.Query("miniAppId"))
+	if userID != 0 {
+		var user models.User
+		if err := db.First(&user, userID).Error; err == nil {
+			miniAppID = user.MiniAppID
+		}
+	}
+
+	query := visibleCanned(db, csID)
+	if miniAppID != 0 {
+		query = query.Where("scope = ? OR mini_app_id = ?", models.CannedPersonal, miniAppID)
+	}
+	if folder, ok := c.GetQuery("folder"); ok {
+		query = query.Where("folder = ?", folder)
+	}
+	if q != "" {
+		escaped := escapeLike(q)
+		like := "%" + escaped + "%"
+		query = query.Where("shortcut LIKE ? OR title LIKE ? OR content LIKE ?", escaped+"%", like, like)
+	}
+	var list []models.CannedResponse
+	query.Order("id ASC").Find(&list)
+
+	// 快捷码完全匹配优先，其次快捷码前缀匹配，再次标题或内容匹配；同级别时个人快捷回复优先
+	rank := func(r models.CannedResponse) int {
+		n := 4
+		switch {
+		case q == "":
+		case strings.EqualFold(r.Shortcut, q):
+			n = 0
+		case strings.HasPrefix(strings.ToLower(r.Shortcut), strings.ToLower(q)):
+			n = 2
+		}
+		if r.Scope == models.CannedShared {
+			n++
+		}
+		return n
+	}
+	sort.SliceStable(list, func(i, j int) bool { return rank(list[i]) < rank(list[j]) })
+	if len(list) > 20 {
+		list = list[:20]
+	}
+
+	vars := cannedVars(db, csID, userID)
+	views := make([]cannedView, 0, len(list))
+	for _, r := range list {
+		views = append(views, cannedView{CannedResponse: r, Rendered: renderCanned(r.Content, vars)})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// getCannedFolders 客服可用快捷回复的分组列表
+func getCannedFolders(c *gin.Context, db *gorm.DB) {
+	folders := []string{}
+	visibleCanned(db, parseUint(c.Param("csId"))).Model(&models.CannedResponse{}).
+		Where("folder <> ?", "").Distinct().Order("folder ASC").Pluck("folder", &folders)
+	c.JSON(http.StatusOK, folders)
+}
+
+// saveCanned 绑定请求参数并保存快捷回复，scope 和所属由调用方设置
+func saveCanned(c *gin.Context, db *gorm.DB, canned *models.CannedResponse, setOwner func(*models.CannedResponse)) {
+	id, createdAt := canned.ID, canned.CreatedAt
+	if err := c.ShouldBindJSON(canned); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	canned.ID, canned.CreatedAt = id, createdAt
+	setOwner(canned)
+	if err := validateCanned(db, canned); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(canned).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, canned)
+}
+
+// addPersonalCanned 客服添加个人快捷回复
+func addPersonalCanned(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("csId"))
+	var cs models.CustomerService
+	if err := db.First(&cs, csID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "客服不存在"})
+		return
+	}
+	saveCanned(c, db, &models.CannedResponse{}, func(r *models.CannedResponse) {
+		r.Scope, r.CustomerServiceID, r.MiniAppID = models.CannedPersonal, csID, 0
+	})
+}
+
+// updatePersonalCanned 客服修改自己的个人快捷回复
+func updatePersonalCanned(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("csId"))
+	var canned models.CannedResponse
+	if err := db.Where("id = ? AND scope = ? AND customer_service_id = ?", parseUint(c.Param("id")), models.CannedPersonal, csID).First(&canned).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "快捷回复不存在"})
+		return
+	}
+	saveCanned(c, db, &canned, func(r *models.CannedResponse) {
+		r.Scope, r.CustomerServiceID, r.MiniAppID = models.CannedPersonal, csID, 0
+	})
+}
+
+// deletePersonalCanned 客服删除自己的个人快捷回复
+func deletePersonalCanned(c *gin.Context, db *gorm.DB) {
+	res := db.Unscoped().Where("id = ? AND scope = ? AND customer_service_id = ?", parseUint(c.Param("id")), models.CannedPersonal, parseUint(c.Param("csId"))).Delete(&models.CannedResponse{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "快捷回复不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
+
+// getSharedCanned 获取小程序的共享快捷回复
+func getSharedCanned(c *gin.Context, db *gorm.DB) {
+	var list []models.CannedResponse
+	db.Where("scope = ? AND mini_app_id = ?", models.CannedShared, parseUint(c.Param("id"))).Order("folder ASC, id ASC").Find(&list)
+	c.JSON(http.StatusOK, list)
+}
+
+// addSharedCanned 添加小程序的共享快捷回复
+func addSharedCanned(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	saveCanned(c, db, &models.CannedResponse{}, func(r *models.CannedResponse) {
+		r.Scope, r.MiniAppID, r.CustomerServiceID = models.CannedShared, miniAppID, 0
+	})
+}
+
+// updateSharedCanned 修改共享快捷回复
+func updateSharedCanned(c *gin.Context, db *gorm.DB) {
+	var canned models.CannedResponse
+	if err := db.Where("id = ? AND scope = ?", parseUint(c.Param("id")), models.CannedShared).First(&canned).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "快捷回复不存在"})
+		return
+	}
+	miniAppID := canned.MiniAppID
+	saveCanned(c, db, &canned, func(r *models.CannedResponse) {
+		r.Scope, r.MiniAppID, r.CustomerServiceID = models.CannedShared, miniAppID, 0
+	})
+}
+
+// deleteSharedCanned 删除共享快捷回复
+func deleteSharedCanned(c *gin.Context, db *gorm.DB) {
+	if err := db.Unscoped().Where("scope = ?", models.CannedShared).Delete(&models.CannedResponse{}, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
@@ -10,10 +11,7 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
-	"os"
-	"path/filepath"
 	"io"
-	"github.com/google/uuid"
 	"time"
 	"log"
 )
@@ -27,7 +25,7 @@ var upgrader = websocket.Upgrader{
 }
 
 var (
-	connections = make(map[uint]*websocket.Conn)
+	connections = make(map[uint]*wsClient) // 连接在本实例的客服
 	connMutex   sync.Mutex
 )
 
@@ -39,16 +37,46 @@ func SetupChatRoutes(r *gin.Engine, db *gorm.DB) {
 		chat.POST("/send", func(c *gin.Context) { sendUserMessage(c, db) })
 		chat.POST("/subscribe", func(c *gin.Context) { subscribeHandler(c, db) })
 		chat.POST("/login", func(c *gin.Context) { loginHandler(c, db) })
-		chat.POST("/upload", func(c *gin.Context) { uploadImage(c, db) })
+		chat.POST("/upload", func(c *gin.Context) { uploadFile(c, db) })
+		chat.POST("/upload/sessions", func(c *gin.Context) { createUploadSession(c, db) })
+		chat.GET("/upload/sessions/:uploadId", func(c *gin.Context) { getUploadSession(c, db) })
+		chat.PUT("/upload/sessions/:uploadId", func(c *gin.Context) { uploadPart(c, db) })
+		chat.POST("/upload/sessions/:uploadId/complete", func(c *gin.Context) { completeUploadSession(c, db) })
+		chat.DELETE("/upload/sessions/:uploadId", func(c *gin.Context) { abortUploadSession(c, db) })
 		chat.GET("/history", func(c *gin.Context) { getChatHistory(c, db) })
+		chat.GET("/queue", func(c *gin.Context) { getQueueStatus(c, db) })
 		chat.GET("/cs/:csId/user/:userId/messages", func(c *gin.Context) { getCSUserMessages(c, db) })
 		chat.POST("/cs/send", func(c *gin.Context) { sendCSMessage(c, db) })
 		chat.GET("/cs/:csId/qrcode", func(c *gin.Context) { getCSQRCode(c, db) })
 		chat.POST("/heartbeat", func(c *gin.Context) { userHeartbeat(c, db) })
-		chat.DELETE("/message/:id", func(c *gin.Context) { deleteMessage(c, db) })
+		chat.DELETE("/message/:id", func(c *gin.Context) { recallUserMessage(c, db) })
+		chat.PUT("/message/:id", func(c *gin.Context) { editUserMessage(c, db) })
+		chat.DELETE("/cs/:csId/message/:id", func(c *gin.Context) { recallAgentMessage(c, db) })
+		chat.PUT("/cs/:csId/message/:id", func(c *gin.Context) { editAgentMessage(c, db) })
 		chat.POST("/message/:id/read", func(c *gin.Context) { markMessageAsRead(c, db) })
 		chat.POST("/cs/:csId/user/:userId/push", func(c *gin.Context) { manualPushNotification(c, db) })
 		chat.GET("/cs/:csId/user/:userId/push-status", func(c *gin.Context) { checkPushStatus(c, db) })
+		chat.GET("/cs/:csId/conversations", func(c *gin.Context) { getCSConversations(c, db) })
+		chat.POST("/conversation/:id/resolve", func(c *gin.Context) { resolveConversation(c, db) })
+		chat.POST("/conversation/:id/close", func(c *gin.Context) { closeConversation(c, db) })
+		chat.POST("/conversation/:id/transfer", func(c *gin.Context) { transferConversationHandler(c, db) })
+		chat.GET("/cs/:csId/conversation/:id/transfers", func(c *gin.Context) { getConversationTransfers(c, db) })
+		chat.GET("/cs/:csId/canned", func(c *gin.Context) { searchCannedResponses(c, db) })
+		chat.GET("/cs/:csId/canned/folders", func(c *gin.Context) { getCannedFolders(c, db) })
+		chat.POST("/cs/:csId/canned", func(c *gin.Context) { addPersonalCanned(c, db) })
+		chat.PUT("/cs/:csId/canned/:id", func(c *gin.Context) { updatePersonalCanned(c, db) })
+		chat.DELETE("/cs/:csId/canned/:id", func(c *gin.Context) { deletePersonalCanned(c, db) })
+		chat.GET("/tags", func(c *gin.Context) { getTags(c, db) })
+		chat.PUT("/cs/:csId/user/:userId/tags", func(c *gin.Context) { setUserTags(c, db) })
+		chat.PUT("/conversation/:id/tags", func(c *gin.Context) { setConversationTags(c, db) })
+		chat.GET("/cs/:csId/user/:userId/notes", func(c *gin.Context) { getUserNotes(c, db) })
+		chat.POST("/cs/:csId/user/:userId/notes", func(c *gin.Context) { addUserNote(c, db) })
+		chat.DELETE("/cs/:csId/note/:id", func(c *gin.Context) { deleteNote(c, db) })
+		chat.POST("/profile", func(c *gin.Context) { updateUserProfile(c, db) })
+		chat.POST("/phone", func(c *gin.Context) { bindUserPhone(c, db) })
+		chat.GET("/cs/:csId/user/:userId/profile", func(c *gin.Context) { getUserProfile(c, db) })
+		chat.POST("/rating", func(c *gin.Context) { submitRating(c, db) })
+		chat.GET("/cs/:csId/search", func(c *gin.Context) { searchMessages(c, db) })
 	}
 }
 
@@ -75,13 +103,19 @@ func wsHandler(c *gin.Context, db *gorm.DB) {
 		return nil
 	})
 
+	client := &wsClient{conn: conn}
 	connMutex.Lock()
-	connections[id] = conn
+	connections[id] = client
 	connMutex.Unlock()
+	agentConnected(db, id)
 
 	defer func() {
 		connMutex.Lock()
-		delete(connections, id)
+		// 客服可能已在本实例重新连接，只移除自己这条连接
+		if connections[id] == client {
+			delete(connections, id)
+			agentDisconnected(db, id)
+		}
 		connMutex.Unlock()
 		conn.Close()
 	}()
@@ -94,8 +128,7 @@ func wsHandler(c *gin.Context, db *gorm.DB) {
 		for {
 			select {
 			case <-ticker.C:
-				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if err := client.write(websocket.PingMessage, nil); err != nil {
 					return
 				}
 			case <-done:
@@ -115,13 +148,21 @@ func wsHandler(c *gin.Context, db *gorm.DB) {
 		
 		// 处理 ping 消息
 		if messageType == websocket.PingMessage {
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			conn.WriteMessage(websocket.PongMessage, nil)
+			client.write(websocket.PongMessage, nil)
 			continue
 		}
 		
 		// 处理文本消息
 		if messageType == websocket.TextMessage {
+			agentActive(db, id)
+			// 事件消息（带 event 字段），如 {"event":"status","status":"away"}
+			var ev struct {
+				Event string `json:"event"`
+			}
+			if json.Unmarshal(message, &ev) == nil && ev.Event != "" {
+				handleWSEvent(db, id, ev.Event, message)
+				continue
+			}
 			// Handle CS reply: parse message, save, send push to user
 			var msg models.Message
 			if err := json.Unmarshal(message, &msg); err != nil {
@@ -129,23 +170,80 @@ func wsHandler(c *gin.Context, db *gorm.DB) {
 			}
 			msg.FromUser = false
 			msg.CustomerServiceID = id
-			msg.IsImage = msg.ImageURL != ""
-			db.Create(&msg)
-			if msg.IsImage {
-				sendSubscriptionPush(db, msg.UserID, id, "您收到一张图片")
-			} else {
-				sendSubscriptionPush(db, msg.UserID, id, msg.Content)
+			if err := prepareMessage(&msg, false); err != nil {
+				notifyCS(id, wsEvent{Type: "error", Data: gin.H{"error": err.Error()}})
+				continue
 			}
+			conv, err := conversationForAgent(db, msg.UserID, id)
+			if err != nil {
+				continue
+			}
+			msg.ConversationID = conv.ID
+			if err := validateReplyTo(db, &msg); err != nil {
+				notifyCS(id, wsEvent{Type: "error", Data: gin.H{"error": err.Error()}})
+				continue
+			}
+			refs := resolveAttachments(db, &msg)
+			db.Create(&msg)
+			linkAttachments(db, msg, refs)
+			recordConversationMessage(db, &conv, false)
+			sendSubscriptionPush(db, msg.UserID, id, pushExcerpt(msg))
+		}
+	}
+}
+
+// handleWSEvent 处理客服端通过 WebSocket 发送的事件
+func handleWSEvent(db *gorm.DB, csID uint, event string, raw []byte) {
+	switch event {
+	case "activity":
+		// 客服端有键盘/鼠标操作，agentActive 已记录
+	case "status":
+		var req struct {
+			Status string `json:"status"`
+		}
+		json.Unmarshal(raw, &req)
+		if !isValidCSStatus(req.Status) {
+			notifyCS(csID, wsEvent{Type: "error", Data: gin.H{"error": "无效的状态"}})
+			return
+		}
+		if err := setAgentStatus(db, csID, req.Status); err != nil {
+			log.Printf("[客服状态] 更新失败，csID=%d, error=%v", csID, err)
 		}
+	case "transfer":
+		// {"event":"transfer","conversationId":1,"toCsId":2,"note":"..."}，toCsId 为 0 时转给团队中其他客服
+		var req struct {
+			ConversationID uint   `json:"conversationId"`
+			ToCSID         uint   `json:"toCsId"`
+			Note           string `json:"note"`
+		}
+		json.Unmarshal(raw, &req)
+		var conv models.Conversation
+		var assignment models.Assignment
+		if err := db.First(&conv, req.ConversationID).Error; err != nil {
+			notifyCS(csID, wsEvent{Type: "error", Data: gin.H{"error": "会话不存在"}})
+			return
+		}
+		if err := db.Where("mini_app_id = ? AND customer_service_id = ?", conv.MiniAppID, csID).First(&assignment).Error; err != nil {
+			notifyCS(csID, wsEvent{Type: "error", Data: gin.H{"error": "该会话不属于您负责的小程序"}})
+			return
+		}
+		if _, err := transferConversation(db, conv, csID, req.ToCSID, req.Note); err != nil {
+			notifyCS(csID, wsEvent{Type: "error", Data: gin.H{"error": err.Error()}})
+		}
+	default:
+		notifyCS(csID, wsEvent{Type: "error", Data: gin.H{"error": "未知事件: " + event}})
 	}
 }
 
 func sendUserMessage(c *gin.Context, db *gorm.DB) {
 	var req struct {
-		AppID    string `json:"appId"`
-		OpenID   string `json:"openId"`
-		Content  string `json:"content"`
-		ImageURL string `json:"imageUrl"` // Optional
+		AppID     string          `json:"appId"`
+		OpenID    string          `json:"openId"`
+		Content   string          `json:"content"`
+		ImageURL  string          `json:"imageUrl"`  // Optional
+		Type      string          `json:"type"`      // 消息类型，不传时按 imageUrl 判断为图片或文本
+		Payload   json.RawMessage `json:"payload"`   // 非文本消息的结构化内容
+		ReplyToID uint            `json:"replyToId"` // 引用回复的消息
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
@@ -158,17 +256,32 @@ func sendUserMessage(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
+	// 先校验消息内容，避免无效消息创建用户和会话
+	msg := models.Message{
+		Content:  req.Content,
+		FromUser: true,
+		ImageURL: req.ImageURL,
+		Type:      req.Type,
+		Payload:   req.Payload,
+		ReplyToID: req.ReplyToID,
+	}
+	if err := prepareMessage(&msg, true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Find or create user
 	var user models.User
-	miniAppID := findMiniAppID(db, req.AppID)
-	if miniAppID == 0 {
+	var ma models.MiniApp
+	if err := db.Where("app_id = ?", req.AppID).First(&ma).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "未找到该小程序"})
 		return
 	}
+	miniAppID := ma.ID
 	
 	// 检查用户是否是新用户（首次发送消息）
 	isNewUser := false
-	if err := db.Where("open_id = ?", req.OpenID).First(&user).Error; err != nil {
+	if err := db.Where("mini_app_id = ? AND open_id = ?", miniAppID, req.OpenID).First(&user).Error; err != nil {
 		// 用户不存在，创建新用户
 		user = models.User{OpenID: req.OpenID, MiniAppID: miniAppID}
 		db.Create(&user)
@@ -180,27 +293,110 @@ func sendUserMessage(c *gin.Context, db *gorm.DB) {
 		isNewUser = (msgCount == 0)
 	}
 
-	// Find assigned CS by appID
-	csID := findAssignedCS(db, req.AppID)
-	if csID == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "该小程序未分配客服"})
+	// 获取或打开会话，并分配客服（进行中的会话继续由原客服接待）
+	conv, err := openConversation(db, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建会话失败"})
 		return
 	}
 
-	// 更新用户最后活动时间
-	now := time.Now()
-	user.LastActiveTime = &now
-	db.Save(&user)
+	msg.UserID = user.ID
+	msg.ConversationID = conv.ID
+	if err := validateReplyTo(db, &msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	refs := resolveAttachments(db, &msg)
 
-	msg := models.Message{
-		UserID:            user.ID,
-		CustomerServiceID: csID,
-		Content:           req.Content,
-		FromUser:          true,
-		IsImage:           req.ImageURL != "",
-		ImageURL:          req.ImageURL,
+	// 关键词自动回复和机器人只处理文本消息
+	text := ""
+	if msg.Type == models.MessageTypeText {
+		text = msg.Content
+	}
+
+	// 关键词自动回复：命中“不转人工”的规则且会话尚无客服接待时，只由自动回复应答
+	var rule *models.AutoReplyRule
+	if text != "" {
+		rule = matchAutoReply(db, ma.ID, text)
+	}
+	autoOnly := rule != nil && rule.SkipHuman && conv.CustomerServiceID == 0 && conv.Status != models.ConversationQueued
+
+	// 机器人应答：会话尚未转人工时先交给小程序配置的机器人，机器人无法回答或用户要求人工时再分配客服
+	var botReply ResponderReply
+	if rule == nil && text != "" && botCanRespond(conv) {
+		if responder := responderFor(db, ma); responder != nil {
+			botReply = askResponder(c.Request.Context(), db, responder, ma, user, conv, text)
+		}
+	}
+	botOnly := botReply.Action == ResponderAnswer || botReply.Action == ResponderClarify
+
+	if autoOnly || botOnly {
+		presence.TouchUser(user)
+		db.Create(&msg)
+		linkAttachments(db, msg, refs)
+		recordConversationMessage(db, &conv, true)
+		if botOnly {
+			reply := sendBotReply(db, &conv, botReply)
+			c.JSON(http.StatusOK, gin.H{"status": "bot_replied", "action": botReply.Action, "reply": reply, "conversationId": conv.ID})
+			return
+		}
+		reply := sendAutoReply(db, *rule, ma, conv, 0)
+		recordConversationMessage(db, &conv, false)
+		c.JSON(http.StatusOK, gin.H{"status": "auto_replied", "reply": reply, "conversationId": conv.ID})
+		return
+	}
+
+	csID := assignConversation(db, ma, &conv)
+
+	// 暂无可接待的客服：消息照常保存，会话进入排队，客服空闲后按顺序分配
+	justQueued := false
+	if csID == 0 {
+		if justQueued, err = enqueueConversation(db, &conv); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "进入排队失败"})
+			return
+		}
 	}
+
+	// 更新用户最后活动时间（内存记录，批量写回数据库）
+	presence.TouchUser(user)
+
+	msg.CustomerServiceID = csID
 	db.Create(&msg)
+	linkAttachments(db, msg, refs)
+	recordConversationMessage(db, &conv, true)
+
+	// Send to CS via hub (full msg including ImageURL)
+	notifyCS(csID, quotedView(db, msg))
+
+	// 命中的自动回复先于人工回复发送，客服端同样能看到
+	if rule != nil {
+		sendAutoReply(db, *rule, ma, conv, csID)
+	}
+	// 机器人转人工时附带的说明（如“正在为您转接人工客服”）
+	if botReply.Action == ResponderHandoff && botReply.Text != "" {
+		notifyCS(csID, sendBotReply(db, &conv, botReply))
+	}
+
+	if csID == 0 {
+		position := queuePosition(db, conv)
+		if cal := loadCalendar(db, ma.ID); !cal.IsOpen(time.Now()) {
+			// 非工作时间：自动回复（每个会话一次），到工作时间后按排队顺序分配
+			sendAfterHoursReply(db, cal, &conv)
+			c.JSON(http.StatusOK, gin.H{"status": "queued", "position": position, "afterHours": true, "nextOpen": cal.nextOpen(time.Now()), "conversationId": conv.ID})
+			return
+		}
+		if justQueued {
+			// 告知用户排队位置（系统消息，显示在聊天记录中）
+			db.Create(&models.Message{
+				UserID:         user.ID,
+				ConversationID: conv.ID,
+				Content:        fmt.Sprintf("当前客服繁忙，您已进入排队，前面还有 %d 人，请稍候", position-1),
+				IsSystem:       true,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "queued", "position": position, "conversationId": conv.ID})
+		return
+	}
 
 	// 如果是新用户且设置了欢迎语，发送欢迎语
 	if isNewUser {
@@ -210,48 +406,48 @@ func sendUserMessage(c *gin.Context, db *gorm.DB) {
 			welcomeMsg := models.Message{
 				UserID:            user.ID,
 				CustomerServiceID: csID,
+				ConversationID:    conv.ID,
 				Content:           cs.WelcomeMessage,
 				FromUser:          false,
 				IsImage:           false,
 			}
 			db.Create(&welcomeMsg)
 			
-			// 通过WebSocket发送给客服（如果连接）
-			connMutex.Lock()
-			conn, ok := connections[csID]
-			connMutex.Unlock()
-			if ok {
-				conn.WriteJSON(welcomeMsg)
-			}
+			// 通过WebSocket发送给客服（客服可能连接在其他实例，经 Hub 分发）
+			notifyCS(csID, welcomeMsg)
 			
 			// 发送订阅推送
 			sendSubscriptionPush(db, user.ID, csID, cs.WelcomeMessage)
 		}
 	}
 
-	// Send to CS if connected
-	connMutex.Lock()
-	conn, ok := connections[csID]
-	connMutex.Unlock()
-	if ok {
-		conn.WriteJSON(msg) // Send full msg including ImageURL
-	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "sent"})
+	c.JSON(http.StatusOK, gin.H{"status": "sent", "conversationId": conv.ID})
 }
 
 func subscribeHandler(c *gin.Context, db *gorm.DB) {
 	var req struct {
 		OpenID string `json:"openId"`
+		AppID  string `json:"appId"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
 		return
 	}
 	var user models.User
-	if err := db.Where("open_id = ?", req.OpenID).First(&user).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
-		return
+	if req.AppID != "" {
+		if err := db.Where("mini_app_id = (SELECT id FROM mini_apps WHERE app_id = ?) AND open_id = ?", req.AppID, req.OpenID).First(&user).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+			return
+		}
+	} else {
+		// 兼容未传 appId 的旧版小程序：只有 OpenID 唯一对应一个用户时才处理
+		var users []models.User
+		db.Where("open_id = ?", req.OpenID).Limit(2).Find(&users)
+		if len(users) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "必须提供小程序 AppID"})
+			return
+		}
+		user = users[0]
 	}
 	user.Subscribed = true
 	db.Save(&user)
@@ -262,6 +458,8 @@ func loginHandler(c *gin.Context, db *gorm.DB) {
 	var req struct {
 		Code   string `json:"code"`
 		AppID  string `json:"appId"`
+		Scene  int    `json:"scene"`  // 进入场景值，仅首次登录时记录
+		Source string `json:"source"` // 进入来源（如渠道参数），仅首次登录时记录
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
@@ -288,6 +486,7 @@ func loginHandler(c *gin.Context, db *gorm.DB) {
 	defer resp.Body.Close()
 	var result struct {
 		OpenID string `json:"openid"`
+		UnionID string `json:"unionid"` // 小程序绑定微信开放平台时返回
 		ErrCode int    `json:"errcode"`
 		ErrMsg  string `json:"errmsg"`
 	}
@@ -305,12 +504,22 @@ func loginHandler(c *gin.Context, db *gorm.DB) {
 
 	// Save or update user
 	var user models.User
-	db.Where("open_id = ?", result.OpenID).FirstOrCreate(&user, models.User{OpenID: result.OpenID, MiniAppID: ma.ID})
-	
-	// 更新用户的 mini_app_id（如果小程序ID变化）
-	if user.MiniAppID != ma.ID {
-		user.MiniAppID = ma.ID
-		db.Save(&user)
+	// 用户以 (小程序, OpenID) 唯一标识，同一 OpenID 在其他小程序中是另一个用户
+	db.Where("mini_app_id = ? AND open_id = ?", ma.ID, result.OpenID).FirstOrCreate(&user, models.User{OpenID: result.OpenID, MiniAppID: ma.ID})
+
+	// 记录 UnionID 和首次进入的场景、来源
+	updates := map[string]interface{}{}
+	if result.UnionID != "" && result.UnionID != user.UnionID {
+		updates["union_id"] = result.UnionID
+	}
+	if user.Scene == 0 && req.Scene != 0 {
+		updates["scene"] = req.Scene
+	}
+	if user.Source == "" && req.Source != "" {
+		updates["source"] = req.Source
+	}
+	if len(updates) > 0 {
+		db.Model(&user).Updates(updates)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -321,35 +530,6 @@ func loginHandler(c *gin.Context, db *gorm.DB) {
 }
 
 // New upload handler
-func uploadImage(c *gin.Context, db *gorm.DB) {
-	file, err := c.FormFile("image")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "请选择图片文件"})
-		return
-	}
-	// Save file to uploads dir
-	uploadDir := "./uploads"
-	os.MkdirAll(uploadDir, os.ModePerm)
-	filename := uuid.New().String() + filepath.Ext(file.Filename)
-	dst := filepath.Join(uploadDir, filename)
-	out, err := os.Create(dst)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存文件失败"})
-		return
-	}
-	defer out.Close()
-	src, err := file.Open()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "打开文件失败"})
-		return
-	}
-	defer src.Close()
-	io.Copy(out, src)
-	// Return URL (assume served from /uploads)
-	url := "https://kefu.chacaitx.cn/uploads/" + filename
-	c.JSON(http.StatusOK, gin.H{"url": url})
-}
-
 func getChatHistory(c *gin.Context, db *gorm.DB) {
 	openID := c.Query("openId")
 	appID := c.Query("appId")
@@ -362,15 +542,24 @@ func getChatHistory(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
 		return
 	}
-	var messages []models.Message
-	db.Where("user_id = ? AND is_deleted = ?", user.ID, false).Order("created_at ASC").Find(&messages)
+	page, err := parseMessagePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	messages, hasMore, err := findMessagePage(db, user.ID, page)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	
 	// 标记所有客服发送的消息为已读
 	db.Model(&models.Message{}).
 		Where("user_id = ? AND from_user = ? AND user_read = ?", user.ID, false, false).
 		Update("user_read", true)
 	
-	c.JSON(http.StatusOK, messages)
+	setPageHeaders(c, messages, hasMore, page)
+	c.JSON(http.StatusOK, messageViews(db, messages))
 }
 
 // getCSUserMessages 获取客服与指定用户的聊天记录
@@ -397,16 +586,25 @@ func getCSUserMessages(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	var messages []models.Message
-	db.Where("user_id = ? AND customer_service_id = ? AND is_deleted = ?", userID, csID, false).
-		Order("created_at ASC").Find(&messages)
+	// 返回该用户的聊天记录，包括其他客服接待时的记录（会话转接后，接手客服也能看到之前的记录）
+	page, err := parseMessagePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	messages, hasMore, err := findMessagePage(db, userID, page)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	
 	// 标记所有用户发送的消息为已读
 	db.Model(&models.Message{}).
-		Where("user_id = ? AND customer_service_id = ? AND from_user = ? AND is_read = ?", userID, csID, true, false).
+		Where("user_id = ? AND from_user = ? AND is_read = ?", userID, true, false).
 		Update("is_read", true)
 	
-	c.JSON(http.StatusOK, messages)
+	setPageHeaders(c, messages, hasMore, page)
+	c.JSON(http.StatusOK, messageViews(db, messages))
 }
 
 // sendCSMessage 客服发送消息
@@ -414,8 +612,11 @@ func sendCSMessage(c *gin.Context, db *gorm.DB) {
 	var req struct {
 		UserID            uint   `json:"UserID"`
 		CustomerServiceID uint   `json:"CustomerServiceID"`
-		Content           string `json:"Content"`
-		ImageURL          string `json:"ImageURL"`
+		Content           string          `json:"Content"`
+		ImageURL          string          `json:"ImageURL"`
+		Type              string          `json:"Type"`
+		Payload           json.RawMessage `json:"Payload"`
+		ReplyToID         uint            `json:"ReplyToID"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
@@ -436,49 +637,46 @@ func sendCSMessage(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
+	agentActive(db, req.CustomerServiceID)
+
+	conv, err := conversationForAgent(db, req.UserID, req.CustomerServiceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取会话失败"})
+		return
+	}
+
 	msg := models.Message{
 		UserID:            req.UserID,
 		CustomerServiceID: req.CustomerServiceID,
+		ConversationID:    conv.ID,
 		Content:           req.Content,
 		FromUser:          false,
-		IsImage:           req.ImageURL != "",
 		ImageURL:          req.ImageURL,
+		Type:              req.Type,
+		Payload:           req.Payload,
+		ReplyToID:         req.ReplyToID,
 	}
-	
-	if err := db.Create(&msg).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := prepareMessage(&msg, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	
-	// 发送订阅推送（每条消息都尝试推送，sendSubscriptionPush 内部会检查订阅状态）
-	if req.ImageURL != "" {
-		sendSubscriptionPush(db, req.UserID, req.CustomerServiceID, "您收到一张图片")
-	} else {
-		sendSubscriptionPush(db, req.UserID, req.CustomerServiceID, req.Content)
-	}
-	
-	c.JSON(http.StatusOK, gin.H{"status": "sent", "message": msg})
-}
-
-// deleteMessage 删除消息
-func deleteMessage(c *gin.Context, db *gorm.DB) {
-	messageID := parseUint(c.Param("id"))
-	if messageID == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "消息ID无效"})
+	if err := validateReplyTo(db, &msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	refs := resolveAttachments(db, &msg)
 	
-	var msg models.Message
-	if err := db.First(&msg, messageID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "消息不存在"})
+	if err := db.Create(&msg).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	linkAttachments(db, msg, refs)
+	recordConversationMessage(db, &conv, false)
 	
-	// 软删除：标记为已删除
-	msg.IsDeleted = true
-	db.Save(&msg)
+	// 发送订阅推送（每条消息都尝试推送，sendSubscriptionPush 内部会检查订阅状态）
+	sendSubscriptionPush(db, req.UserID, req.CustomerServiceID, pushExcerpt(msg))
 	
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	c.JSON(http.StatusOK, gin.H{"status": "sent", "message": quotedView(db, msg)})
 }
 
 // markMessageAsRead 标记消息为已读（用户端）
@@ -514,13 +712,6 @@ func findMiniAppID(db *gorm.DB, appID string) uint {
 	db.Where("app_id = ?", appID).First(&ma)
 	return ma.ID
 }
-func findAssignedCS(db *gorm.DB, appID string) uint {
-	var assign models.Assignment
-	db.Joins("JOIN mini_apps ON assignments.mini_app_id = mini_apps.id").
-		Where("mini_apps.app_id = ?", appID).
-		First(&assign)
-	return assign.CustomerServiceID
-}
 func sendSubscriptionPush(db *gorm.DB, userID uint, csID uint, content string) {
 	// 使用 goroutine 异步推送，但添加错误处理和日志
 	go func() {
@@ -541,14 +732,8 @@ func sendSubscriptionPush(db *gorm.DB, userID uint, csID uint, content string) {
 		}
 		log.Printf("[推送] ✓ 用户已订阅")
 
-		// 检查用户是否在线（1分钟内有活动，实时检测）
-		isOnline := false
-		if user.LastActiveTime != nil {
-			timeSinceActive := time.Since(*user.LastActiveTime)
-			isOnline = timeSinceActive < 1*time.Minute
-		}
-		
-		if isOnline {
+		// 检查用户是否在线（在线阈值由 presence 统一配置）
+		if presence.IsUserOnline(user) {
 			log.Printf("[推送] ⏭️  用户在线，跳过推送，userID=%d, 最后活动时间: %v", userID, user.LastActiveTime)
 			return
 		}
@@ -579,24 +764,10 @@ func sendSubscriptionPush(db *gorm.DB, userID uint, csID uint, content string) {
 		log.Printf("[推送] ✓ 模板ID已配置，templateID=%s", ma.TemplateID)
 
 		// Get access_token
-		tokenURL := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" + ma.AppID + "&secret=" + ma.Secret
 		log.Printf("[推送] 正在获取 access_token...")
-		resp, err := http.Get(tokenURL)
+		accessToken, err := fetchAccessToken(ma)
 		if err != nil {
-			log.Printf("[推送] ❌ 获取 access_token 请求失败，userID=%d, error=%v", userID, err)
-			return
-		}
-		defer resp.Body.Close()
-		
-		var tokenResp struct {
-			AccessToken string `json:"access_token"`
-			ErrCode     int    `json:"errcode"`
-			ErrMsg      string `json:"errmsg"`
-		}
-		json.NewDecoder(resp.Body).Decode(&tokenResp)
-		
-		if tokenResp.ErrCode != 0 || tokenResp.AccessToken == "" {
-			log.Printf("[推送] ❌ 获取 access_token 失败，userID=%d, errCode=%d, errMsg=%s", userID, tokenResp.ErrCode, tokenResp.ErrMsg)
+			log.Printf("[推送] ❌ 获取 access_token 失败，userID=%d, error=%v", userID, err)
 			return
 		}
 		log.Printf("[推送] ✓ 获取 access_token 成功")
@@ -620,7 +791,7 @@ func sendSubscriptionPush(db *gorm.DB, userID uint, csID uint, content string) {
 
 		// Send subscription message - 按照模板格式发送
 		// 根据错误信息，模板需要 time2 字段，不是 time3
-		sendURL := "https://api.weixin.qq.com/cgi-bin/message/subscribe/send?access_token=" + tokenResp.AccessToken
+		sendURL := "https://api.weixin.qq.com/cgi-bin/message/subscribe/send?access_token=" + accessToken
 		data := map[string]interface{}{
 			"touser":           user.OpenID,
 			"template_id":      ma.TemplateID,
@@ -673,6 +844,7 @@ func sendSubscriptionPush(db *gorm.DB, userID uint, csID uint, content string) {
 				log.Printf("[推送] ⚠️  错误码40037: 模板ID不正确")
 			} else if pushResult.ErrCode == 40001 {
 				log.Printf("[推送] ⚠️  错误码40001: access_token无效，需要重新获取")
+				invalidateAccessToken(ma.AppID)
 			} else if pushResult.ErrCode == 40013 {
 				log.Printf("[推送] ⚠️  错误码40013: 不合法的AppID")
 			} else if pushResult.ErrCode == 45009 {
@@ -835,28 +1007,14 @@ func getCSQRCode(c *gin.Context, db *gorm.DB) {
 	}
 	
 	// 获取 access_token
-	tokenURL := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" + miniApp.AppID + "&secret=" + miniApp.Secret
-	resp, err := http.Get(tokenURL)
+	accessToken, err := fetchAccessToken(miniApp)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取 access_token 失败: " + err.Error()})
 		return
 	}
-	defer resp.Body.Close()
-	
-	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-		ErrCode     int    `json:"errcode"`
-		ErrMsg      string `json:"errmsg"`
-	}
-	json.NewDecoder(resp.Body).Decode(&tokenResp)
-	
-	if tokenResp.ErrCode != 0 || tokenResp.AccessToken == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取 access_token 失败: " + tokenResp.ErrMsg})
-		return
-	}
 	
 	// 调用微信API获取小程序码
-	qrCodeURL := "https://api.weixin.qq.com/wxa/getwxacode?access_token=" + tokenResp.AccessToken
+	qrCodeURL := "https://api.weixin.qq.com/wxa/getwxacode?access_token=" + accessToken
 	qrCodeData := map[string]interface{}{
 		"path": qrCodePath,
 		"width": 280, // 二维码宽度，单位px，最小280px，最大1280px
@@ -911,15 +1069,13 @@ func userHeartbeat(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	
-	if err := db.Where("open_id = ?", req.OpenID).First(&user).Error; err != nil {
+	if err := db.Where("mini_app_id = ? AND open_id = ?", miniAppID, req.OpenID).First(&user).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
 		return
 	}
 	
-	// 更新最后活动时间
-	now := time.Now()
-	user.LastActiveTime = &now
-	db.Save(&user)
+	// 更新最后活动时间（内存记录，批量写回数据库）
+	presence.TouchUser(user)
 	
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// activeConversationStatuses 进行中的会话状态
+var activeConversationStatuses = []string{
+	models.ConversationOpen,
+	models.ConversationBot,
+	models.ConversationQueued,
+	models.ConversationAssigned,
+	models.ConversationPendingUser,
+}
+
+// isActiveConversation 会话是否进行中（未解决、未关闭）
+func isActiveConversation(conv models.Conversation) bool {
+	for _, s := range activeConversationStatuses {
+		if conv.Status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidConversationStatus 检查会话状态是否合法
+func isValidConversationStatus(status string) bool {
+	switch status {
+	case models.ConversationOpen, models.ConversationBot, models.ConversationQueued, models.ConversationAssigned, models.ConversationPendingUser,
+		models.ConversationResolved, models.ConversationClosed:
+		return true
+	}
+	return false
+}
+
+// latestConversation 返回用户最近的一次会话
+func latestConversation(db *gorm.DB, userID uint) (models.Conversation, bool) {
+	var conv models.Conversation
+	db.Where("user_id = ?", userID).Order("id DESC").Limit(1).Find(&conv)
+	return conv, conv.ID > 0
+}
+
+// notifyConversation 向接待客服推送会话状态变化
+func notifyConversation(conv models.Conversation) {
+	notifyCS(conv.CustomerServiceID, wsEvent{Type: "conversation", Data: conv})
+}
+
+// openConversation 用户发消息时获取会话：进行中的会话直接使用；
+// 已解决或已关闭的会话在 CONVERSATION_REOPEN_WINDOW 内重新打开，超过则新建会话
+func openConversation(db *gorm.DB, user models.User) (models.Conversation, error) {
+	conv, ok := latestConversation(db, user.ID)
+	if ok && isActiveConversation(conv) {
+		return conv, nil
+	}
+
+	if ok {
+		endedAt := conv.UpdatedAt
+		if conv.ClosedAt != nil {
+			endedAt = *conv.ClosedAt
+		} else if conv.ResolvedAt != nil {
+			endedAt = *conv.ResolvedAt
+		}
+		if time.Since(endedAt) < envDuration("CONVERSATION_REOPEN_WINDOW", 24*time.Hour) {
+			err := db.Model(&conv).Updates(map[string]interface{}{
+				"status":                models.ConversationOpen,
+				"resolved_at":           nil,
+				"closed_at":             nil,
+				"closed_by":             "",
+				"reopen_count":          gorm.Expr("reopen_count + 1"),
+				"first_response_due_at": firstResponseDue(db, user.MiniAppID, time.Now()),
+				"first_response_at":     nil,
+			}).Error
+			if err != nil {
+				return conv, err
+			}
+			db.First(&conv, conv.ID)
+			return conv, nil
+		}
+	}
+
+	due := firstResponseDue(db, user.MiniAppID, time.Now())
+	conv = models.Conversation{
+		UserID:             user.ID,
+		MiniAppID:          user.MiniAppID,
+		Status:             models.ConversationOpen,
+		FirstResponseDueAt: &due,
+	}
+	err := db.Create(&conv).Error
+	return conv, err
+}
+
+// assignConversation 为会话选择客服：原接待客服仍在团队中且未离线则继续接待，
+// 否则按小程序的分配策略重新分配。没有可接待的客服或会话已在排队时返回 0
+func assignConversation(db *gorm.DB, ma models.MiniApp, conv *models.Conversation) uint {
+	team := teamMembers(db, ma.ID)
+	if len(team) == 0 {
+		return 0
+	}
+	if conv.CustomerServiceID != 0 {
+		for _, cs := range team {
+			if cs.ID == conv.CustomerServiceID && cs.Status != models.CSStatusOffline {
+				return cs.ID
+			}
+		}
+	}
+
+	// 已在排队的会话按顺序由调度分配，不插队；非工作时间不分配新会话
+	if conv.Status == models.ConversationQueued || !loadCalendar(db, ma.ID).IsOpen(time.Now()) {
+		return 0
+	}
+	csID := routeNewChat(db, ma, conv.UserID, 0)
+	if csID == 0 {
+		return 0
+	}
+	if csID != conv.CustomerServiceID {
+		conv.CustomerServiceID = csID
+		db.Model(conv).Update("customer_service_id", csID)
+	}
+	return csID
+}
+
+// conversationForAgent 客服发消息时获取会话：使用用户进行中的会话，没有则打开一个由该客服接待的会话
+// 会话在排队中时，由该客服直接接入
+func conversationForAgent(db *gorm.DB, userID, csID uint) (models.Conversation, error) {
+	conv, ok := latestConversation(db, userID)
+	if !ok || !isActiveConversation(conv) {
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return conv, err
+		}
+		var err error
+		if conv, err = openConversation(db, user); err != nil {
+			return conv, err
+		}
+	}
+	if conv.Status == models.ConversationQueued {
+		if _, err := assignQueuedConversation(db, &conv, csID); err != nil {
+			return conv, err
+		}
+	}
+	if conv.CustomerServiceID == 0 {
+		conv.CustomerServiceID = csID
+		db.Model(&conv).Update("customer_service_id", csID)
+	}
+	return conv, nil
+}
+
+// recordConversationMessage 会话收到新消息：用户消息进入等待客服状态（排队中保持排队），客服消息进入等待用户状态
+func recordConversationMessage(db *gorm.DB, conv *models.Conversation, fromUser bool) {
+	status := models.ConversationPendingUser
+	if fromUser {
+		switch {
+		case conv.Status == models.ConversationQueued:
+			status = models.ConversationQueued
+		case conv.CustomerServiceID != 0:
+			status = models.ConversationAssigned
+		default:
+			status = models.ConversationOpen
+		}
+	}
+	now := time.Now()
+	changed := conv.Status != status
+	conv.Status = status
+	conv.LastMessageAt = &now
+	updates := map[string]interface{}{"status": status, "last_message_at": now}
+	if !fromUser && conv.FirstResponseAt == nil {
+		conv.FirstResponseAt = &now
+		updates["first_response_at"] = now
+	}
+	db.Model(conv).Updates(updates)
+	if changed {
+		notifyConversation(*conv)
+	}
+}
+
+// parseConversationStatuses 解析逗号分隔的状态筛选条件
+func parseConversationStatuses(q string) ([]string, bool) {
+	var statuses []string
+	for _, s := range strings.Split(q, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !isValidConversationStatus(s) {
+			return nil, false
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, true
+}
+
+// getCSConversations 获取客服接待的会话列表，status 可用逗号分隔多个状态，默认返回进行中的会话
+func getCSConversations(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("csId"))
+	if csID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的客服ID"})
+		return
+	}
+	statuses := activeConversationStatuses
+	if q := c.Query("status"); q != "" {
+		var ok bool
+		if statuses, ok = parseConversationStatuses(q); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的会话状态"})
+			return
+		}
+	}
+
+	var convs []models.Conversation
+	db.Where("customer_service_id = ? AND status IN ?", csID, statuses).
+		Order("last_message_at DESC").Limit(200).Find(&convs)
+	c.JSON(http.StatusOK, convs)
+}
+
+// getConversations 管理端会话列表，可按状态、小程序、客服、用户、标签筛选，slaBreached=1 只返回首次响应超时的会话
+func getConversations(c *gin.Context, db *gorm.DB) {
+	query := db.Model(&models.Conversation{})
+	if q := c.Query("status"); q != "" {
+		statuses, ok := parseConversationStatuses(q)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的会话状态"})
+			return
+		}
+		query = query.Where("status IN ?", statuses)
+	}
+	if id := parseUint(c.Query("miniAppId")); id != 0 {
+		query = query.Where("mini_app_id = ?", id)
+	}
+	if id := parseUint(c.Query("csId")); id != 0 {
+		query = query.Where("customer_service_id = ?", id)
+	}
+	if id := parseUint(c.Query("userId")); id != 0 {
+		query = query.Where("user_id = ?", id)
+	}
+	if q := c.Query("tag"); q != "" {
+		tagIDs, ok := parseTagFilter(db, q)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "标签不存在"})
+			return
+		}
+		query = query.Where("id IN (?)", db.Model(&models.ConversationTag{}).Select("conversation_id").Where("tag_id IN ?", tagIDs))
+	}
+	if c.Query("slaBreached") == "1" {
+		query = query.Where("(first_response_at IS NULL AND first_response_due_at < ?) OR first_response_at > first_response_due_at", time.Now())
+	}
+
+	var convs []models.Conversation
+	query.Order("last_message_at DESC").Limit(500).Find(&convs)
+	c.JSON(http.StatusOK, convs)
+}
+
+// loadAgentConversation 读取会话并检查客服是否属于该小程序的客服团队
+func loadAgentConversation(c *gin.Context, db *gorm.DB, csID uint) (models.Conversation, bool) {
+	var conv models.Conversation
+	if err := db.First(&conv, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return conv, false
+	}
+	var assignment models.Assignment
+	if err := db.Where("mini_app_id = ? AND customer_service_id = ?", conv.MiniAppID, csID).First(&assignment).Error; err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "该会话不属于您负责的小程序"})
+		return conv, false
+	}
+	return conv, true
+}
+
+// resolveConversation 客服将会话标记为已解决
+func resolveConversation(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		CustomerServiceID uint `json:"CustomerServiceID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.CustomerServiceID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	conv, ok := loadAgentConversation(c, db, req.CustomerServiceID)
+	if !ok {
+		return
+	}
+	if !isActiveConversation(conv) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "会话已解决或已关闭"})
+		return
+	}
+
+	now := time.Now()
+	conv.Status = models.ConversationResolved
+	conv.ResolvedAt = &now
+	if err := db.Model(&conv).Updates(map[string]interface{}{"status": conv.Status, "resolved_at": now}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+		return
+	}
+	notifyConversation(conv)
+	requestRating(db, &conv)
+	dispatchForAgent(db, conv.CustomerServiceID)
+	c.JSON(http.StatusOK, gin.H{"message": "会话已解决", "conversation": conv})
+}
+
+// closeConversation 客服关闭会话
+func closeConversation(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		CustomerServiceID uint `json:"CustomerServiceID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.CustomerServiceID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	conv, ok := loadAgentConversation(c, db, req.CustomerServiceID)
+	if !ok {
+		return
+	}
+	if conv.Status == models.ConversationClosed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "会话已关闭"})
+		return
+	}
+
+	if err := closeConversationRecord(db, &conv, "agent"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "关闭失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "会话已关闭", "conversation": conv})
+}
+
+// closeConversationRecord 关闭会话并通知接待客服
+func closeConversationRecord(db *gorm.DB, conv *models.Conversation, closedBy string) error {
+	now := time.Now()
+	res := db.Model(&models.Conversation{}).
+		Where("id = ? AND status <> ?", conv.ID, models.ConversationClosed).
+		Updates(map[string]interface{}{"status": models.ConversationClosed, "closed_at": now, "closed_by": closedBy})
+	if res.Error != nil {
+		return res.Error
+	}
+	conv.Status = models.ConversationClosed
+	conv.ClosedAt = &now
+	conv.ClosedBy = closedBy
+	if res.RowsAffected > 0 {
+		notifyConversation(*conv)
+		dispatchForAgent(db, conv.CustomerServiceID)
+	}
+	return nil
+}
+
+// startConversationAutoClose 超过 CONVERSATION_IDLE_TIMEOUT 没有新消息的会话自动关闭
+// 只关闭等待用户、机器人应答中和已解决的会话，等待客服回复的会话不会因超时丢失
+func startConversationAutoClose(db *gorm.DB) {
+	idle := envDuration("CONVERSATION_IDLE_TIMEOUT", 30*time.Minute)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			var convs []models.Conversation
+			db.Where("status IN ? AND last_message_at < ?",
+				[]string{models.ConversationPendingUser, models.ConversationBot, models.ConversationResolved},
+				time.Now().Add(-idle)).Find(&convs)
+			for i := range convs {
+				if err := closeConversationRecord(db, &convs[i], "auto"); err != nil {
+					log.Printf("[会话] 自动关闭失败，conversationID=%d, error=%v", convs[i].ID, err)
+				}
+			}
+		}
+	}()
+}
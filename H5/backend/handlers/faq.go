@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// faqResponder 内置机器人：按字符二元组相似度在常见问题库中匹配用户问题。
+// 相似度不低于 FAQ_ANSWER_THRESHOLD 时直接回答，不低于 FAQ_CLARIFY_THRESHOLD 时列出候选问题请用户确认，否则转人工
+type faqResponder struct {
+	db     *gorm.DB
+	dryRun bool // 试运行时不累计命中次数
+}
+
+// faqCandidate 一条问题库条目的匹配结果
+type faqCandidate struct {
+	entry models.FAQEntry
+	score float64
+}
+
+func (f *faqResponder) Respond(ctx context.Context, req ResponderRequest) (ResponderReply, error) {
+	content := strings.TrimSpace(req.Content)
+	// 用户回复上一次候选问题的序号
+	if n, err := strconv.Atoi(content); err == nil && n >= 1 && n <= len(req.Suggestions) {
+		content = req.Suggestions[n-1]
+	}
+
+	var entries []models.FAQEntry
+	if err := f.db.WithContext(ctx).Where("mini_app_id = ? AND enabled = ?", req.MiniAppID, true).Find(&entries).Error; err != nil {
+		return ResponderReply{}, err
+	}
+	candidates := rankFAQ(entries, content)
+	if len(candidates) == 0 || candidates[0].score < envFloat("FAQ_CLARIFY_THRESHOLD", 0.3) {
+		return ResponderReply{Action: ResponderHandoff}, nil
+	}
+
+	best := candidates[0]
+	if best.score >= envFloat("FAQ_ANSWER_THRESHOLD", 0.6) {
+		if !f.dryRun {
+			f.db.Model(&models.FAQEntry{}).Where("id = ?", best.entry.ID).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+		}
+		return ResponderReply{Action: ResponderAnswer, Text: best.entry.Answer}, nil
+	}
+
+	var suggestions []string
+	var lines []string
+	for _, cand := range candidates {
+		if len(suggestions) == 3 || cand.score < envFloat("FAQ_CLARIFY_THRESHOLD", 0.3) {
+			break
+		}
+		suggestions = append(suggestions, cand.entry.Question)
+		lines = append(lines, fmt.Sprintf("%d. %s", len(suggestions), cand.entry.Question))
+	}
+	return ResponderReply{
+		Action:      ResponderClarify,
+		Text:        "您是想问以下问题吗？\n" + strings.Join(lines, "\n") + "\n请回复序号，或回复“人工”转人工客服",
+		Suggestions: suggestions,
+	}, nil
+}
+
+// rankFAQ 计算每个条目（标准问题及其他问法中的最高分）与用户问题的相似度，按分数从高到低排序
+func rankFAQ(entries []models.FAQEntry, content string) []faqCandidate {
+	query := textGrams(content)
+	if len(query) == 0 {
+		return nil
+	}
+	var candidates []faqCandidate
+	for _, e := range entries {
+		best := 0.0
+		for _, q := range append([]string{e.Question}, strings.Split(e.Aliases, "\n")...) {
+			if s := gramSimilarity(query, textGrams(q)); s > best {
+				best = s
+			}
+		}
+		if best > 0 {
+			candidates = append(candidates, faqCandidate{e, best})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	return candidates
+}
+
+// textGrams 把文本归一化（小写、去掉标点和空白）后切成字符二元组，单字文本取单字
+func textGrams(s string) map[string]int {
+	var runes []rune
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			runes = append(runes, r)
+		}
+	}
+	grams := make(map[string]int)
+	if len(runes) == 1 {
+		grams[string(runes)]++
+	}
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])]++
+	}
+	return grams
+}
+
+// gramSimilarity Dice 系数：2*|A∩B| / (|A|+|B|)，取值 0~1
+func gramSimilarity(a, b map[string]int) float64 {
+	total, common := 0, 0
+	for g, n := range a {
+		total += n
+		if m := b[g]; m > 0 {
+			if m < n {
+				common += m
+			} else {
+				common += n
+			}
+		}
+	}
+	for _, n := range b {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+// validateFAQEntry 校验问题库条目
+func validateFAQEntry(entry *models.FAQEntry) error {
+	entry.Question = strings.TrimSpace(entry.Question)
+	if entry.Question == "" {
+		return fmt.Errorf("问题不能为空")
+	}
+	if strings.TrimSpace(entry.Answer) == "" {
+		return fmt.Errorf("答案不能为空")
+	}
+	return nil
+}
+
+// getFAQEntries 获取小程序的常见问题库
+func getFAQEntries(c *gin.Context, db *gorm.DB) {
+	var entries []models.FAQEntry
+	db.Where("mini_app_id = ?", parseUint(c.Param("id"))).Order("id ASC").Find(&entries)
+	c.JSON(http.StatusOK, entries)
+}
+
+// addFAQEntry 添加常见问题
+func addFAQEntry(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var req struct {
+		models.FAQEntry
+		Enabled *bool `json:"Enabled"` // 未传时启用
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	entry := req.FAQEntry
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	if err := validateFAQEntry(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entry.ID = 0
+	entry.MiniAppID = miniAppID
+	entry.HitCount = 0
+	entry.Enabled = true
+	if err := db.Create(&entry).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加失败: " + err.Error()})
+		return
+	}
+	if req.Enabled != nil && !*req.Enabled {
+		db.Model(&entry).Update("enabled", false)
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// updateFAQEntry 修改常见问题
+func updateFAQEntry(c *gin.Context, db *gorm.DB) {
+	var entry models.FAQEntry
+	if err := db.First(&entry, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "问题不存在"})
+		return
+	}
+	id, miniAppID, createdAt, hits := entry.ID, entry.MiniAppID, entry.CreatedAt, entry.HitCount
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	entry.ID, entry.MiniAppID, entry.CreatedAt, entry.HitCount = id, miniAppID, createdAt, hits
+	if err := validateFAQEntry(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(&entry).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "修改失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// deleteFAQEntry 删除常见问题
+func deleteFAQEntry(c *gin.Context, db *gorm.DB) {
+	if err := db.Unscoped().Delete(&models.FAQEntry{}, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
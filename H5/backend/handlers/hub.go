@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// Hub 客服消息分发接口
+// 所有发给客服的 WebSocket 消息都先发布到 Hub，再由每个实例投递给连接在本机的客服，
+// 这样用户请求落在实例 A、客服连接在实例 B 时也能收到消息。
+type Hub interface {
+	// Publish 向指定客服发布一条消息（JSON 内容）
+	Publish(csID uint, payload []byte) error
+	// Subscribe 注册投递回调，收到任意实例发布的消息时调用
+	Subscribe(handler func(csID uint, payload []byte))
+	// Close 停止后台任务
+	Close()
+}
+
+var hub Hub = newMemoryHub()
+
+// wsClient 客服的 WebSocket 连接，gorilla/websocket 不支持并发写，写操作需加锁
+type wsClient struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsClient) write(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// wsEvent 非消息类的 WebSocket 事件（消息本身仍直接推送 Message JSON，兼容客服端）
+type wsEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// notifyCS 通过 Hub 向客服推送消息或事件
+func notifyCS(csID uint, v interface{}) {
+	if csID == 0 {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[Hub] 序列化消息失败，csID=%d, error=%v", csID, err)
+		return
+	}
+	if err := hub.Publish(csID, payload); err != nil {
+		log.Printf("[Hub] 发布消息失败，csID=%d, error=%v", csID, err)
+	}
+}
+
+// deliverToLocalCS 投递给连接在本实例的客服，不在本实例时忽略
+func deliverToLocalCS(csID uint, payload []byte) {
+	connMutex.Lock()
+	client, ok := connections[csID]
+	connMutex.Unlock()
+	if !ok {
+		return
+	}
+	if err := client.write(websocket.TextMessage, payload); err != nil {
+		log.Printf("[Hub] 推送给客服失败，csID=%d, error=%v", csID, err)
+	}
+}
+
+// memoryHub 单实例部署使用，发布即投递
+type memoryHub struct {
+	mu       sync.RWMutex
+	handlers []func(csID uint, payload []byte)
+}
+
+func newMemoryHub() *memoryHub {
+	return &memoryHub{}
+}
+
+func (h *memoryHub) Publish(csID uint, payload []byte) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, handler := range h.handlers {
+		handler(csID, payload)
+	}
+	return nil
+}
+
+func (h *memoryHub) Subscribe(handler func(csID uint, payload []byte)) {
+	h.mu.Lock()
+	h.handlers = append(h.handlers, handler)
+	h.mu.Unlock()
+}
+
+func (h *memoryHub) Close() {}
+
+// dbHub 多实例部署使用，通过 hub_events 表轮询分发，不依赖外部消息中间件。
+// 本实例发布的事件直接投递，其他实例轮询到后投递给各自的本地连接。
+type dbHub struct {
+	db         *gorm.DB
+	instanceID string
+	interval   time.Duration
+	retention  time.Duration
+	overlap    time.Duration
+	local      *memoryHub
+	lastID     uint
+	started    time.Time
+	delivered  map[uint]time.Time // 重叠窗口内已处理的事件，避免重复投递
+	stop       chan struct{}
+}
+
+func newDBHub(db *gorm.DB) *dbHub {
+	h := &dbHub{
+		db:         db,
+		instanceID: uuid.New().String(),
+		interval:   envDuration("HUB_POLL_INTERVAL", 500*time.Millisecond),
+		retention:  envDuration("HUB_RETENTION", 5*time.Minute),
+		overlap:    envDuration("HUB_POLL_OVERLAP", 5*time.Second),
+		local:      newMemoryHub(),
+		started:    time.Now(),
+		delivered:  make(map[uint]time.Time),
+		stop:       make(chan struct{}),
+	}
+	// 从当前最新事件开始，不重放启动前的历史事件
+	var last models.HubEvent
+	if err := db.Order("id DESC").Limit(1).Find(&last).Error; err == nil {
+		h.lastID = last.ID
+	}
+	go h.pollLoop()
+	go h.cleanupLoop()
+	log.Printf("[Hub] 使用数据库分发，instanceID=%s, 轮询间隔=%v", h.instanceID, h.interval)
+	return h
+}
+
+func (h *dbHub) Publish(csID uint, payload []byte) error {
+	h.local.Publish(csID, payload)
+	return h.db.Create(&models.HubEvent{
+		Origin:            h.instanceID,
+		CustomerServiceID: csID,
+		Payload:           string(payload),
+	}).Error
+}
+
+func (h *dbHub) Subscribe(handler func(csID uint, payload []byte)) {
+	h.local.Subscribe(handler)
+}
+
+func (h *dbHub) Close() {
+	close(h.stop)
+}
+
+func (h *dbHub) pollLoop() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.poll()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// poll 读取新事件。并发插入时自增 ID 不一定按顺序提交，较小的 ID 可能在较大的 ID 被读到之后才可见，
+// 因此除 lastID 之后的事件外，还重新扫描最近 HUB_POLL_OVERLAP（默认 5 秒，需大于事务提交延迟和实例间时钟偏差）内创建的事件，
+// 已处理过的跳过。两者分开查询，突发时重叠窗口内的大量已处理事件不会占满新事件的查询
+func (h *dbHub) poll() {
+	now := time.Now()
+	since := now.Add(-h.overlap)
+	if since.Before(h.started) {
+		since = h.started
+	}
+	var ids []uint
+	if err := h.db.Model(&models.HubEvent{}).Where("id <= ? AND created_at >= ?", h.lastID, since).
+		Pluck("id", &ids).Error; err != nil {
+		log.Printf("[Hub] 轮询事件失败: %v", err)
+		return
+	}
+	var late []uint
+	for _, id := range ids {
+		if _, ok := h.delivered[id]; !ok {
+			late = append(late, id)
+		}
+	}
+	if len(late) > 0 {
+		var events []models.HubEvent
+		if err := h.db.Where("id IN ?", late).Order("id ASC").Find(&events).Error; err != nil {
+			log.Printf("[Hub] 轮询事件失败: %v", err)
+			return
+		}
+		h.deliver(events, now)
+	}
+
+	// 新事件分页读取，直到读完
+	for {
+		var events []models.HubEvent
+		if err := h.db.Where("id > ?", h.lastID).Order("id ASC").Limit(1000).Find(&events).Error; err != nil {
+			log.Printf("[Hub] 轮询事件失败: %v", err)
+			return
+		}
+		h.deliver(events, now)
+		if len(events) < 1000 {
+			break
+		}
+	}
+
+	// 超出重叠窗口的事件不会再被查到，不再需要记录
+	for id, at := range h.delivered {
+		if now.Sub(at) > 2*h.overlap {
+			delete(h.delivered, id)
+		}
+	}
+}
+
+// deliver 投递其他实例发布的事件并记录为已处理
+func (h *dbHub) deliver(events []models.HubEvent, now time.Time) {
+	for _, ev := range events {
+		h.delivered[ev.ID] = now
+		if ev.ID > h.lastID {
+			h.lastID = ev.ID
+		}
+		if ev.Origin == h.instanceID {
+			continue
+		}
+		h.local.Publish(ev.CustomerServiceID, []byte(ev.Payload))
+	}
+}
+
+func (h *dbHub) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.db.Where("created_at < ?", time.Now().Add(-h.retention)).Delete(&models.HubEvent{})
+		case <-h.stop:
+			return
+		}
+	}
+}
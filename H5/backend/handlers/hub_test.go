@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"h5-backend/models"
+)
+
+// newTestDBHub 不启动后台轮询，由测试调用 poll
+func newTestDBHub(t *testing.T) (*dbHub, map[uint]int) {
+	t.Helper()
+	db := newTestDB(t, &models.HubEvent{})
+	h := &dbHub{
+		db:         db,
+		instanceID: "self",
+		overlap:    time.Minute,
+		local:      newMemoryHub(),
+		started:    time.Now().Add(-time.Hour),
+		delivered:  make(map[uint]time.Time),
+	}
+	received := map[uint]int{}
+	h.Subscribe(func(csID uint, payload []byte) { received[csID]++ })
+	return h, received
+}
+
+func TestDBHubPollBurst(t *testing.T) {
+	h, received := newTestDBHub(t)
+	// 重叠窗口内已有大量已处理的事件
+	var old []models.HubEvent
+	for i := 0; i < 1500; i++ {
+		old = append(old, models.HubEvent{Origin: "other", CustomerServiceID: 1})
+	}
+	h.db.CreateInBatches(&old, 500)
+	h.poll()
+	if received[1] != 1500 {
+		t.Fatalf("第一次轮询投递 %d 条，want 1500", received[1])
+	}
+
+	var burst []models.HubEvent
+	for i := 0; i < 2500; i++ {
+		burst = append(burst, models.HubEvent{Origin: "other", CustomerServiceID: 2})
+	}
+	burst = append(burst, models.HubEvent{Origin: "self", CustomerServiceID: 3})
+	h.db.CreateInBatches(&burst, 500)
+	h.poll()
+	if received[1] != 1500 || received[2] != 2500 {
+		t.Errorf("突发后投递 cs1=%d cs2=%d，want 1500 2500", received[1], received[2])
+	}
+	if received[3] != 0 {
+		t.Errorf("本实例发布的事件不应重复投递")
+	}
+	h.poll()
+	if received[1] != 1500 || received[2] != 2500 {
+		t.Errorf("再次轮询不应重复投递，cs1=%d cs2=%d", received[1], received[2])
+	}
+}
+
+func TestDBHubPollLateCommit(t *testing.T) {
+	h, received := newTestDBHub(t)
+	h.db.Create(&models.HubEvent{ID: 10, Origin: "other", CustomerServiceID: 1})
+	h.poll()
+	// ID 较小的事件在 ID 10 之后才提交
+	h.db.Create(&models.HubEvent{ID: 5, Origin: "other", CustomerServiceID: 2})
+	h.poll()
+	h.poll()
+	if received[1] != 1 || received[2] != 1 {
+		t.Errorf("received = %v，want 各一次", received)
+	}
+	if h.lastID != 10 {
+		t.Errorf("lastID = %d，want 10", h.lastID)
+	}
+
+	// 超出重叠窗口的迟到事件不再补发
+	h.db.Create(&models.HubEvent{ID: 6, Origin: "other", CustomerServiceID: 3, CreatedAt: time.Now().Add(-2 * time.Minute)})
+	h.poll()
+	if received[3] != 0 {
+		t.Errorf("超出窗口的事件不应投递")
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/buckket/go-blurhash"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // 注册 WebP 解码
+)
+
+// 图片处理尺寸（长边像素）
+const (
+	displayMaxSide = 1280 // 聊天窗口中显示的图片
+	thumbMaxSide   = 320  // 缩略图，用于列表和预览
+)
+
+// encodedImage 处理后的一张图片
+type encodedImage struct {
+	data []byte
+	ext  string
+	mime string
+}
+
+// processedImage 上传图片处理结果：去除 EXIF 等元数据的原图、压缩后的显示图和缩略图
+type processedImage struct {
+	original encodedImage
+	display  encodedImage // 原图不超过显示尺寸时为空，直接使用原图
+	thumb    encodedImage
+	width    int // 按 EXIF 方向旋转后的尺寸
+	height   int
+	blurhash string
+}
+
+// processImage 按 EXIF 方向旋转后重新编码，重新编码会丢弃 EXIF（包括 GPS 位置）等元数据。
+// 原图按来源格式编码：JPEG 仍为 JPEG，PNG 和 WebP 无损编码为 PNG，避免有损压缩和格式变化。
+// GIF 保留原文件以保留动画（GIF 不含 EXIF），缩略图取第一帧
+func processImage(data []byte, mimeType string, img image.Image) (processedImage, error) {
+	var out processedImage
+	if mimeType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	b := img.Bounds()
+	out.width, out.height = b.Dx(), b.Dy()
+
+	var err error
+	if mimeType == "image/gif" {
+		out.original = encodedImage{data: data, ext: ".gif", mime: mimeType}
+	} else {
+		if out.original, err = encodeOriginal(img, mimeType); err != nil {
+			return out, err
+		}
+		if longSide(b) > displayMaxSide {
+			if out.display, err = encodeImage(resizeImage(img, displayMaxSide, xdraw.ApproxBiLinear), 80); err != nil {
+				return out, err
+			}
+		}
+	}
+
+	thumb := img
+	if longSide(b) > thumbMaxSide {
+		thumb = resizeImage(img, thumbMaxSide, xdraw.CatmullRom)
+	}
+	if out.thumb, err = encodeImage(thumb, 70); err != nil {
+		return out, err
+	}
+	// blurhash 用缩略图计算，原图计算太慢
+	out.blurhash, _ = blurhash.Encode(4, 3, thumb)
+	return out, nil
+}
+
+func longSide(b image.Rectangle) int {
+	if b.Dx() > b.Dy() {
+		return b.Dx()
+	}
+	return b.Dy()
+}
+
+// resizeImage 等比缩放到长边为 maxSide
+func resizeImage(img image.Image, maxSide int, scaler xdraw.Scaler) image.Image {
+	b := img.Bounds()
+	w, h := maxSide, b.Dy()*maxSide/b.Dx()
+	if b.Dy() > b.Dx() {
+		w, h = b.Dx()*maxSide/b.Dy(), maxSide
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	scaler.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeOriginal 去除元数据后的原图，JPEG 重新编码为 JPEG，其他格式编码为 PNG
+func encodeOriginal(img image.Image, mimeType string) (encodedImage, error) {
+	var buf bytes.Buffer
+	if mimeType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+			return encodedImage{}, err
+		}
+		return encodedImage{data: buf.Bytes(), ext: ".jpg", mime: "image/jpeg"}, nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return encodedImage{}, err
+	}
+	return encodedImage{data: buf.Bytes(), ext: ".png", mime: "image/png"}, nil
+}
+
+// encodeImage 不透明的图片编码为 JPEG，带透明通道的编码为 PNG
+func encodeImage(img image.Image, quality int) (encodedImage, error) {
+	var buf bytes.Buffer
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		if err := png.Encode(&buf, img); err != nil {
+			return encodedImage{}, err
+		}
+		return encodedImage{data: buf.Bytes(), ext: ".png", mime: "image/png"}, nil
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return encodedImage{}, err
+	}
+	return encodedImage{data: buf.Bytes(), ext: ".jpg", mime: "image/jpeg"}, nil
+}
+
+// jpegOrientation 读取 JPEG 中 EXIF 的方向（1~8），没有或无法解析时返回 1
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) { // 图像数据开始，之后没有 EXIF
+			return 1
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation 从 EXIF 的 TIFF 结构中读取 IFD0 的 Orientation（0x0112）
+func tiffOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation 按 EXIF 方向旋转或翻转，使图片按拍摄时的方向显示。直接从解码结果读取像素，不复制整张原图
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	at := pixelReader(img)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.SetNRGBA(x, y, at(sx, sy))
+		}
+	}
+	return dst
+}
+
+// pixelReader 按相对于图片左上角的坐标读取像素。JPEG 解码结果（YCbCr）和 NRGBA 直接转换，其他类型按颜色模型转换
+func pixelReader(img image.Image) func(x, y int) color.NRGBA {
+	b := img.Bounds()
+	switch src := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) color.NRGBA {
+			c := src.YCbCrAt(b.Min.X+x, b.Min.Y+y)
+			r, g, bl := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+			return color.NRGBA{R: r, G: g, B: bl, A: 255}
+		}
+	case *image.NRGBA:
+		return func(x, y int) color.NRGBA {
+			return src.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	return func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+// exifJPEG 在 JPEG 的 SOI 之后插入只含 Orientation 的 EXIF（APP1）段
+func exifJPEG(t *testing.T, img image.Image, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8)) // IFD0 偏移
+	binary.Write(&tiff, order, uint16(1)) // 1 个条目
+	binary.Write(&tiff, order, uint16(0x0112))
+	binary.Write(&tiff, order, uint16(3)) // SHORT
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, uint16(orientation))
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(0)) // 没有下一个 IFD
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(buf.Bytes()[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(buf.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for o := 1; o <= 8; o++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if got := jpegOrientation(exifJPEG(t, img, o, order)); got != o {
+				t.Errorf("orientation %d (%v) = %d", o, order, got)
+			}
+		}
+	}
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"没有 EXIF", plain.Bytes()},
+		{"方向超出范围", exifJPEG(t, img, 9, binary.BigEndian)},
+		{"不是 JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"截断的段", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x40, 'E', 'x'}},
+		{"空数据", nil},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != 1 {
+			t.Errorf("%s: orientation = %d, want 1", tt.name, got)
+		}
+	}
+}
+
+// labeled 3x2 的图片，像素按行依次标记为 1~6（红色通道）
+func labeled() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.NRGBA{uint8(y*3 + x + 1), 0, 0, 255})
+		}
+	}
+	return img
+}
+
+func labels(img image.Image) [][]uint8 {
+	b := img.Bounds()
+	var rows [][]uint8
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var row []uint8
+		for x := b.Min.X; x < b.Max.X; x++ {
+			row = append(row, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).R)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestApplyOrientation(t *testing.T) {
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},   // 水平翻转
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},   // 旋转 180°
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},   // 垂直翻转
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}}, // 沿左上-右下对角线翻转
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}}, // 顺时针旋转 90°
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}}, // 沿右上-左下对角线翻转
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}}, // 逆时针旋转 90°
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		if got := labels(applyOrientation(labeled(), tt.orientation)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orientation %d = %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+
+	// JPEG 解码结果（YCbCr）与按颜色模型逐像素转换的结果一致
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, labeled(), &jpeg.Options{Quality: 100})
+	ycc, _ := jpeg.Decode(&buf)
+	if _, ok := ycc.(*image.YCbCr); !ok {
+		t.Fatalf("JPEG 解码结果为 %T", ycc)
+	}
+	for o := 2; o <= 8; o++ {
+		got := applyOrientation(ycc, o)
+		want := applyOrientation(image.Image(genericImage{ycc}), o)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("YCbCr orientation %d 与逐像素转换结果不一致", o)
+		}
+	}
+
+	// 图片边界不从原点开始时同样按相对位置处理
+	sub := labeled().(*image.NRGBA).SubImage(image.Rect(1, 0, 3, 2))
+	if got, want := labels(applyOrientation(sub, 6)), [][]uint8{{5, 2}, {6, 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sub image = %v, want %v", got, want)
+	}
+}
+
+func TestProcessImageKeepsFormat(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			opaque.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 12), 100, 255})
+		}
+	}
+	pngData := pngFixture(t, 40, 20)
+	pngImg, _, _ := image.Decode(bytes.NewReader(pngData))
+	jpegData := exifJPEG(t, opaque, 6, binary.LittleEndian)
+	jpegImg, _, _ := image.Decode(bytes.NewReader(jpegData))
+
+	tests := []struct {
+		name         string
+		data         []byte
+		mime         string
+		img          image.Image
+		wantExt      string
+		wantFormat   string
+		wantW, wantH int
+	}{
+		{"不透明的 PNG 仍为 PNG", pngData, "image/png", pngImg, ".png", "png", 40, 20},
+		{"WebP 编码为 PNG", nil, "image/webp", opaque, ".png", "png", 40, 20},
+		{"JPEG 按方向旋转", jpegData, "image/jpeg", jpegImg, ".jpg", "jpeg", 20, 40},
+	}
+	for _, tt := range tests {
+		p, err := processImage(tt.data, tt.mime, tt.img)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.original.ext != tt.wantExt || p.width != tt.wantW || p.height != tt.wantH {
+			t.Errorf("%s: original %s %dx%d, want %s %dx%d", tt.name, p.original.ext, p.width, p.height, tt.wantExt, tt.wantW, tt.wantH)
+		}
+		decoded, format, err := image.Decode(bytes.NewReader(p.original.data))
+		if err != nil || format != tt.wantFormat {
+			t.Errorf("%s: 原图内容为 %s，err=%v", tt.name, format, err)
+			continue
+		}
+		if b := decoded.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("%s: 原图尺寸 %v", tt.name, b)
+		}
+		if jpegOrientation(p.original.data) != 1 {
+			t.Errorf("%s: 原图仍包含 EXIF 方向", tt.name)
+		}
+	}
+}
+
+// genericImage 隐藏具体类型，使 applyOrientation 按颜色模型逐像素转换
+type genericImage struct{ image.Image }
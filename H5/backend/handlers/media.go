@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+var (
+	store        storage.Storage // 上传文件的存储后端
+	uploadsStore *storage.Local  // 通过 /uploads 访问的本地文件（本地存储，或切换到 S3 前上传的旧文件）
+)
+
+// initStorage 按环境变量创建存储后端：
+// STORAGE_BACKEND=local（默认，保存到 UPLOAD_DIR）或 s3（S3_ENDPOINT、S3_BUCKET 等）；
+// PUBLIC_BASE_URL 为后端对外地址，S3_PUBLIC_BASE_URL 为对象存储或 CDN 的访问地址
+func initStorage() {
+	publicBaseURL := envString("PUBLIC_BASE_URL", "https://kefu.chacaitx.cn")
+	uploadDir := envString("UPLOAD_DIR", "./uploads")
+	signingKey := envString("MEDIA_SIGNING_KEY", "")
+	if mediaPrivate() && signingKey == "" {
+		signingKey = uuid.New().String()
+		log.Printf("[存储] 未配置 MEDIA_SIGNING_KEY，使用随机密钥，重启后已签发的临时地址失效，多实例部署时必须配置")
+	}
+
+	backend := envString("STORAGE_BACKEND", "local")
+	cfg := storage.Config{
+		Backend:       backend,
+		PublicBaseURL: publicBaseURL,
+		LocalDir:      uploadDir,
+		SigningKey:    signingKey,
+	}
+	if backend == "s3" {
+		cfg.PublicBaseURL = envString("S3_PUBLIC_BASE_URL", "")
+		cfg.Endpoint = envString("S3_ENDPOINT", "")
+		cfg.AccessKey = envString("S3_ACCESS_KEY", "")
+		cfg.SecretKey = envString("S3_SECRET_KEY", "")
+		cfg.Bucket = envString("S3_BUCKET", "")
+		cfg.Region = envString("S3_REGION", "")
+		cfg.UseSSL = envBool("S3_USE_SSL", false)
+		cfg.PublicEndpoint = envString("S3_PUBLIC_ENDPOINT", "")
+		cfg.Private = mediaPrivate()
+	}
+	s, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("[存储] 初始化失败: %v", err)
+	}
+	store = s
+
+	if local, ok := s.(*storage.Local); ok {
+		uploadsStore = local
+	} else if local, err := storage.NewLocal(uploadDir, publicBaseURL, signingKey); err == nil {
+		uploadsStore = local
+	}
+	log.Printf("[存储] 使用 %s 存储，访问地址 %s", backend, store.URL(""))
+}
+
+// mediaPrivate MEDIA_PRIVATE=true 时上传的文件不公开访问，返回给客户端的地址为临时签名地址
+func mediaPrivate() bool {
+	return envBool("MEDIA_PRIVATE", false)
+}
+
+// newMediaKey 生成文件路径，按年月分目录
+func newMediaKey(ext string) string {
+	return time.Now().Format("2006/01/") + uuid.New().String() + strings.ToLower(ext)
+}
+
+// mediaURL 返回文件的访问地址，私有模式下为有效期 MEDIA_URL_EXPIRY（默认 1 小时）的签名地址
+func mediaURL(url string) string {
+	if !mediaPrivate() || url == "" {
+		return url
+	}
+	for _, s := range []storage.Storage{store, uploadsStore} {
+		if s == nil {
+			continue
+		}
+		if key, ok := storage.KeyFromURL(s, url); ok {
+			signed, err := s.SignedURL(context.Background(), key, envDuration("MEDIA_URL_EXPIRY", time.Hour))
+			if err != nil {
+				log.Printf("[存储] 生成签名地址失败，key=%s, error=%v", key, err)
+				return url
+			}
+			return signed
+		}
+	}
+	return url
+}
+
+// mediaPayloadFields Payload 中保存文件地址的字段
+var mediaPayloadFields = []string{"url", "coverUrl", "imageUrl", "thumbUrl", "displayUrl"}
+
+// signMessageMedia 私有模式下把消息中的文件地址替换为签名地址，数据库中仍保存原地址
+func signMessageMedia(msg *models.Message) {
+	if !mediaPrivate() {
+		return
+	}
+	msg.ImageURL = mediaURL(msg.ImageURL)
+	if len(msg.Payload) == 0 {
+		return
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(msg.Payload, &fields) != nil {
+		return
+	}
+	for _, f := range mediaPayloadFields {
+		if s, ok := fields[f].(string); ok {
+			fields[f] = mediaURL(s)
+		}
+	}
+	msg.Payload, _ = json.Marshal(fields)
+}
+
+// SetupMediaRoutes 注册 /uploads 文件访问路由（本地存储）
+func SetupMediaRoutes(r *gin.Engine) {
+	r.GET("/uploads/*key", serveUpload)
+	r.HEAD("/uploads/*key", serveUpload)
+}
+
+// setSafeMediaHeaders 按扩展名设置 Content-Type，不使用文件本身或客户端提供的类型：
+// 允许的图片、音视频直接显示，其他文件（包括旧版上传的任意扩展名文件）一律作为附件下载，并禁止浏览器嗅探和执行脚本
+func setSafeMediaHeaders(c *gin.Context, key string) {
+	t, ok := uploadTypeByExt(path.Ext(key))
+	contentType := "application/octet-stream"
+	if ok {
+		contentType = t.mime
+	}
+	c.Header("Content-Type", contentType)
+	if ok && t.inline {
+		c.Header("Content-Disposition", "inline")
+	} else {
+		c.Header("Content-Disposition", "attachment; filename=\""+path.Base(key)+"\"")
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; media-src 'self'; img-src 'self'; sandbox")
+}
+
+// serveUpload 读取本地存储的文件，私有模式下需要有效的签名
+func serveUpload(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if uploadsStore == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		return
+	}
+	if mediaPrivate() && !uploadsStore.Verify(key, c.Query("expires"), c.Query("sig")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "访问地址无效或已过期"})
+		return
+	}
+	rc, info, err := uploadsStore.Get(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "文件路径无效"})
+		}
+		return
+	}
+	defer rc.Close()
+	setSafeMediaHeaders(c, key)
+	// 本地文件可以 Seek，由 ServeContent 处理 Range 和 If-Modified-Since，视频播放器需要按范围请求才能播放和拖动进度
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, "", info.LastModified, rs)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		io.Copy(c.Writer, rc)
+	}
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// recalledText 撤回后显示的占位内容
+const recalledText = "消息已撤回"
+
+// messageView 返回给用户和客服的消息：撤回的消息清空内容，原内容只在管理员审计接口中可见；私有文件地址替换为签名地址
+func messageView(msg models.Message) models.Message {
+	if msg.RecalledAt != nil {
+		msg.Content = recalledText
+		msg.Payload = nil
+		msg.IsImage = false
+		msg.ImageURL = ""
+	}
+	signMessageMedia(&msg)
+	return msg
+}
+
+// editWindow 发送者可以撤回和编辑消息的时间，用户默认 2 分钟，客服默认 10 分钟
+func editWindow(fromUser bool) time.Duration {
+	if fromUser {
+		return envDuration("RECALL_WINDOW_USER", 2*time.Minute)
+	}
+	return envDuration("RECALL_WINDOW_AGENT", 10*time.Minute)
+}
+
+// checkSender 校验是否为消息发送者本人，且消息仍可修改
+func checkSender(msg models.Message, userID, csID uint) (int, error) {
+	fromUser := csID == 0
+	if msg.IsSystem || msg.IsBot || msg.FromUser != fromUser ||
+		(fromUser && msg.UserID != userID) || (!fromUser && msg.CustomerServiceID != csID) {
+		return http.StatusForbidden, fmt.Errorf("只能修改自己发送的消息")
+	}
+	if msg.RecalledAt != nil {
+		return http.StatusConflict, fmt.Errorf("消息已撤回")
+	}
+	if time.Since(msg.CreatedAt) > editWindow(fromUser) {
+		return http.StatusForbidden, fmt.Errorf("已超过可修改时间（%v）", editWindow(fromUser))
+	}
+	return 0, nil
+}
+
+// notifyMessageChange 通知会话当前客服消息被撤回或编辑（会话转接后发送消息的客服可能不是当前客服）；
+// 小程序端通过拉取聊天记录获得最新内容
+func notifyMessageChange(db *gorm.DB, event string, msg models.Message) {
+	ev := wsEvent{Type: event, Data: messageView(msg)}
+	var conv models.Conversation
+	if db.First(&conv, msg.ConversationID).Error == nil && conv.CustomerServiceID != msg.CustomerServiceID {
+		notifyCS(conv.CustomerServiceID, ev)
+	}
+	notifyCS(msg.CustomerServiceID, ev)
+}
+
+// recallMessage 撤回消息，保存原内容供审计
+func recallMessage(db *gorm.DB, msg *models.Message, csID uint) error {
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.Message{}).Where("id = ? AND recalled_at IS NULL", msg.ID).Update("recalled_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("消息已撤回")
+		}
+		return tx.Create(&models.MessageRevision{
+			MessageID:         msg.ID,
+			UserID:            msg.UserID,
+			Action:            models.RevisionRecall,
+			Content:           msg.Content,
+			Payload:           msg.Payload,
+			FromUser:          csID == 0,
+			CustomerServiceID: csID,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	msg.RecalledAt = &now
+	notifyMessageChange(db, "message_recalled", *msg)
+	return nil
+}
+
+// editMessage 编辑文本消息，保存修改前的内容
+func editMessage(db *gorm.DB, msg *models.Message, csID uint, content string) (int, error) {
+	if msg.Type != models.MessageTypeText {
+		return http.StatusBadRequest, fmt.Errorf("只能编辑文本消息")
+	}
+	if strings.TrimSpace(content) == "" {
+		return http.StatusBadRequest, fmt.Errorf("消息内容不能为空")
+	}
+	if utf8.RuneCountInString(content) > 5000 {
+		return http.StatusBadRequest, fmt.Errorf("消息内容不能超过 5000 字")
+	}
+	if content == msg.Content {
+		return 0, nil
+	}
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.MessageRevision{
+			MessageID:         msg.ID,
+			UserID:            msg.UserID,
+			Action:            models.RevisionEdit,
+			Content:           msg.Content,
+			FromUser:          csID == 0,
+			CustomerServiceID: csID,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(msg).Updates(map[string]interface{}{"content": content, "edited_at": now}).Error
+	})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("编辑失败: %v", err)
+	}
+	msg.Content = content
+	msg.EditedAt = &now
+	notifyMessageChange(db, "message_edited", *msg)
+	return 0, nil
+}
+
+// loadUserMessage 小程序用户的消息，用户由 appId + openId 确定
+func loadUserMessage(c *gin.Context, db *gorm.DB, appID, openID string) (models.Message, bool) {
+	var msg models.Message
+	_, user, err := findMiniAppUser(db, appID, openID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return msg, false
+	}
+	if err := db.First(&msg, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "消息不存在"})
+		return msg, false
+	}
+	if status, err := checkSender(msg, user.ID, 0); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return msg, false
+	}
+	return msg, true
+}
+
+// loadAgentMessage 客服自己发送的消息
+func loadAgentMessage(c *gin.Context, db *gorm.DB) (models.Message, uint, bool) {
+	var msg models.Message
+	csID := parseUint(c.Param("csId"))
+	if err := db.First(&msg, parseUint(c.Param("id"))).Error; err != nil || csID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "消息不存在"})
+		return msg, csID, false
+	}
+	if status, err := checkSender(msg, 0, csID); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return msg, csID, false
+	}
+	return msg, csID, true
+}
+
+// recallUserMessage 用户撤回自己的消息（DELETE /chat/message/:id?appId=&openId=）
+func recallUserMessage(c *gin.Context, db *gorm.DB) {
+	msg, ok := loadUserMessage(c, db, c.Query("appId"), c.Query("openId"))
+	if !ok {
+		return
+	}
+	if err := recallMessage(db, &msg, 0); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "recalled", "message": messageView(msg)})
+}
+
+// editUserMessage 用户编辑自己的文本消息
+func editUserMessage(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		AppID   string `json:"appId"`
+		OpenID  string `json:"openId"`
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	msg, ok := loadUserMessage(c, db, req.AppID, req.OpenID)
+	if !ok {
+		return
+	}
+	if status, err := editMessage(db, &msg, 0, req.Content); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "edited", "message": msg})
+}
+
+// recallAgentMessage 客服撤回自己的消息
+func recallAgentMessage(c *gin.Context, db *gorm.DB) {
+	msg, csID, ok := loadAgentMessage(c, db)
+	if !ok {
+		return
+	}
+	if err := recallMessage(db, &msg, csID); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "recalled", "message": messageView(msg)})
+}
+
+// editAgentMessage 客服编辑自己的文本消息
+func editAgentMessage(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		Content string `json:"Content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	msg, csID, ok := loadAgentMessage(c, db)
+	if !ok {
+		return
+	}
+	if status, err := editMessage(db, &msg, csID, req.Content); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "edited", "message": msg})
+}
+
+// getMessageRevisions 管理员查看消息原始内容和修改记录（审计）
+func getMessageRevisions(c *gin.Context, db *gorm.DB) {
+	var msg models.Message
+	if err := db.First(&msg, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "消息不存在"})
+		return
+	}
+	var revisions []models.MessageRevision
+	db.Where("message_id = ?", msg.ID).Order("id ASC").Find(&revisions)
+	c.JSON(http.StatusOK, gin.H{"message": msg, "revisions": revisions})
+}
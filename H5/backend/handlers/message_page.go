@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// 聊天记录每页条数
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+// messagePage 聊天记录分页参数：
+// before/after 为消息ID游标，分别取该消息之前（更早）或之后的消息；都不传时取最新的消息；
+// since 为增量同步时间（RFC3339 或毫秒时间戳），返回此后新增或变更（编辑、撤回、已读）的消息；
+// sinceId 与 since 组成 (updated_at, id) 游标，只返回该消息之后的变更，同一时刻变更的消息超过一页时也能继续同步
+type messagePage struct {
+	before, after uint
+	since         time.Time
+	sinceID       uint
+	limit         int
+}
+
+func parseMessagePage(c *gin.Context) (messagePage, error) {
+	p := messagePage{
+		before:  parseUint(c.Query("before")),
+		after:   parseUint(c.Query("after")),
+		sinceID: parseUint(c.Query("sinceId")),
+		limit:   defaultMessagePageSize,
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("limit 参数错误")
+		}
+		if n > maxMessagePageSize {
+			n = maxMessagePageSize
+		}
+		p.limit = n
+	}
+	if v := c.Query("since"); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			p.since = time.UnixMilli(ms)
+		} else if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			p.since = t
+		} else {
+			return p, fmt.Errorf("since 参数错误，应为 RFC3339 时间或毫秒时间戳")
+		}
+	}
+	if p.sinceID != 0 && p.since.IsZero() {
+		return p, fmt.Errorf("sinceId 需要与 since 一起使用")
+	}
+	if p.before != 0 && p.after != 0 {
+		return p, fmt.Errorf("before 和 after 不能同时使用")
+	}
+	return p, nil
+}
+
+// findMessagePage 按分页参数查询用户的聊天记录，结果按时间正序；hasMore 表示同方向还有更多消息
+func findMessagePage(db *gorm.DB, userID uint, p messagePage) ([]models.Message, bool, error) {
+	query := db.Where("user_id = ? AND is_deleted = ?", userID, false).Limit(p.limit + 1)
+	var messages []models.Message
+
+	if !p.since.IsZero() {
+		// 没有 sinceId 时包含 updated_at 等于 since 的记录，避免同一时刻的变更被遗漏，客户端按 ID 去重合并。
+		// updated_at 为毫秒精度（MySQL datetime(3)），与 X-Sync-Time 一致，可以按等于比较
+		if p.sinceID != 0 {
+			query = query.Where("updated_at > ? OR (updated_at = ? AND id > ?)", p.since, p.since, p.sinceID)
+		} else {
+			query = query.Where("updated_at >= ?", p.since)
+		}
+		err := query.Order("updated_at ASC, id ASC").Find(&messages).Error
+		hasMore := len(messages) > p.limit
+		if hasMore {
+			messages = messages[:p.limit]
+		}
+		return messages, hasMore, err
+	}
+
+	desc := p.after == 0
+	if cursorID := p.before + p.after; cursorID != 0 {
+		var cursor models.Message
+		if err := db.Select("id", "created_at").Where("user_id = ?", userID).First(&cursor, cursorID).Error; err != nil {
+			return nil, false, fmt.Errorf("游标消息不存在")
+		}
+		if desc {
+			query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		} else {
+			query = query.Where("created_at > ? OR (created_at = ? AND id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		}
+	}
+	if desc {
+		query = query.Order("created_at DESC, id DESC")
+	} else {
+		query = query.Order("created_at ASC, id ASC")
+	}
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > p.limit
+	if hasMore {
+		messages = messages[:p.limit]
+	}
+	if desc {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, hasMore, nil
+}
+
+// setPageHeaders 分页信息放在响应头中，响应体仍为消息数组，兼容旧版客户端
+// X-Sync-Time 为本页消息中最新的 updated_at（毫秒），下次增量同步时作为 since 传入；没有消息时不返回。
+// 增量同步时还返回 X-Sync-Id（本页最后一条消息的 ID），下次作为 sinceId 传入
+func setPageHeaders(c *gin.Context, messages []models.Message, hasMore bool, p messagePage) {
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	if !p.since.IsZero() {
+		// 增量同步按 (updated_at, id) 排序，最后一条即游标
+		syncTime, syncID := p.since, p.sinceID
+		if len(messages) > 0 {
+			last := messages[len(messages)-1]
+			syncTime, syncID = last.UpdatedAt, last.ID
+		}
+		c.Header("X-Sync-Time", strconv.FormatInt(syncTime.UnixMilli(), 10))
+		if syncID != 0 {
+			c.Header("X-Sync-Id", strconv.FormatUint(uint64(syncID), 10))
+		}
+		return
+	}
+	var syncTime time.Time
+	for _, msg := range messages {
+		if msg.UpdatedAt.After(syncTime) {
+			syncTime = msg.UpdatedAt
+		}
+	}
+	if !syncTime.IsZero() {
+		c.Header("X-Sync-Time", strconv.FormatInt(syncTime.UnixMilli(), 10))
+	}
+}
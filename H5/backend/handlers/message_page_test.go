@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"h5-backend/models"
+)
+
+// newTestDB 内存 SQLite 数据库，用于测试查询逻辑
+func newTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	// 内存数据库每个连接是独立的，只使用一个连接
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func testContext(target string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", target, nil)
+	return c
+}
+
+func TestParseMessagePage(t *testing.T) {
+	since := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query   string
+		want    messagePage
+		wantErr bool
+	}{
+		{"", messagePage{limit: defaultMessagePageSize}, false},
+		{"?before=12&limit=20", messagePage{before: 12, limit: 20}, false},
+		{"?after=12", messagePage{after: 12, limit: defaultMessagePageSize}, false},
+		{"?limit=10000", messagePage{limit: maxMessagePageSize}, false},
+		{"?limit=0", messagePage{}, true},
+		{"?limit=-5", messagePage{}, true},
+		{"?limit=abc", messagePage{}, true},
+		{"?since=1792396800000", messagePage{since: since, limit: defaultMessagePageSize}, false},
+		{"?since=2026-10-19T16:00:00%2B08:00", messagePage{since: since, limit: defaultMessagePageSize}, false},
+		{"?since=yesterday", messagePage{}, true},
+		{"?before=1&after=2", messagePage{}, true},
+		{"?since=1792396800000&sinceId=7", messagePage{since: since, sinceID: 7, limit: defaultMessagePageSize}, false},
+		{"?sinceId=7", messagePage{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMessagePage(testContext("/" + tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMessagePage(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got.before != tt.want.before || got.after != tt.want.after || got.limit != tt.want.limit || !got.since.Equal(tt.want.since) || got.sinceID != tt.want.sinceID {
+			t.Errorf("parseMessagePage(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func messageIDs(messages []models.Message) []uint {
+	ids := []uint{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// seedMessages 用户 1 的消息 1~7，其中 2~4 和 6~7 的 created_at 相同，另有已删除和其他用户的消息
+func seedMessages(t *testing.T, db *gorm.DB) time.Time {
+	t.Helper()
+	base := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	offsets := []int{0, 1, 1, 1, 2, 3, 3}
+	for i, off := range offsets {
+		at := base.Add(time.Duration(off) * time.Minute)
+		msg := models.Message{ID: uint(i + 1), UserID: 1, Content: "m", CreatedAt: at, UpdatedAt: at}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("create message: %v", err)
+		}
+	}
+	db.Create(&models.Message{ID: 8, UserID: 1, Content: "deleted", IsDeleted: true, CreatedAt: base, UpdatedAt: base})
+	db.Create(&models.Message{ID: 9, UserID: 2, Content: "other", CreatedAt: base, UpdatedAt: base})
+	return base
+}
+
+func TestFindMessagePageCursor(t *testing.T) {
+	db := newTestDB(t, &models.Message{})
+	seedMessages(t, db)
+
+	tests := []struct {
+		name     string
+		page     messagePage
+		want     []uint
+		wantMore bool
+	}{
+		{"最新一页", messagePage{limit: 3}, []uint{5, 6, 7}, true},
+		{"全部", messagePage{limit: 50}, []uint{1, 2, 3, 4, 5, 6, 7}, false},
+		{"before 跨过相同时间", messagePage{before: 5, limit: 3}, []uint{2, 3, 4}, true},
+		{"before 落在相同时间中间", messagePage{before: 3, limit: 3}, []uint{1, 2}, false},
+		{"before 相同时间的最后一条", messagePage{before: 7, limit: 1}, []uint{6}, true},
+		{"before 第一条", messagePage{before: 1, limit: 3}, []uint{}, false},
+		{"after 落在相同时间中间", messagePage{after: 2, limit: 2}, []uint{3, 4}, true},
+		{"after 恰好取完", messagePage{after: 4, limit: 3}, []uint{5, 6, 7}, false},
+		{"after 最后一条", messagePage{after: 7, limit: 3}, []uint{}, false},
+	}
+	for _, tt := range tests {
+		got, more, err := findMessagePage(db, 1, tt.page)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ids := messageIDs(got); !reflect.DeepEqual(ids, tt.want) || more != tt.wantMore {
+			t.Errorf("%s: got %v more=%v, want %v more=%v", tt.name, ids, more, tt.want, tt.wantMore)
+		}
+	}
+
+	if _, _, err := findMessagePage(db, 1, messagePage{before: 100, limit: 3}); err == nil {
+		t.Error("不存在的游标消息应返回错误")
+	}
+	if _, _, err := findMessagePage(db, 1, messagePage{after: 9, limit: 3}); err == nil {
+		t.Error("其他用户的消息不能作为游标")
+	}
+}
+
+func TestFindMessagePageWalk(t *testing.T) {
+	db := newTestDB(t, &models.Message{})
+	seedMessages(t, db)
+
+	// 每页 2 条向前翻页，相同时间的消息不能重复或遗漏
+	var all []uint
+	page, more, _ := findMessagePage(db, 1, messagePage{limit: 2})
+	all = append(messageIDs(page), all...)
+	for more {
+		page, more, _ = findMessagePage(db, 1, messagePage{before: page[0].ID, limit: 2})
+		all = append(messageIDs(page), all...)
+	}
+	if want := []uint{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(all, want) {
+		t.Errorf("向前翻页 got %v, want %v", all, want)
+	}
+
+	all = nil
+	page, more, _ = findMessagePage(db, 1, messagePage{after: 1, limit: 2})
+	all = append(all, messageIDs(page)...)
+	for more {
+		page, more, _ = findMessagePage(db, 1, messagePage{after: page[len(page)-1].ID, limit: 2})
+		all = append(all, messageIDs(page)...)
+	}
+	if want := []uint{2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(all, want) {
+		t.Errorf("向后翻页 got %v, want %v", all, want)
+	}
+}
+
+func TestFindMessagePageSince(t *testing.T) {
+	db := newTestDB(t, &models.Message{})
+	base := seedMessages(t, db)
+
+	// 消息 2 被编辑，updated_at 晚于其他消息
+	edited := base.Add(10 * time.Minute)
+	db.Model(&models.Message{}).Where("id = ?", 2).UpdateColumn("updated_at", edited)
+
+	tests := []struct {
+		name     string
+		since    time.Time
+		limit    int
+		want     []uint
+		wantMore bool
+	}{
+		{"包含与 since 相同的时间", base.Add(3 * time.Minute), 50, []uint{6, 7, 2}, false},
+		{"只返回变更", base.Add(5 * time.Minute), 50, []uint{2}, false},
+		{"分页", base.Add(time.Minute), 2, []uint{3, 4}, true},
+		{"没有变更", edited.Add(time.Millisecond), 50, []uint{}, false},
+	}
+	for _, tt := range tests {
+		got, more, err := findMessagePage(db, 1, messagePage{since: tt.since, limit: tt.limit})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ids := messageIDs(got); !reflect.DeepEqual(ids, tt.want) || more != tt.wantMore {
+			t.Errorf("%s: got %v more=%v, want %v more=%v", tt.name, ids, more, tt.want, tt.wantMore)
+		}
+	}
+}
+
+func TestFindMessagePageSinceCursor(t *testing.T) {
+	db := newTestDB(t, &models.Message{})
+	base := seedMessages(t, db)
+
+	// 批量标记已读，所有消息的 updated_at 相同，超过一页
+	read := base.Add(10 * time.Minute)
+	db.Model(&models.Message{}).Where("user_id = ?", 1).UpdateColumn("updated_at", read)
+
+	// 按响应头中的 X-Sync-Time 和 X-Sync-Id 继续同步，不能重复返回同一页
+	p := messagePage{since: base, limit: 3}
+	var all []uint
+	for i := 0; i < 10; i++ {
+		page, more, err := findMessagePage(db, 1, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, messageIDs(page)...)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		setPageHeaders(c, page, more, p)
+		ms, _ := strconv.ParseInt(c.Writer.Header().Get("X-Sync-Time"), 10, 64)
+		p.since = time.UnixMilli(ms).UTC()
+		p.sinceID = parseUint(c.Writer.Header().Get("X-Sync-Id"))
+		if !more {
+			break
+		}
+	}
+	if want := []uint{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(all, want) {
+		t.Errorf("同步结果 %v，want %v", all, want)
+	}
+	if !p.since.Equal(read) || p.sinceID != 7 {
+		t.Errorf("最终游标 (%v, %d)，want (%v, 7)", p.since, p.sinceID, read)
+	}
+
+	// 没有新的变更时游标保持不变
+	page, _, _ := findMessagePage(db, 1, p)
+	if len(page) != 0 {
+		t.Errorf("没有变更时返回 %v", messageIDs(page))
+	}
+	db.Model(&models.Message{}).Where("id = ?", 3).UpdateColumn("updated_at", read.Add(time.Second))
+	page, _, _ = findMessagePage(db, 1, p)
+	if ids := messageIDs(page); !reflect.DeepEqual(ids, []uint{3}) {
+		t.Errorf("新的变更 %v，want [3]", ids)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// messageQuote 被引用消息的预览
+type messageQuote struct {
+	ID       uint   `json:"ID"`
+	FromUser bool   `json:"FromUser"`
+	Type     string `json:"Type"`
+	Excerpt  string `json:"Excerpt"`
+	Recalled bool   `json:"Recalled"`
+}
+
+// quotedMessage 返回给用户和客服的消息，回复消息附带被引用消息的预览
+type quotedMessage struct {
+	models.Message
+	ReplyTo *messageQuote `json:"ReplyTo,omitempty"`
+}
+
+func quoteOf(parent models.Message) *messageQuote {
+	return &messageQuote{
+		ID:       parent.ID,
+		FromUser: parent.FromUser,
+		Type:     parent.Type,
+		Excerpt:  truncateRunes(messageSummary(parent), 50),
+		Recalled: parent.RecalledAt != nil,
+	}
+}
+
+// messageViews 批量生成消息视图，一次查询所有被引用的消息
+func messageViews(db *gorm.DB, msgs []models.Message) []quotedMessage {
+	var parentIDs []uint
+	for _, msg := range msgs {
+		if msg.ReplyToID != 0 {
+			parentIDs = append(parentIDs, msg.ReplyToID)
+		}
+	}
+	parents := make(map[uint]models.Message)
+	if len(parentIDs) > 0 {
+		var list []models.Message
+		db.Where("id IN ?", uniqueIDs(parentIDs)).Find(&list)
+		for _, p := range list {
+			parents[p.ID] = p
+		}
+	}
+	views := make([]quotedMessage, len(msgs))
+	for i, msg := range msgs {
+		views[i] = quotedMessage{Message: messageView(msg)}
+		if p, ok := parents[msg.ReplyToID]; ok {
+			views[i].ReplyTo = quoteOf(p)
+		}
+	}
+	return views
+}
+
+// quotedView 单条消息的视图，用于发送后的返回和 WebSocket 推送
+func quotedView(db *gorm.DB, msg models.Message) quotedMessage {
+	return messageViews(db, []models.Message{msg})[0]
+}
+
+// validateReplyTo 被引用的消息必须属于同一个用户的聊天记录
+func validateReplyTo(db *gorm.DB, msg *models.Message) error {
+	if msg.ReplyToID == 0 {
+		return nil
+	}
+	var parent models.Message
+	if err := db.Select("id", "user_id", "is_deleted").First(&parent, msg.ReplyToID).Error; err != nil ||
+		parent.UserID != msg.UserID || parent.IsDeleted {
+		return fmt.Errorf("引用的消息不存在")
+	}
+	return nil
+}
+
+// pushExcerpt 订阅推送的消息摘要，回复消息加上“回复: ”前缀
+func pushExcerpt(msg models.Message) string {
+	if msg.ReplyToID != 0 {
+		return "回复: " + messageSummary(msg)
+	}
+	return messageSummary(msg)
+}
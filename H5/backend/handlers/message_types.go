@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"h5-backend/models"
+)
+
+// 各消息类型的 Payload 结构
+
+// imagePayload 图片消息，displayUrl/thumbUrl/blurhash 来自上传接口的处理结果
+type imagePayload struct {
+	URL        string `json:"url"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	DisplayURL string `json:"displayUrl,omitempty"` // 压缩后的显示图
+	ThumbURL   string `json:"thumbUrl,omitempty"`   // 缩略图
+	Blurhash   string `json:"blurhash,omitempty"`   // 加载前显示的模糊占位图
+}
+
+type filePayload struct {
+	URL      string `json:"url"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size,omitempty"` // 字节
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+type voicePayload struct {
+	URL      string `json:"url"`
+	Duration int    `json:"duration"` // 秒
+}
+
+type videoPayload struct {
+	URL      string `json:"url"`
+	Duration int    `json:"duration,omitempty"` // 秒
+	CoverURL string `json:"coverUrl,omitempty"`
+}
+
+type locationPayload struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+type linkPayload struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+}
+
+type productPayload struct {
+	ProductID string `json:"productId"`
+	Title     string `json:"title"`
+	Price     string `json:"price,omitempty"` // 展示用价格，如 "¥99.00"
+	ImageURL  string `json:"imageUrl,omitempty"`
+	PagePath  string `json:"pagePath,omitempty"` // 点击跳转的小程序页面
+}
+
+type orderPayload struct {
+	OrderID  string `json:"orderId"`
+	Title    string `json:"title,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Amount   string `json:"amount,omitempty"`
+	ImageURL string `json:"imageUrl,omitempty"`
+	PagePath string `json:"pagePath,omitempty"`
+}
+
+// userMessageTypes 用户可以发送的消息类型，客服还可以发送卡片类消息；系统和评价消息只由服务端生成
+var userMessageTypes = map[string]bool{
+	models.MessageTypeText: true, models.MessageTypeImage: true, models.MessageTypeFile: true,
+	models.MessageTypeVoice: true, models.MessageTypeVideo: true, models.MessageTypeLocation: true,
+}
+
+var agentMessageTypes = map[string]bool{
+	models.MessageTypeText: true, models.MessageTypeImage: true, models.MessageTypeFile: true,
+	models.MessageTypeVoice: true, models.MessageTypeVideo: true, models.MessageTypeLocation: true,
+	models.MessageTypeLink: true, models.MessageTypeMiniProgram: true, models.MessageTypeProduct: true,
+	models.MessageTypeOrder: true,
+}
+
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// decodePayload 严格解析 Payload，不允许未知字段
+func decodePayload(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return fmt.Errorf("缺少消息内容 payload")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("payload 格式错误: %v", err)
+	}
+	return nil
+}
+
+// validatePayload 按消息类型校验 Payload，返回规范化后的 Payload
+func validatePayload(msgType string, raw json.RawMessage) (interface{}, error) {
+	switch msgType {
+	case models.MessageTypeImage:
+		var p imagePayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if !isHTTPURL(p.URL) || (p.DisplayURL != "" && !isHTTPURL(p.DisplayURL)) || (p.ThumbURL != "" && !isHTTPURL(p.ThumbURL)) {
+			return nil, fmt.Errorf("图片地址无效")
+		}
+		if p.Width < 0 || p.Height < 0 || len(p.Blurhash) > 100 {
+			return nil, fmt.Errorf("图片信息无效")
+		}
+		return p, nil
+	case models.MessageTypeFile:
+		var p filePayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if !isHTTPURL(p.URL) || strings.TrimSpace(p.Name) == "" || p.Size < 0 {
+			return nil, fmt.Errorf("文件消息需要有效的地址和文件名")
+		}
+		return p, nil
+	case models.MessageTypeVoice:
+		var p voicePayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if !isHTTPURL(p.URL) || p.Duration <= 0 || p.Duration > 600 {
+			return nil, fmt.Errorf("语音消息需要有效的地址和时长（1~600 秒）")
+		}
+		return p, nil
+	case models.MessageTypeVideo:
+		var p videoPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if !isHTTPURL(p.URL) || p.Duration < 0 || (p.CoverURL != "" && !isHTTPURL(p.CoverURL)) {
+			return nil, fmt.Errorf("视频地址无效")
+		}
+		return p, nil
+	case models.MessageTypeLocation:
+		var p locationPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+			return nil, fmt.Errorf("经纬度无效")
+		}
+		return p, nil
+	case models.MessageTypeLink:
+		var p linkPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if !isHTTPURL(p.URL) || strings.TrimSpace(p.Title) == "" {
+			return nil, fmt.Errorf("链接卡片需要有效的地址和标题")
+		}
+		return p, nil
+	case models.MessageTypeMiniProgram:
+		var p pageCardPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(p.Title) == "" || p.PagePath == "" {
+			return nil, fmt.Errorf("小程序卡片需要标题和页面路径")
+		}
+		return p, nil
+	case models.MessageTypeProduct:
+		var p productPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if p.ProductID == "" || strings.TrimSpace(p.Title) == "" {
+			return nil, fmt.Errorf("商品卡片需要商品ID和标题")
+		}
+		return p, nil
+	case models.MessageTypeOrder:
+		var p orderPayload
+		if err := decodePayload(raw, &p); err != nil {
+			return nil, err
+		}
+		if p.OrderID == "" {
+			return nil, fmt.Errorf("订单卡片需要订单号")
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("不支持的消息类型: %s", msgType)
+}
+
+// prepareMessage 校验发送的消息并填充兼容字段：
+// 未指定类型时按 imageUrl 判断为图片或文本；图片消息同时设置 IsImage/ImageURL，旧版客户端仍可显示；
+// 非文本消息未填写 Content 时使用摘要，便于旧版客户端显示和搜索
+func prepareMessage(msg *models.Message, fromUser bool) error {
+	if msg.Type == "" {
+		msg.Type = models.MessageTypeText
+		if msg.ImageURL != "" {
+			msg.Type = models.MessageTypeImage
+		}
+	}
+	allowed := agentMessageTypes
+	if fromUser {
+		allowed = userMessageTypes
+	}
+	if !allowed[msg.Type] {
+		return fmt.Errorf("不支持的消息类型: %s", msg.Type)
+	}
+
+	if msg.Type == models.MessageTypeText {
+		if strings.TrimSpace(msg.Content) == "" {
+			return fmt.Errorf("消息内容不能为空")
+		}
+		if utf8.RuneCountInString(msg.Content) > 5000 {
+			return fmt.Errorf("消息内容不能超过 5000 字")
+		}
+		msg.Payload = nil
+		msg.IsImage, msg.ImageURL = false, ""
+		return nil
+	}
+
+	if msg.Type == models.MessageTypeImage && len(msg.Payload) == 0 && msg.ImageURL != "" {
+		msg.Payload, _ = json.Marshal(imagePayload{URL: msg.ImageURL})
+	}
+	p, err := validatePayload(msg.Type, msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload, _ = json.Marshal(p)
+	msg.IsImage, msg.ImageURL = false, ""
+	if img, ok := p.(imagePayload); ok {
+		msg.IsImage, msg.ImageURL = true, img.URL
+	}
+	if strings.TrimSpace(msg.Content) == "" {
+		msg.Content = messageSummary(*msg)
+	}
+	return nil
+}
+
+// messageSummary 消息摘要，用于订阅推送、会话列表预览等只能显示文字的场景
+func messageSummary(msg models.Message) string {
+	if msg.RecalledAt != nil {
+		return "[" + recalledText + "]"
+	}
+	switch msg.Type {
+	case models.MessageTypeImage:
+		return "[图片]"
+	case models.MessageTypeFile:
+		var p filePayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[文件] " + p.Name)
+	case models.MessageTypeVoice:
+		var p voicePayload
+		json.Unmarshal(msg.Payload, &p)
+		return fmt.Sprintf("[语音] %d″", p.Duration)
+	case models.MessageTypeVideo:
+		return "[视频]"
+	case models.MessageTypeLocation:
+		var p locationPayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[位置] " + p.Name)
+	case models.MessageTypeLink:
+		var p linkPayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[链接] " + p.Title)
+	case models.MessageTypeMiniProgram:
+		var p pageCardPayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[小程序] " + p.Title)
+	case models.MessageTypeProduct:
+		var p productPayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[商品] " + p.Title)
+	case models.MessageTypeOrder:
+		var p orderPayload
+		json.Unmarshal(msg.Payload, &p)
+		return strings.TrimSpace("[订单] " + p.OrderID)
+	case models.MessageTypeRating:
+		return "[服务评价]"
+	}
+	if msg.IsImage {
+		return "[图片]"
+	}
+	return msg.Content
+}
+
+// truncateRunes 按字符截断，超出时添加省略号
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "..."
+}
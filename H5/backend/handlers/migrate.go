@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+// RunMigrations 执行 AutoMigrate 无法完成的数据迁移，在 AutoMigrate 之后、启动服务之前调用。
+// 每个迁移完成后在 configs 表中记录，只执行一次
+func RunMigrations(db *gorm.DB) {
+	runMigration(db, "migration_user_identity", migrateUserIdentity)
+	runMigration(db, "migration_message_type", migrateMessageType)
+	runMigration(db, "migration_message_fulltext", migrateMessageFullText)
+}
+
+func runMigration(db *gorm.DB, key string, fn func(tx *gorm.DB) error) {
+	var cfg models.Config
+	if err := db.Where("`key` = ?", key).First(&cfg).Error; err == nil && cfg.Value == "done" {
+		return
+	}
+	log.Printf("[迁移] 开始执行 %s", key)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		cfg.Key = key
+		cfg.Value = "done"
+		return tx.Save(&cfg).Error
+	})
+	if err != nil {
+		log.Printf("[迁移] %s 执行失败，下次启动时重试: %v", key, err)
+		return
+	}
+	log.Printf("[迁移] %s 执行完成", key)
+}
+
+// messageMiniApp 消息实际所属的小程序：有会话的按会话，旧消息按接待客服的分配关系
+// （旧版本一个客服只分配一个小程序，分配了多个小程序的客服无法判断，不处理）
+const messageMiniApp = `COALESCE(NULLIF(c.mini_app_id, 0), a.mini_app_id, 0)`
+
+// messageMiniAppJoins 计算 messageMiniApp 需要关联的表，messages 的别名为 m
+const messageMiniAppJoins = `LEFT JOIN conversations c ON c.id = m.conversation_id
+		LEFT JOIN (SELECT customer_service_id, MIN(mini_app_id) AS mini_app_id FROM assignments
+			WHERE deleted_at IS NULL GROUP BY customer_service_id HAVING COUNT(*) = 1) a
+			ON a.customer_service_id = m.customer_service_id`
+
+// migrateUserIdentity 用户由全局唯一的 OpenID 改为按 (小程序, OpenID) 唯一：
+// 删除 open_id 上的旧唯一索引，并把旧版登录覆盖了小程序的用户按消息实际所属的小程序拆分为多个用户
+func migrateUserIdentity(tx *gorm.DB) error {
+	// 旧索引只包含 open_id 一列（init_db.sql 建表时为 open_id，gorm 建表时为 open_id 或 uni_users_open_id）
+	type indexRow struct {
+		KeyName    string `gorm:"column:Key_name"`
+		ColumnName string `gorm:"column:Column_name"`
+		NonUnique  int    `gorm:"column:Non_unique"`
+	}
+	var rows []indexRow
+	if err := tx.Raw("SHOW INDEX FROM users").Scan(&rows).Error; err != nil {
+		return err
+	}
+	columns := make(map[string][]string)
+	for _, r := range rows {
+		if r.NonUnique == 0 {
+			columns[r.KeyName] = append(columns[r.KeyName], r.ColumnName)
+		}
+	}
+	for name, cols := range columns {
+		if len(cols) == 1 && cols[0] == "open_id" {
+			log.Printf("[迁移] 删除 users 表的旧唯一索引 %s", name)
+			if err := tx.Exec("ALTER TABLE users DROP INDEX `" + name + "`").Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	// 找出消息属于其他小程序的用户：旧版登录按 OpenID 查找用户并覆盖 mini_app_id，
+	// 同一个微信用户在多个小程序中的消息都挂在同一条用户记录上
+	type collision struct {
+		UserID    uint
+		MiniAppID uint
+	}
+	var collisions []collision
+	err := tx.Raw(`SELECT DISTINCT m.user_id, ` + messageMiniApp + ` AS mini_app_id FROM messages m
+		JOIN users u ON u.id = m.user_id
+		` + messageMiniAppJoins + `
+		WHERE ` + messageMiniApp + ` NOT IN (0, u.mini_app_id)`).Scan(&collisions).Error
+	if err != nil {
+		return err
+	}
+	for _, col := range collisions {
+		if err := splitUser(tx, col.UserID, col.MiniAppID); err != nil {
+			return err
+		}
+	}
+	if len(collisions) > 0 {
+		log.Printf("[迁移] 已拆分 %d 组跨小程序的用户记录", len(collisions))
+	}
+	return nil
+}
+
+// splitUser 把用户在 miniAppID 下的消息、会话、备注和评价移到该小程序对应的用户（不存在时创建）
+func splitUser(tx *gorm.DB, userID, miniAppID uint) error {
+	var user models.User
+	if err := tx.First(&user, userID).Error; err != nil {
+		return err
+	}
+	var target models.User
+	err := tx.Where("mini_app_id = ? AND open_id = ?", miniAppID, user.OpenID).First(&target).Error
+	if err != nil {
+		// 订阅授权按小程序模板生效，拆分出的用户需要重新授权
+		target = models.User{
+			OpenID:         user.OpenID,
+			MiniAppID:      miniAppID,
+			UnionID:        user.UnionID,
+			LastActiveTime: user.LastActiveTime,
+		}
+		if err := tx.Create(&target).Error; err != nil {
+			return err
+		}
+	}
+
+	// 先按会话移动备注，再移动消息和会话
+	convIDs := tx.Model(&models.Conversation{}).Select("id").Where("user_id = ? AND mini_app_id = ?", userID, miniAppID)
+	if err := tx.Model(&models.InternalNote{}).Where("user_id = ? AND conversation_id IN (?)", userID, convIDs).Update("user_id", target.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec(`UPDATE messages m `+messageMiniAppJoins+`
+		SET m.user_id = ? WHERE m.user_id = ? AND `+messageMiniApp+` = ?`, target.ID, userID, miniAppID).Error; err != nil {
+		return err
+	}
+	movedMessages := tx.Model(&models.Message{}).Select("id").Where("user_id = ?", target.ID)
+	if err := tx.Model(&models.MessageRevision{}).Where("user_id = ? AND message_id IN (?)", userID, movedMessages).Update("user_id", target.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.MessageAttachment{}).Where("user_id = ? AND message_id IN (?)", userID, movedMessages).Update("user_id", target.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Rating{}).Where("user_id = ? AND mini_app_id = ?", userID, miniAppID).Update("user_id", target.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Conversation{}).Where("user_id = ? AND mini_app_id = ?", userID, miniAppID).Update("user_id", target.ID).Error; err != nil {
+		return err
+	}
+	// 标签不区分小程序，无法判断是在哪个小程序下打的，拆分出的用户保留同样的标签
+	if err := tx.Exec(`INSERT IGNORE INTO user_tags (created_at, updated_at, user_id, tag_id)
+		SELECT NOW(), NOW(), ?, tag_id FROM user_tags WHERE user_id = ? AND deleted_at IS NULL`, target.ID, userID).Error; err != nil {
+		return err
+	}
+	log.Printf("[迁移] 用户 %d 在小程序 %d 下的消息和会话已移至用户 %d", userID, miniAppID, target.ID)
+	return nil
+}
+
+// migrateMessageType 为增加类型字段前的历史消息补充类型：新增列默认值为 text，
+// 图片消息改为 image 并补充图片 Payload，系统消息改为 system
+func migrateMessageType(tx *gorm.DB) error {
+	if err := tx.Exec("UPDATE messages SET type = ? WHERE (type IS NULL OR type = '' OR type = ?) AND is_image = ? AND image_url <> ''",
+		models.MessageTypeImage, models.MessageTypeText, true).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("UPDATE messages SET payload = JSON_OBJECT('url', image_url) WHERE type = ? AND payload IS NULL",
+		models.MessageTypeImage).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("UPDATE messages SET type = ? WHERE (type IS NULL OR type = '' OR type = ?) AND is_system = ?",
+		models.MessageTypeSystem, models.MessageTypeText, true).Error; err != nil {
+		return err
+	}
+	return tx.Exec("UPDATE messages SET type = ? WHERE type IS NULL OR type = ''", models.MessageTypeText).Error
+}
+
+// migrateMessageFullText 为消息内容建立全文索引，使用 ngram 分词以支持中文（需要 MySQL 5.7.6+）
+func migrateMessageFullText(tx *gorm.DB) error {
+	var count int64
+	if err := tx.Raw("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'messages' AND index_name = 'ft_messages_content'").Scan(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return tx.Exec("ALTER TABLE messages ADD FULLTEXT INDEX ft_messages_content (content) WITH PARSER ngram").Error
+}
+
+// legacyUploadMinAge 最近写入的文件可能是其他实例正在保存的新上传（文件先于记录写入），迁移旧文件时跳过
+const legacyUploadMinAge = time.Hour
+
+// legacyUploads 本地存储中没有附件记录的文件，不含分片临时文件和最近写入的文件
+func legacyUploads(tx *gorm.DB, local *storage.Local) ([]string, error) {
+	var list []models.Attachment
+	if err := tx.Select("`key`", "display_key", "thumb_key").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool)
+	for _, a := range list {
+		tracked[a.Key], tracked[a.DisplayKey], tracked[a.ThumbKey] = true, true, true
+	}
+	cutoff := time.Now().Add(-legacyUploadMinAge)
+	var keys []string
+	err := local.Walk(func(key string, info storage.ObjectInfo) error {
+		if !tracked[key] && !strings.HasPrefix(key, "tmp/") && info.LastModified.Before(cutoff) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// readLegacyUpload 读取文件内容和 SHA-256
+func readLegacyUpload(local *storage.Local, key string) ([]byte, string, error) {
+	rc, _, err := local.Get(context.Background(), key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:]), nil
+}
+
+// legacyURLPattern 匹配旧文件地址的 LIKE 条件。旧地址的域名可能与当前 PUBLIC_BASE_URL 不同，按 /uploads/{key} 后缀匹配
+func legacyURLPattern(key string) string {
+	return "%/uploads/" + key
+}
+
+// migrateLegacyUploads 为增加附件记录之前上传的文件补充记录，并关联图片地址指向该文件的消息，
+// 没有被引用的文件超过保留期后由清理任务删除。内容相同的文件只保留一份记录，引用改为该记录的地址，
+// 多余的文件由 migrateLegacyUploadDuplicates 删除。头像和自动回复图片的地址统一为当前访问地址，清理任务按地址判断是否使用。
+// 只处理本地存储：使用 S3 时 /uploads 下的旧文件不在存储后端中，不由清理任务管理
+func migrateLegacyUploads(tx *gorm.DB) error {
+	local, ok := store.(*storage.Local)
+	if !ok {
+		return nil
+	}
+	keys, err := legacyUploads(tx, local)
+	if err != nil {
+		return err
+	}
+	created, merged := 0, 0
+	for _, key := range keys {
+		data, hash, err := readLegacyUpload(local, key)
+		if err != nil {
+			return err
+		}
+		mimeType := mimetype.Detect(data).String()
+		if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+			mimeType = mimeType[:i]
+		}
+		kind := UploadFile
+		if strings.HasPrefix(mimeType, "image/") {
+			kind = UploadImage
+		}
+
+		var a models.Attachment
+		if err := tx.Where("hash = ? AND kind = ?", hash, kind).First(&a).Error; err == nil {
+			merged++
+		} else {
+			now := time.Now()
+			a = models.Attachment{Hash: hash, Kind: kind, Key: key, MimeType: mimeType, Size: int64(len(data)), Name: path.Base(key), LastUsedAt: &now}
+			if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+				a.Width, a.Height = cfg.Width, cfg.Height
+			}
+			if err := tx.Create(&a).Error; err != nil {
+				return err
+			}
+			created++
+		}
+		if err := linkLegacyUpload(tx, key, a); err != nil {
+			return err
+		}
+	}
+	log.Printf("[迁移] 旧文件已补充 %d 个附件记录，%d 个内容重复的文件已合并", created, merged)
+	return nil
+}
+
+// linkLegacyUpload 把引用旧文件 key 的消息、头像和自动回复图片指向附件 a 的地址，并记录消息引用
+func linkLegacyUpload(tx *gorm.DB, key string, a models.Attachment) error {
+	url := store.URL(a.Key)
+	var msgs []models.Message
+	if err := tx.Select("id", "user_id", "image_url", "payload").Where("image_url LIKE ?", legacyURLPattern(key)).Find(&msgs).Error; err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if !strings.HasSuffix(msg.ImageURL, "/uploads/"+key) {
+			continue
+		}
+		if msg.ImageURL != url {
+			updates := map[string]interface{}{"image_url": url}
+			if len(msg.Payload) > 0 {
+				updates["payload"] = json.RawMessage(bytes.ReplaceAll(msg.Payload, []byte(msg.ImageURL), []byte(url)))
+			}
+			if err := tx.Model(&models.Message{}).Where("id = ?", msg.ID).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+		}
+		var n int64
+		tx.Model(&models.MessageAttachment{}).Where("message_id = ? AND attachment_id = ?", msg.ID, a.ID).Count(&n)
+		if n == 0 {
+			if err := tx.Create(&models.MessageAttachment{MessageID: msg.ID, AttachmentID: a.ID, UserID: msg.UserID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Model(&models.User{}).Where("avatar_url LIKE ?", legacyURLPattern(key)).UpdateColumn("avatar_url", url).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.AutoReplyRule{}).Where("reply_image_url LIKE ?", legacyURLPattern(key)).UpdateColumn("reply_image_url", url).Error
+}
+
+// migrateLegacyUploadDuplicates 删除 migrateLegacyUploads 合并的重复文件：没有附件记录、内容与已有记录相同的文件。
+// 在合并引用的迁移提交后执行，删除失败时下次启动重试
+func migrateLegacyUploadDuplicates(tx *gorm.DB) error {
+	local, ok := store.(*storage.Local)
+	if !ok {
+		return nil
+	}
+	keys, err := legacyUploads(tx, local)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, hash, err := readLegacyUpload(local, key)
+		if err != nil {
+			return err
+		}
+		var n int64
+		tx.Model(&models.Attachment{}).Where("hash = ?", hash).Count(&n)
+		if n == 0 {
+			continue
+		}
+		if err := local.Delete(context.Background(), key); err != nil {
+			return err
+		}
+		log.Printf("[迁移] 已删除重复的旧文件 %s", key)
+	}
+	return nil
+}
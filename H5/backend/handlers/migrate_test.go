@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+func TestMigrateLegacyUploads(t *testing.T) {
+	db := newTestDB(t, &models.Attachment{}, &models.MessageAttachment{}, &models.Message{}, &models.User{}, &models.AutoReplyRule{})
+	dir := t.TempDir()
+	local, err := storage.NewLocal(dir, "http://new.host", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := store
+	store = local
+	t.Cleanup(func() { store = prev })
+
+	img := pngFixture(t, 4, 4)
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(key string, data []byte, mod time.Time) {
+		p := filepath.Join(dir, filepath.FromSlash(key))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mod, mod)
+	}
+	write("a.png", img, old)
+	write("b.png", img, old) // 与 a.png 内容相同
+	write("orphan.txt", []byte("orphan"), old)
+	write("recent.txt", []byte("recent"), time.Now())
+	write("tmp/u1/0-part", []byte("part"), old)
+	write("2026/10/tracked.txt", []byte("tracked"), old)
+	db.Create(&models.Attachment{Hash: "h", Kind: UploadFile, Key: "2026/10/tracked.txt"})
+
+	// 旧地址的域名与当前配置不同
+	db.Create(&models.Message{ID: 1, UserID: 1, IsImage: true, ImageURL: "https://old.host/uploads/a.png", Payload: []byte(`{"url":"https://old.host/uploads/a.png"}`)})
+	db.Create(&models.Message{ID: 2, UserID: 2, IsImage: true, ImageURL: "https://old.host/uploads/b.png"})
+	db.Create(&models.Message{ID: 3, UserID: 2, IsImage: true, ImageURL: "https://old.host/uploads/xb.png"})
+	db.Create(&models.User{MiniAppID: 1, OpenID: "o1", AvatarURL: "https://old.host/uploads/b.png"})
+
+	if err := migrateLegacyUploads(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLegacyUploadDuplicates(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []models.Attachment
+	db.Order("id").Find(&list)
+	keys := map[string]models.Attachment{}
+	for _, a := range list {
+		keys[a.Key] = a
+	}
+	if len(list) != 3 || keys["a.png"].Kind != UploadImage || keys["orphan.txt"].Kind != UploadFile {
+		t.Fatalf("附件记录 %+v", list)
+	}
+	if a := keys["a.png"]; a.Width != 4 || a.MimeType != "image/png" || a.Size != int64(len(img)) || a.LastUsedAt == nil {
+		t.Errorf("a.png 记录 %+v", a)
+	}
+
+	url := local.URL("a.png")
+	var msgs []models.Message
+	db.Order("id").Find(&msgs)
+	if msgs[0].ImageURL != url || string(msgs[0].Payload) != `{"url":"`+url+`"}` || msgs[1].ImageURL != url {
+		t.Errorf("消息地址未改为当前地址: %q %s %q", msgs[0].ImageURL, msgs[0].Payload, msgs[1].ImageURL)
+	}
+	if msgs[2].ImageURL != "https://old.host/uploads/xb.png" {
+		t.Errorf("不应修改其他文件的地址: %q", msgs[2].ImageURL)
+	}
+	var refs []models.MessageAttachment
+	db.Order("message_id").Find(&refs)
+	if len(refs) != 2 || refs[0].AttachmentID != keys["a.png"].ID || refs[1].AttachmentID != keys["a.png"].ID || refs[1].UserID != 2 {
+		t.Errorf("消息引用 %+v", refs)
+	}
+	var user models.User
+	db.First(&user)
+	if user.AvatarURL != url {
+		t.Errorf("头像地址 %q，want %q", user.AvatarURL, url)
+	}
+
+	for key, want := range map[string]bool{"a.png": true, "b.png": false, "orphan.txt": true, "recent.txt": true, "tmp/u1/0-part": true} {
+		if _, err := local.Stat(t.Context(), key); (err == nil) != want {
+			t.Errorf("%s 存在 = %v，want %v", key, err == nil, want)
+		}
+	}
+
+	// 再次执行不重复创建记录
+	if err := migrateLegacyUploads(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(&models.Attachment{}).Count(&count)
+	if count != 3 {
+		t.Errorf("再次执行后附件记录 %d，want 3", count)
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// loadAgentUser 读取用户并检查用户所在小程序是否由该客服负责
+func loadAgentUser(c *gin.Context, db *gorm.DB, csID uint) (models.User, bool) {
+	var user models.User
+	if err := db.First(&user, parseUint(c.Param("userId"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return user, false
+	}
+	var assignment models.Assignment
+	if err := db.Where("mini_app_id = ? AND customer_service_id = ?", user.MiniAppID, csID).First(&assignment).Error; err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "该用户不属于您负责的小程序"})
+		return user, false
+	}
+	return user, true
+}
+
+// noteView 内部备注及作者名称
+type noteView struct {
+	models.InternalNote
+	AuthorName string `json:"AuthorName"`
+}
+
+// getUserNotes 获取用户的内部备注（含该用户各会话上的备注），最新的在前
+func getUserNotes(c *gin.Context, db *gorm.DB) {
+	user, ok := loadAgentUser(c, db, parseUint(c.Param("csId")))
+	if !ok {
+		return
+	}
+	query := db.Where("user_id = ?", user.ID)
+	if id := parseUint(c.Query("conversationId")); id != 0 {
+		query = query.Where("conversation_id = ?", id)
+	}
+	var notes []models.InternalNote
+	query.Order("id DESC").Find(&notes)
+
+	var authors []models.CustomerService
+	var authorIDs []uint
+	for _, n := range notes {
+		authorIDs = append(authorIDs, n.CustomerServiceID)
+	}
+	names := make(map[uint]string)
+	if len(authorIDs) > 0 {
+		db.Where("id IN ?", authorIDs).Find(&authors)
+		for _, a := range authors {
+			names[a.ID] = a.Name
+		}
+	}
+	views := make([]noteView, 0, len(notes))
+	for _, n := range notes {
+		views = append(views, noteView{InternalNote: n, AuthorName: names[n.CustomerServiceID]})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// addUserNote 客服添加内部备注，可关联到用户的某个会话
+func addUserNote(c *gin.Context, db *gorm.DB) {
+	csID := parseUint(c.Param("csId"))
+	user, ok := loadAgentUser(c, db, csID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Content        string `json:"Content"`
+		ConversationID uint   `json:"ConversationID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "备注内容不能为空"})
+		return
+	}
+	if req.ConversationID != 0 {
+		var conv models.Conversation
+		if err := db.Where("id = ? AND user_id = ?", req.ConversationID, user.ID).First(&conv).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "会话不存在"})
+			return
+		}
+	}
+	note := models.InternalNote{
+		UserID:            user.ID,
+		ConversationID:    req.ConversationID,
+		CustomerServiceID: csID,
+		Content:           req.Content,
+	}
+	if err := db.Create(&note).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, note)
+}
+
+// deleteNote 删除内部备注，只能删除自己写的备注
+func deleteNote(c *gin.Context, db *gorm.DB) {
+	res := db.Unscoped().Where("id = ? AND customer_service_id = ?", parseUint(c.Param("id")), parseUint(c.Param("csId"))).Delete(&models.InternalNote{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "备注不存在或不是您添加的"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
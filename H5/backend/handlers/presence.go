@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// presenceService 在内存中记录用户和客服的最后活动时间，定期批量写回数据库，
+// 代替每次心跳都 db.Save 整行用户数据。在线判断统一使用同一个阈值。
+type presenceService struct {
+	db        *gorm.DB
+	threshold time.Duration
+
+	mu         sync.Mutex
+	users      map[uint]*userPresence
+	agents     map[uint]time.Time
+	dirtyUsers map[uint]time.Time // 待写回 users.last_active_time
+	dirtyCS    map[uint]time.Time // 待写回 customer_services.last_active_time
+}
+
+type userPresence struct {
+	miniAppID uint
+	lastSeen  time.Time
+	online    bool
+}
+
+// presenceEvent 推送给客服的用户在线状态变化
+type presenceEvent struct {
+	UserID         uint      `json:"userId"`
+	Online         bool      `json:"online"`
+	LastActiveTime time.Time `json:"lastActiveTime"`
+}
+
+var presence = newPresenceService()
+
+func newPresenceService() *presenceService {
+	return &presenceService{
+		threshold:  envDuration("PRESENCE_ONLINE_THRESHOLD", time.Minute),
+		users:      make(map[uint]*userPresence),
+		agents:     make(map[uint]time.Time),
+		dirtyUsers: make(map[uint]time.Time),
+		dirtyCS:    make(map[uint]time.Time),
+	}
+}
+
+// start 启动批量写回和离线检测
+func (p *presenceService) start(db *gorm.DB) {
+	p.db = db
+	go p.loop(envDuration("PRESENCE_FLUSH_INTERVAL", 10*time.Second), p.flush)
+	go p.loop(5*time.Second, p.sweep)
+}
+
+func (p *presenceService) loop(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fn()
+	}
+}
+
+// TouchUser 记录用户活动，用户由离线变为在线时通知该小程序的客服
+func (p *presenceService) TouchUser(user models.User) {
+	now := time.Now()
+	p.mu.Lock()
+	up, ok := p.users[user.ID]
+	if !ok {
+		up = &userPresence{}
+		p.users[user.ID] = up
+	}
+	wasOnline := up.online
+	up.miniAppID = user.MiniAppID
+	up.lastSeen = now
+	up.online = true
+	p.dirtyUsers[user.ID] = now
+	p.mu.Unlock()
+
+	if !wasOnline {
+		p.publishUser(user.ID, user.MiniAppID, true, now)
+	}
+}
+
+// IsUserOnline 判断用户是否在线
+// 优先使用内存记录，多实例部署时心跳可能落在其他实例，再参考数据库中已写回的时间
+func (p *presenceService) IsUserOnline(user models.User) bool {
+	lastSeen := time.Time{}
+	if user.LastActiveTime != nil {
+		lastSeen = *user.LastActiveTime
+	}
+	p.mu.Lock()
+	if up, ok := p.users[user.ID]; ok && up.lastSeen.After(lastSeen) {
+		lastSeen = up.lastSeen
+	}
+	p.mu.Unlock()
+	return !lastSeen.IsZero() && time.Since(lastSeen) < p.threshold
+}
+
+// TouchAgent 记录客服活动（WebSocket 连接或发送消息）
+func (p *presenceService) TouchAgent(csID uint) {
+	now := time.Now()
+	p.mu.Lock()
+	p.agents[csID] = now
+	p.dirtyCS[csID] = now
+	p.mu.Unlock()
+}
+
+// RemoveAgent 客服断开连接
+func (p *presenceService) RemoveAgent(csID uint) {
+	p.mu.Lock()
+	delete(p.agents, csID)
+	p.mu.Unlock()
+}
+
+// idleAgents 返回在本实例连接、且超过 idle 未活动的客服
+func (p *presenceService) idleAgents(idle time.Duration) []uint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []uint
+	for id, t := range p.agents {
+		if time.Since(t) >= idle {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// flush 批量写回最后活动时间，只更新单列，不触碰其他字段
+func (p *presenceService) flush() {
+	p.mu.Lock()
+	users, agents := p.dirtyUsers, p.dirtyCS
+	p.dirtyUsers = make(map[uint]time.Time)
+	p.dirtyCS = make(map[uint]time.Time)
+	p.mu.Unlock()
+
+	if len(users) == 0 && len(agents) == 0 {
+		return
+	}
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		for id, t := range users {
+			if err := tx.Model(&models.User{}).Where("id = ?", id).UpdateColumn("last_active_time", t).Error; err != nil {
+				return err
+			}
+		}
+		for id, t := range agents {
+			if err := tx.Model(&models.CustomerService{}).Where("id = ?", id).UpdateColumn("last_active_time", t).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[在线状态] 写回最后活动时间失败: %v", err)
+	}
+}
+
+// sweep 检测超过阈值未活动的用户，标记为离线并通知客服；长时间不活动的记录从内存移除
+func (p *presenceService) sweep() {
+	now := time.Now()
+	type change struct {
+		userID, miniAppID uint
+		lastSeen          time.Time
+	}
+	var offline []change
+
+	p.mu.Lock()
+	for id, up := range p.users {
+		idle := now.Sub(up.lastSeen)
+		if up.online && idle >= p.threshold {
+			up.online = false
+			offline = append(offline, change{id, up.miniAppID, up.lastSeen})
+		}
+		if !up.online && idle >= 10*p.threshold {
+			delete(p.users, id)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, ch := range offline {
+		p.publishUser(ch.userID, ch.miniAppID, false, ch.lastSeen)
+	}
+}
+
+// publishUser 向负责该小程序的客服推送用户在线状态变化
+func (p *presenceService) publishUser(userID, miniAppID uint, online bool, lastSeen time.Time) {
+	if p.db == nil {
+		return
+	}
+	var assignments []models.Assignment
+	p.db.Where("mini_app_id = ?", miniAppID).Find(&assignments)
+	event := wsEvent{Type: "presence", Data: presenceEvent{UserID: userID, Online: online, LastActiveTime: lastSeen}}
+	for _, a := range assignments {
+		notifyCS(a.CustomerServiceID, event)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// findMiniAppUser 按小程序 AppID 和 OpenID 查找用户
+func findMiniAppUser(db *gorm.DB, appID, openID string) (models.MiniApp, models.User, error) {
+	var ma models.MiniApp
+	var user models.User
+	if err := db.Where("app_id = ?", appID).First(&ma).Error; err != nil {
+		return ma, user, fmt.Errorf("未找到该小程序")
+	}
+	if err := db.Where("mini_app_id = ? AND open_id = ?", ma.ID, openID).First(&user).Error; err != nil {
+		return ma, user, fmt.Errorf("用户不存在")
+	}
+	return ma, user, nil
+}
+
+// linkedIdentities 同一个人（UnionID 相同）在其他小程序中的用户
+func linkedIdentities(db *gorm.DB, user models.User) []models.User {
+	linked := []models.User{}
+	if user.UnionID == "" {
+		return linked
+	}
+	db.Where("union_id = ? AND id <> ?", user.UnionID, user.ID).Order("id ASC").Find(&linked)
+	return linked
+}
+
+// mergeAttributes 合并自定义属性，值为 null 的属性会被删除
+func mergeAttributes(current json.RawMessage, updates map[string]interface{}) (json.RawMessage, error) {
+	attrs := map[string]interface{}{}
+	if len(current) > 0 {
+		json.Unmarshal(current, &attrs)
+	}
+	for k, v := range updates {
+		if v == nil {
+			delete(attrs, k)
+		} else {
+			attrs[k] = v
+		}
+	}
+	if len(attrs) > 50 {
+		return nil, fmt.Errorf("自定义属性不能超过 50 个")
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 8*1024 {
+		return nil, fmt.Errorf("自定义属性过大")
+	}
+	return data, nil
+}
+
+// updateUserProfile 小程序上报用户资料：昵称、头像、进入场景和来源、自定义属性
+// 只更新请求中提供的字段；场景和来源只在首次上报时记录
+func updateUserProfile(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		AppID      string                 `json:"appId"`
+		OpenID     string                 `json:"openId"`
+		Nickname   *string                `json:"nickname"`
+		AvatarURL  *string                `json:"avatarUrl"`
+		Scene      int                    `json:"scene"`
+		Source     string                 `json:"source"`
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.AppID == "" || req.OpenID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	_, user, err := findMiniAppUser(db, req.AppID, req.OpenID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Nickname != nil {
+		if utf8.RuneCountInString(*req.Nickname) > 50 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "昵称不能超过 50 个字"})
+			return
+		}
+		updates["nickname"] = *req.Nickname
+	}
+	if req.AvatarURL != nil {
+		updates["avatar_url"] = *req.AvatarURL
+	}
+	if user.Scene == 0 && req.Scene != 0 {
+		updates["scene"] = req.Scene
+	}
+	if user.Source == "" && req.Source != "" {
+		updates["source"] = req.Source
+	}
+	if len(req.Attributes) > 0 {
+		attrs, err := mergeAttributes(user.Attributes, req.Attributes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["attributes"] = attrs
+	}
+	if len(updates) > 0 {
+		if err := db.Model(&user).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// bindUserPhone 用小程序 getPhoneNumber 返回的 code 换取并绑定用户手机号
+func bindUserPhone(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		AppID  string `json:"appId"`
+		OpenID string `json:"openId"`
+		Code   string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.AppID == "" || req.OpenID == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	ma, user, err := findMiniAppUser(db, req.AppID, req.OpenID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	info, err := exchangePhoneCode(ma, req.Code)
+	if err != nil {
+		log.Printf("[用户资料] 获取手机号失败，userID=%d, error=%v", user.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "获取手机号失败: " + err.Error()})
+		return
+	}
+	phone := info.PurePhoneNumber
+	if phone == "" {
+		phone = info.PhoneNumber
+	}
+	if err := db.Model(&user).Updates(map[string]interface{}{"phone": phone, "phone_country_code": info.CountryCode}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存手机号失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// getUserProfile 客服端查看用户资料：基本信息、标签、在线状态和会话概况
+func getUserProfile(c *gin.Context, db *gorm.DB) {
+	user, ok := loadAgentUser(c, db, parseUint(c.Param("csId")))
+	if !ok {
+		return
+	}
+	var ma models.MiniApp
+	db.First(&ma, user.MiniAppID)
+
+	var conversationCount, noteCount int64
+	db.Model(&models.Conversation{}).Where("user_id = ?", user.ID).Count(&conversationCount)
+	db.Model(&models.InternalNote{}).Where("user_id = ?", user.ID).Count(&noteCount)
+	var lastConv *models.Conversation
+	if conv, ok := latestConversation(db, user.ID); ok {
+		lastConv = &conv
+	}
+
+	// 同一个人在其他小程序中的身份（通过 UnionID 关联）
+	type identity struct {
+		UserID      uint   `json:"userId"`
+		MiniAppID   uint   `json:"miniAppId"`
+		MiniAppName string `json:"miniAppName"`
+		Nickname    string `json:"nickname"`
+	}
+	identities := []identity{}
+	for _, u := range linkedIdentities(db, user) {
+		var other models.MiniApp
+		db.First(&other, u.MiniAppID)
+		identities = append(identities, identity{UserID: u.ID, MiniAppID: u.MiniAppID, MiniAppName: other.Name, Nickname: u.Nickname})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":              user,
+		"displayName":       userDisplayName(user),
+		"miniAppName":       ma.Name,
+		"isOnline":          presence.IsUserOnline(user),
+		"tags":              userTagsOf(db, []uint{user.ID})[user.ID],
+		"conversationCount": conversationCount,
+		"noteCount":         noteCount,
+		"lastConversation":  lastConv,
+		"linkedIdentities":  identities,
+	})
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// dispatchMu 同一实例内串行调度，避免同一会话被重复分配（跨实例由条件更新保证）
+var dispatchMu sync.Mutex
+
+// enqueueConversation 暂无可接待的客服时，会话进入小程序的排队队列
+func enqueueConversation(db *gorm.DB, conv *models.Conversation) (bool, error) {
+	if conv.Status == models.ConversationQueued {
+		return false, nil
+	}
+	now := time.Now()
+	err := db.Model(conv).Updates(map[string]interface{}{
+		"status":              models.ConversationQueued,
+		"queued_at":           now,
+		"customer_service_id": 0,
+	}).Error
+	if err != nil {
+		return false, err
+	}
+	conv.Status = models.ConversationQueued
+	conv.QueuedAt = &now
+	conv.CustomerServiceID = 0
+	return true, nil
+}
+
+// queuePosition 会话在小程序队列中的位置（从 1 开始），不在排队时返回 0
+func queuePosition(db *gorm.DB, conv models.Conversation) int64 {
+	if conv.Status != models.ConversationQueued || conv.QueuedAt == nil {
+		return 0
+	}
+	var ahead int64
+	db.Model(&models.Conversation{}).
+		Where("mini_app_id = ? AND status = ? AND (queued_at < ? OR (queued_at = ? AND id < ?))",
+			conv.MiniAppID, models.ConversationQueued, *conv.QueuedAt, *conv.QueuedAt, conv.ID).
+		Count(&ahead)
+	return ahead + 1
+}
+
+// assignQueuedConversation 将排队中的会话分配给客服，排队期间的消息一并归属该客服
+func assignQueuedConversation(db *gorm.DB, conv *models.Conversation, csID uint) (bool, error) {
+	res := db.Model(&models.Conversation{}).
+		Where("id = ? AND status = ?", conv.ID, models.ConversationQueued).
+		Updates(map[string]interface{}{"status": models.ConversationAssigned, "customer_service_id": csID})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	conv.Status = models.ConversationAssigned
+	conv.CustomerServiceID = csID
+
+	db.Model(&models.Message{}).
+		Where("conversation_id = ? AND customer_service_id = ?", conv.ID, 0).
+		Update("customer_service_id", csID)
+
+	var cs models.CustomerService
+	db.First(&cs, csID)
+	sysMsg := models.Message{
+		UserID:            conv.UserID,
+		CustomerServiceID: csID,
+		ConversationID:    conv.ID,
+		Content:           "客服 " + cs.Name + " 已接入，正在为您服务",
+		IsSystem:          true,
+	}
+	db.Create(&sysMsg)
+
+	notifyConversation(*conv)
+	notifyCS(csID, sysMsg)
+	return true, nil
+}
+
+// dispatchQueue 按排队顺序将小程序队列中的会话分配给可接待的客服，直到队列为空或没有空闲客服
+func dispatchQueue(db *gorm.DB, miniAppID uint) {
+	dispatchMu.Lock()
+	defer dispatchMu.Unlock()
+
+	// 非工作时间保持排队，到工作时间后由定时调度分配
+	if !loadCalendar(db, miniAppID).IsOpen(time.Now()) {
+		return
+	}
+	for {
+		var conv models.Conversation
+		db.Where("mini_app_id = ? AND status = ?", miniAppID, models.ConversationQueued).
+			Order("queued_at ASC, id ASC").Limit(1).Find(&conv)
+		if conv.ID == 0 {
+			return
+		}
+		// 每次分配前重新读取小程序，轮流分配的游标在上一次分配后已更新
+		var ma models.MiniApp
+		if err := db.First(&ma, miniAppID).Error; err != nil {
+			return
+		}
+		csID := routeNewChat(db, ma, conv.UserID, 0)
+		if csID == 0 {
+			return
+		}
+		if _, err := assignQueuedConversation(db, &conv, csID); err != nil {
+			log.Printf("[排队] 分配会话失败，conversationID=%d, error=%v", conv.ID, err)
+			return
+		}
+	}
+}
+
+// dispatchForAgent 客服变为可接待（上线、会话结束、调整接待数等）时，调度其负责的小程序队列
+func dispatchForAgent(db *gorm.DB, csID uint) {
+	if csID == 0 {
+		return
+	}
+	go func() {
+		var assigns []models.Assignment
+		db.Where("customer_service_id = ?", csID).Find(&assigns)
+		for _, a := range assigns {
+			dispatchQueue(db, a.MiniAppID)
+		}
+	}()
+}
+
+// startQueueDispatcher 定期调度所有有排队会话的小程序，兜底处理其他实例上线的客服
+func startQueueDispatcher(db *gorm.DB) {
+	interval := envDuration("QUEUE_DISPATCH_INTERVAL", 10*time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			var miniAppIDs []uint
+			db.Model(&models.Conversation{}).Where("status = ?", models.ConversationQueued).
+				Distinct("mini_app_id").Pluck("mini_app_id", &miniAppIDs)
+			for _, id := range miniAppIDs {
+				dispatchQueue(db, id)
+			}
+		}
+	}()
+}
+
+// getQueueStatus 用户查询自己的排队位置
+func getQueueStatus(c *gin.Context, db *gorm.DB) {
+	openID := c.Query("openId")
+	appID := c.Query("appId")
+	if openID == "" || appID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少必要参数"})
+		return
+	}
+	var user models.User
+	if err := db.Where("open_id = ? AND mini_app_id = (SELECT id FROM mini_apps WHERE app_id = ?)", openID, appID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	conv, ok := latestConversation(db, user.ID)
+	position := int64(0)
+	if ok {
+		position = queuePosition(db, conv)
+	}
+	c.JSON(http.StatusOK, gin.H{"queued": position > 0, "position": position})
+}
+
+// getQueue 主管查看排队中的会话，可按小程序筛选
+func getQueue(c *gin.Context, db *gorm.DB) {
+	query := db.Where("status = ?", models.ConversationQueued)
+	if id := parseUint(c.Query("miniAppId")); id != 0 {
+		query = query.Where("mini_app_id = ?", id)
+	}
+	var convs []models.Conversation
+	query.Order("queued_at ASC, id ASC").Find(&convs)
+
+	type QueueItem struct {
+		models.Conversation
+		Position    int64 `json:"Position"`
+		WaitSeconds int64 `json:"WaitSeconds"` // 已等待时长（秒）
+	}
+	positions := make(map[uint]int64)
+	result := []QueueItem{}
+	for _, conv := range convs {
+		positions[conv.MiniAppID]++
+		wait := int64(0)
+		if conv.QueuedAt != nil {
+			wait = int64(time.Since(*conv.QueuedAt).Seconds())
+		}
+		result = append(result, QueueItem{Conversation: conv, Position: positions[conv.MiniAppID], WaitSeconds: wait})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// pickFromQueue 主管手动将排队中的会话分配给指定客服（不受客服状态和接待数限制）
+func pickFromQueue(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		CustomerServiceID uint `json:"CustomerServiceID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.CustomerServiceID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	var conv models.Conversation
+	if err := db.First(&conv, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+	var assignment models.Assignment
+	if err := db.Where("mini_app_id = ? AND customer_service_id = ?", conv.MiniAppID, req.CustomerServiceID).First(&assignment).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "目标客服不在该小程序的客服团队中"})
+		return
+	}
+
+	ok, err := assignQueuedConversation(db, &conv, req.CustomerServiceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "分配失败: " + err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "会话已不在排队中"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("会话已分配给客服 %d", req.CustomerServiceID), "conversation": conv})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// seedTeam 创建小程序及在线客服团队
+func seedTeam(t *testing.T, strategy string, agents int) (*gorm.DB, models.MiniApp) {
+	t.Helper()
+	db := newTestDB(t, &models.MiniApp{}, &models.CustomerService{}, &models.Assignment{},
+		&models.Conversation{}, &models.Message{}, &models.BusinessHours{}, &models.BusinessHoliday{})
+	ma := models.MiniApp{Name: "测试", AppID: "wx-test", RoutingStrategy: strategy}
+	db.Create(&ma)
+	for i := 1; i <= agents; i++ {
+		cs := models.CustomerService{Name: fmt.Sprintf("客服%d", i), Status: models.CSStatusOnline, MaxConcurrent: 10}
+		db.Create(&cs)
+		db.Create(&models.Assignment{MiniAppID: ma.ID, CustomerServiceID: cs.ID})
+	}
+	return db, ma
+}
+
+func TestDispatchQueueRoundRobin(t *testing.T) {
+	db, ma := seedTeam(t, models.RoutingRoundRobin, 3)
+	queuedAt := time.Now()
+	for i := 0; i < 6; i++ {
+		at := queuedAt.Add(time.Duration(i) * time.Second)
+		db.Create(&models.Conversation{UserID: uint(i + 1), MiniAppID: ma.ID, Status: models.ConversationQueued, QueuedAt: &at})
+	}
+
+	dispatchQueue(db, ma.ID)
+
+	var convs []models.Conversation
+	db.Order("id").Find(&convs)
+	var got []uint
+	for _, c := range convs {
+		if c.Status != models.ConversationAssigned {
+			t.Errorf("会话 %d 状态 %s，want assigned", c.ID, c.Status)
+		}
+		got = append(got, c.CustomerServiceID)
+	}
+	want := []uint{1, 2, 3, 1, 2, 3}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("分配的客服 = %v，want %v", got, want)
+	}
+}
+
+func TestRoundRobinAgentReadsCursor(t *testing.T) {
+	db, ma := seedTeam(t, models.RoutingRoundRobin, 3)
+	team := teamMembers(db, ma.ID)
+	// 每次都从数据库读取游标，调用方持有的小程序记录过期时也依次分配
+	var got []uint
+	for i := 0; i < 4; i++ {
+		got = append(got, roundRobinAgent(db, ma.ID, team))
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]uint{1, 2, 3, 1}) {
+		t.Errorf("分配顺序 = %v", got)
+	}
+
+	// 只有上次分配的客服可接待时仍分配给他
+	if id := roundRobinAgent(db, ma.ID, team[:1]); id != 1 {
+		t.Errorf("唯一可接待的客服 = %d，want 1", id)
+	}
+	db.Model(&models.MiniApp{}).Where("id = ?", ma.ID).UpdateColumn("round_robin_cursor", 2)
+	if id := roundRobinAgent(db, ma.ID, []models.CustomerService{team[0], team[2]}); id != 3 {
+		t.Errorf("跳过不可接待的客服 = %d，want 3", id)
+	}
+}
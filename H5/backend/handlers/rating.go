@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// ratingPayload 满意度评价邀请消息的内容，小程序据此显示评价卡片
+type ratingPayload struct {
+	ConversationID uint   `json:"conversationId"`
+	AgentName      string `json:"agentName"`
+}
+
+// requestRating 会话解决后向用户发送满意度评价邀请（每个会话一次）
+// CSAT_ENABLED=false 关闭评价；CSAT_SUBSCRIPTION_PUSH=true 时同时通过订阅消息提醒不在线的用户
+func requestRating(db *gorm.DB, conv *models.Conversation) {
+	if !envBool("CSAT_ENABLED", true) || conv.CustomerServiceID == 0 || conv.RatingRequestedAt != nil {
+		return
+	}
+	var count int64
+	db.Model(&models.Rating{}).Where("conversation_id = ?", conv.ID).Count(&count)
+	if count > 0 {
+		return
+	}
+	now := time.Now()
+	res := db.Model(&models.Conversation{}).Where("id = ? AND rating_requested_at IS NULL", conv.ID).Update("rating_requested_at", now)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	conv.RatingRequestedAt = &now
+
+	var cs models.CustomerService
+	db.First(&cs, conv.CustomerServiceID)
+	payload, _ := json.Marshal(ratingPayload{ConversationID: conv.ID, AgentName: cs.Name})
+	content := "本次服务已结束，请对客服的服务进行评价"
+	db.Create(&models.Message{
+		UserID:            conv.UserID,
+		CustomerServiceID: conv.CustomerServiceID,
+		ConversationID:    conv.ID,
+		Content:           content,
+		Type:              models.MessageTypeRating,
+		Payload:           payload,
+		IsSystem:          true,
+	})
+	if envBool("CSAT_SUBSCRIPTION_PUSH", false) {
+		sendSubscriptionPush(db, conv.UserID, conv.CustomerServiceID, content)
+	}
+}
+
+// submitRating 用户提交满意度评价
+func submitRating(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		AppID          string `json:"appId"`
+		OpenID         string `json:"openId"`
+		ConversationID uint   `json:"conversationId"`
+		Score          int    `json:"score"`
+		Comment        string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ConversationID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	if req.Score < 1 || req.Score > 5 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "评分必须为 1~5"})
+		return
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "评价内容不能超过 500 字"})
+		return
+	}
+	_, user, err := findMiniAppUser(db, req.AppID, req.OpenID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var conv models.Conversation
+	if err := db.Where("id = ? AND user_id = ?", req.ConversationID, user.ID).First(&conv).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+	if conv.RatingRequestedAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该会话暂不能评价"})
+		return
+	}
+	var existing models.Rating
+	if err := db.Where("conversation_id = ?", conv.ID).First(&existing).Error; err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "您已评价过本次服务"})
+		return
+	}
+
+	// 评价归属于发送邀请时的接待客服（邀请消息中记录）
+	var invite models.Message
+	csID := conv.CustomerServiceID
+	if err := db.Where("conversation_id = ? AND type = ?", conv.ID, models.MessageTypeRating).Order("id DESC").First(&invite).Error; err == nil && invite.CustomerServiceID != 0 {
+		csID = invite.CustomerServiceID
+	}
+	rating := models.Rating{
+		ConversationID:    conv.ID,
+		UserID:            user.ID,
+		MiniAppID:         conv.MiniAppID,
+		CustomerServiceID: csID,
+		Score:             req.Score,
+		Comment:           req.Comment,
+	}
+	if err := db.Create(&rating).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "您已评价过本次服务"})
+		return
+	}
+	notifyCS(csID, wsEvent{Type: "rating", Data: rating})
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "rating": rating})
+}
+
+// csatStats 满意度统计：评价数、平均分、满意率（4~5 星占比）、各星级数量
+type csatStats struct {
+	Count        int64    `json:"count"`
+	Average      float64  `json:"average"`
+	CSAT         float64  `json:"csat"`
+	Distribution [5]int64 `json:"distribution"` // 1~5 星的数量
+	ID           uint     `json:"id,omitempty"`
+	Name         string   `json:"name,omitempty"`
+	scores       []int
+}
+
+func (s *csatStats) add(score int) {
+	s.scores = append(s.scores, score)
+}
+
+func (s *csatStats) finish() {
+	total, satisfied := 0, 0
+	for _, score := range s.scores {
+		total += score
+		if score >= 4 {
+			satisfied++
+		}
+		s.Distribution[score-1]++
+	}
+	s.Count = int64(len(s.scores))
+	if s.Count > 0 {
+		s.Average = float64(total) / float64(s.Count)
+		s.CSAT = float64(satisfied) / float64(s.Count)
+	}
+}
+
+// parseDateRange 解析 from/to（2006-01-02，按服务器时区），to 包含当天
+func parseDateRange(c *gin.Context) (from, to time.Time, ok bool) {
+	if s := c.Query("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return from, to, false
+		}
+		from = t
+	}
+	if s := c.Query("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return from, to, false
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	return from, to, true
+}
+
+// ratingQuery 按时间范围、小程序、客服筛选评价
+func ratingQuery(c *gin.Context, db *gorm.DB) (*gorm.DB, bool) {
+	from, to, ok := parseDateRange(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "日期格式错误，应为 2006-01-02"})
+		return nil, false
+	}
+	query := db.Model(&models.Rating{})
+	if !from.IsZero() {
+		query = query.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("created_at < ?", to)
+	}
+	if id := parseUint(c.Query("miniAppId")); id != 0 {
+		query = query.Where("mini_app_id = ?", id)
+	}
+	if id := parseUint(c.Query("csId")); id != 0 {
+		query = query.Where("customer_service_id = ?", id)
+	}
+	return query, true
+}
+
+// getCSATReport 满意度报表：总体及按客服、按小程序的统计，可按 from/to、miniAppId、csId 筛选
+func getCSATReport(c *gin.Context, db *gorm.DB) {
+	query, ok := ratingQuery(c, db)
+	if !ok {
+		return
+	}
+	var ratings []models.Rating
+	query.Find(&ratings)
+
+	overall := &csatStats{}
+	byAgent := map[uint]*csatStats{}
+	byMiniApp := map[uint]*csatStats{}
+	for _, r := range ratings {
+		if r.Score < 1 || r.Score > 5 {
+			continue
+		}
+		overall.add(r.Score)
+		if byAgent[r.CustomerServiceID] == nil {
+			byAgent[r.CustomerServiceID] = &csatStats{ID: r.CustomerServiceID}
+		}
+		byAgent[r.CustomerServiceID].add(r.Score)
+		if byMiniApp[r.MiniAppID] == nil {
+			byMiniApp[r.MiniAppID] = &csatStats{ID: r.MiniAppID}
+		}
+		byMiniApp[r.MiniAppID].add(r.Score)
+	}
+	overall.finish()
+
+	agents := []*csatStats{}
+	var csList []models.CustomerService
+	db.Order("id ASC").Find(&csList)
+	for _, cs := range csList {
+		if s, ok := byAgent[cs.ID]; ok {
+			s.Name = cs.Name
+			s.finish()
+			agents = append(agents, s)
+		}
+	}
+	miniApps := []*csatStats{}
+	var maList []models.MiniApp
+	db.Order("id ASC").Find(&maList)
+	for _, ma := range maList {
+		if s, ok := byMiniApp[ma.ID]; ok {
+			s.Name = ma.Name
+			if s.Name == "" {
+				s.Name = ma.AppID
+			}
+			s.finish()
+			miniApps = append(miniApps, s)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"overall":   overall,
+		"byAgent":   agents,
+		"byMiniApp": miniApps,
+	})
+}
+
+// getRatings 评价明细，筛选条件同满意度报表，maxScore 只返回不高于该分数的评价（如差评）
+func getRatings(c *gin.Context, db *gorm.DB) {
+	query, ok := ratingQuery(c, db)
+	if !ok {
+		return
+	}
+	if s := parseUint(c.Query("maxScore")); s != 0 {
+		query = query.Where("score <= ?", s)
+	}
+	var ratings []models.Rating
+	query.Order("id DESC").Limit(500).Find(&ratings)
+	c.JSON(http.StatusOK, ratings)
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// 机器人应答结果
+const (
+	ResponderAnswer  = "answer"  // 直接回答
+	ResponderClarify = "clarify" // 无法确定用户问题，请用户澄清（可附带候选问题）
+	ResponderHandoff = "handoff" // 转人工客服
+)
+
+// Responder 转人工前的第一线机器人，收到用户消息后决定回答、请用户澄清或转人工
+type Responder interface {
+	Respond(ctx context.Context, req ResponderRequest) (ResponderReply, error)
+}
+
+// ResponderTurn 会话中的一条历史消息
+type ResponderTurn struct {
+	FromUser bool   `json:"fromUser"`
+	IsBot    bool   `json:"isBot"`
+	Content  string `json:"content"`
+}
+
+// ResponderRequest 交给机器人的用户消息及上下文
+type ResponderRequest struct {
+	MiniAppID      uint            `json:"miniAppId"`
+	AppID          string          `json:"appId"`
+	ConversationID uint            `json:"conversationId"`
+	UserID         uint            `json:"userId"`
+	OpenID         string          `json:"openId"`
+	Content        string          `json:"content"`
+	Suggestions    []string        `json:"suggestions,omitempty"` // 上一次澄清时给出的候选问题，用户可回复序号
+	History        []ResponderTurn `json:"history"`
+}
+
+// ResponderReply 机器人的应答
+type ResponderReply struct {
+	Action      string   `json:"action"`
+	Text        string   `json:"text"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// botPayload 机器人消息的附加内容，澄清时记录候选问题
+type botPayload struct {
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// responderFor 返回小程序配置的机器人，未配置时返回 nil
+func responderFor(db *gorm.DB, ma models.MiniApp) Responder {
+	switch ma.ResponderType {
+	case models.ResponderFAQ:
+		return &faqResponder{db: db}
+	case models.ResponderWebhook:
+		if ma.ResponderURL == "" {
+			return nil
+		}
+		return &webhookResponder{url: ma.ResponderURL, secret: ma.ResponderSecret, client: http.DefaultClient}
+	}
+	return nil
+}
+
+// botCanRespond 会话尚未转人工时由机器人应答（排队中或已有客服接待的会话不再交给机器人）
+func botCanRespond(conv models.Conversation) bool {
+	if conv.CustomerServiceID != 0 {
+		return false
+	}
+	switch conv.Status {
+	case models.ConversationOpen, models.ConversationBot, models.ConversationPendingUser:
+		return true
+	}
+	return false
+}
+
+// wantsHuman 用户明确要求转人工（BOT_HANDOFF_KEYWORDS，逗号分隔）
+func wantsHuman(content string) bool {
+	content = strings.TrimSpace(content)
+	for _, kw := range strings.Split(envString("BOT_HANDOFF_KEYWORDS", "人工,转人工,人工客服,找客服"), ",") {
+		if kw = strings.TrimSpace(kw); kw != "" && content == kw {
+			return true
+		}
+	}
+	return false
+}
+
+// askResponder 把用户消息交给机器人，机器人出错或超时时转人工
+func askResponder(ctx context.Context, db *gorm.DB, responder Responder, ma models.MiniApp, user models.User, conv models.Conversation, content string) ResponderReply {
+	if wantsHuman(content) {
+		return ResponderReply{Action: ResponderHandoff}
+	}
+	req := ResponderRequest{
+		MiniAppID:      ma.ID,
+		AppID:          ma.AppID,
+		ConversationID: conv.ID,
+		UserID:         user.ID,
+		OpenID:         user.OpenID,
+		Content:        content,
+		History:        []ResponderTurn{},
+	}
+	var history []models.Message
+	db.Where("conversation_id = ? AND is_system = ? AND recalled_at IS NULL", conv.ID, false).Order("id DESC").Limit(10).Find(&history)
+	for i := len(history) - 1; i >= 0; i-- {
+		req.History = append(req.History, ResponderTurn{FromUser: history[i].FromUser, IsBot: history[i].IsBot, Content: history[i].Content})
+	}
+	if len(history) > 0 && history[0].IsBot && len(history[0].Payload) > 0 {
+		var p botPayload
+		if json.Unmarshal(history[0].Payload, &p) == nil {
+			req.Suggestions = p.Suggestions
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, envDuration("RESPONDER_TIMEOUT", 5*time.Second))
+	defer cancel()
+	reply, err := responder.Respond(ctx, req)
+	if err == nil {
+		err = validateResponderReply(reply)
+	}
+	if err != nil {
+		log.Printf("[机器人] 应答失败，转人工，miniAppID=%d, conversationID=%d, error=%v", ma.ID, conv.ID, err)
+		return ResponderReply{Action: ResponderHandoff}
+	}
+	return reply
+}
+
+func validateResponderReply(reply ResponderReply) error {
+	switch reply.Action {
+	case ResponderAnswer, ResponderClarify:
+		if strings.TrimSpace(reply.Text) == "" {
+			return fmt.Errorf("应答内容为空")
+		}
+	case ResponderHandoff:
+	default:
+		return fmt.Errorf("无效的应答类型: %q", reply.Action)
+	}
+	return nil
+}
+
+// sendBotReply 保存机器人消息，回答或澄清时会话进入机器人应答状态
+func sendBotReply(db *gorm.DB, conv *models.Conversation, reply ResponderReply) models.Message {
+	msg := models.Message{
+		UserID:         conv.UserID,
+		ConversationID: conv.ID,
+		Content:        reply.Text,
+		Type:           models.MessageTypeText,
+		IsBot:          true,
+	}
+	if len(reply.Suggestions) > 0 {
+		msg.Payload, _ = json.Marshal(botPayload{Suggestions: reply.Suggestions})
+	}
+	db.Create(&msg)
+	if reply.Action != ResponderHandoff {
+		now := time.Now()
+		changed := conv.Status != models.ConversationBot
+		conv.Status = models.ConversationBot
+		conv.LastMessageAt = &now
+		db.Model(conv).Updates(map[string]interface{}{"status": models.ConversationBot, "last_message_at": now})
+		if changed {
+			notifyConversation(*conv)
+		}
+	}
+	return msg
+}
+
+// webhookResponder 调用外部 HTTP 接口应答：POST ResponderRequest JSON，返回 ResponderReply JSON。
+// 配置了密钥时请求头 X-Responder-Signature 为请求体的 HMAC-SHA256（hex）
+type webhookResponder struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (w *webhookResponder) Respond(ctx context.Context, req ResponderRequest) (ResponderReply, error) {
+	var reply ResponderReply
+	body, err := json.Marshal(req)
+	if err != nil {
+		return reply, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return reply, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		httpReq.Header.Set("X-Responder-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("webhook 返回状态码 %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return reply, fmt.Errorf("webhook 返回内容格式错误: %v", err)
+	}
+	return reply, nil
+}
+
+// updateMiniAppResponder 设置小程序的机器人应答方式
+func updateMiniAppResponder(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var req struct {
+		ResponderType   string  `json:"ResponderType"`
+		ResponderURL    string  `json:"ResponderURL"`
+		ResponderSecret *string `json:"ResponderSecret"` // 不传时保留原密钥
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	switch req.ResponderType {
+	case models.ResponderNone, models.ResponderFAQ:
+	case models.ResponderWebhook:
+		if !strings.HasPrefix(req.ResponderURL, "http://") && !strings.HasPrefix(req.ResponderURL, "https://") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook 地址必须以 http:// 或 https:// 开头"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的机器人类型，可选值: faq/webhook，为空表示不使用"})
+		return
+	}
+
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	updates := map[string]interface{}{"responder_type": req.ResponderType, "responder_url": req.ResponderURL}
+	if req.ResponderSecret != nil {
+		updates["responder_secret"] = *req.ResponderSecret
+	}
+	if err := db.Model(&ma).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "更新成功", "ResponderType": req.ResponderType, "ResponderURL": req.ResponderURL})
+}
+
+// testResponder 试运行：把一条消息交给小程序配置的机器人，返回应答结果，不保存任何数据
+func testResponder(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		Content     string   `json:"content"`
+		Suggestions []string `json:"suggestions"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	var ma models.MiniApp
+	if err := db.First(&ma, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	responder := responderFor(db, ma)
+	if responder == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该小程序未配置机器人"})
+		return
+	}
+	if f, ok := responder.(*faqResponder); ok {
+		f.dryRun = true
+	}
+	if wantsHuman(req.Content) {
+		c.JSON(http.StatusOK, ResponderReply{Action: ResponderHandoff})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), envDuration("RESPONDER_TIMEOUT", 5*time.Second))
+	defer cancel()
+	reply, err := responder.Respond(ctx, ResponderRequest{
+		MiniAppID:   ma.ID,
+		AppID:       ma.AppID,
+		Content:     req.Content,
+		Suggestions: req.Suggestions,
+		History:     []ResponderTurn{},
+	})
+	if err == nil {
+		err = validateResponderReply(reply)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "机器人应答失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reply)
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// isValidRoutingStrategy 检查分配策略是否合法
+func isValidRoutingStrategy(strategy string) bool {
+	switch strategy {
+	case models.RoutingRoundRobin, models.RoutingLeastActive, models.RoutingSticky:
+		return true
+	}
+	return false
+}
+
+// teamMembers 返回小程序客服团队成员（按客服ID排序）
+func teamMembers(db *gorm.DB, miniAppID uint) []models.CustomerService {
+	var assigns []models.Assignment
+	db.Where("mini_app_id = ?", miniAppID).Find(&assigns)
+	if len(assigns) == 0 {
+		return nil
+	}
+	var csIDs []uint
+	for _, a := range assigns {
+		csIDs = append(csIDs, a.CustomerServiceID)
+	}
+	var team []models.CustomerService
+	db.Where("id IN ?", csIDs).Order("id ASC").Find(&team)
+	return team
+}
+
+// routeNewChat 按小程序的分配策略为新会话选择客服，只在可接待（在线且未满负荷）的客服中选择
+// exclude 为不参与分配的客服（如转接时的转出客服），没有可接待的客服时返回 0
+func routeNewChat(db *gorm.DB, ma models.MiniApp, userID uint, exclude uint) uint {
+	var eligible []models.CustomerService
+	for _, cs := range teamMembers(db, ma.ID) {
+		if cs.ID != exclude && isAgentAvailable(db, cs) {
+			eligible = append(eligible, cs)
+		}
+	}
+	if len(eligible) == 0 {
+		return 0
+	}
+
+	switch ma.RoutingStrategy {
+	case models.RoutingSticky:
+		if csID := lastAgentOf(db, userID, eligible); csID != 0 {
+			return csID
+		}
+		return leastActiveAgent(db, eligible)
+	case models.RoutingLeastActive:
+		return leastActiveAgent(db, eligible)
+	default:
+		return roundRobinAgent(db, ma.ID, eligible)
+	}
+}
+
+// roundRobinAgent 轮流分配：选择ID大于上次分配客服的第一个客服，到末尾后从头开始。
+// 游标按数据库中的当前值条件更新，并发分配时更新失败的一方重新读取游标再选择，避免两个新会话分给同一客服
+func roundRobinAgent(db *gorm.DB, miniAppID uint, eligible []models.CustomerService) uint {
+	next := eligible[0].ID
+	for attempt := 0; attempt < 5; attempt++ {
+		var cursor uint
+		if err := db.Model(&models.MiniApp{}).Where("id = ?", miniAppID).Pluck("round_robin_cursor", &cursor).Error; err != nil {
+			return next
+		}
+		next = eligible[0].ID
+		for _, cs := range eligible {
+			if cs.ID > cursor {
+				next = cs.ID
+				break
+			}
+		}
+		if next == cursor {
+			return next
+		}
+		res := db.Model(&models.MiniApp{}).Where("id = ? AND round_robin_cursor = ?", miniAppID, cursor).
+			UpdateColumn("round_robin_cursor", next)
+		if res.Error != nil || res.RowsAffected == 1 {
+			return next
+		}
+	}
+	return next
+}
+
+// leastActiveAgent 分配给当前接待会话最少的客服，相同时取ID较小的
+func leastActiveAgent(db *gorm.DB, eligible []models.CustomerService) uint {
+	type agentLoadInfo struct {
+		id   uint
+		load int64
+	}
+	loads := make([]agentLoadInfo, 0, len(eligible))
+	for _, cs := range eligible {
+		loads = append(loads, agentLoadInfo{cs.ID, agentLoad(db, cs.ID)})
+	}
+	sort.SliceStable(loads, func(i, j int) bool { return loads[i].load < loads[j].load })
+	return loads[0].id
+}
+
+// lastAgentOf 返回候选客服中最近一次与该用户对话的客服，没有则返回 0
+func lastAgentOf(db *gorm.DB, userID uint, candidates []models.CustomerService) uint {
+	var ids []uint
+	for _, cs := range candidates {
+		ids = append(ids, cs.ID)
+	}
+	var lastMsg models.Message
+	db.Where("user_id = ? AND customer_service_id IN ?", userID, ids).Order("created_at DESC").Limit(1).Find(&lastMsg)
+	return lastMsg.CustomerServiceID
+}
+
+// updateMiniAppRouting 设置小程序的新会话分配策略
+func updateMiniAppRouting(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	var req struct {
+		RoutingStrategy string `json:"RoutingStrategy"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	if !isValidRoutingStrategy(req.RoutingStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的分配策略，可选值: round_robin/least_active/sticky"})
+		return
+	}
+
+	var ma models.MiniApp
+	if err := db.First(&ma, miniAppID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "小程序不存在"})
+		return
+	}
+	if err := db.Model(&ma).Update("routing_strategy", req.RoutingStrategy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "更新成功", "RoutingStrategy": req.RoutingStrategy})
+}
+
+// getMiniAppTeam 获取小程序的客服团队（含状态和当前接待数）
+func getMiniAppTeam(c *gin.Context, db *gorm.DB) {
+	miniAppID := parseUint(c.Param("id"))
+	if miniAppID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的小程序ID"})
+		return
+	}
+
+	type TeamMember struct {
+		ID            uint   `json:"ID"`
+		Name          string `json:"Name"`
+		Status        string `json:"Status"`
+		MaxConcurrent int    `json:"MaxConcurrent"`
+		ActiveChats   int64  `json:"ActiveChats"`
+		Available     bool   `json:"Available"` // 是否可接待新会话
+	}
+	result := []TeamMember{}
+	for _, cs := range teamMembers(db, miniAppID) {
+		result = append(result, TeamMember{
+			ID:            cs.ID,
+			Name:          cs.Name,
+			Status:        cs.Status,
+			MaxConcurrent: cs.MaxConcurrent,
+			ActiveChats:   agentLoad(db, cs.ID),
+			Available:     isAgentAvailable(db, cs),
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
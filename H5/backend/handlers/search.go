@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// SearchIndex 消息全文检索接口，默认使用 MySQL FULLTEXT（ngram 分词），以后可以换成其他检索服务
+type SearchIndex interface {
+	// Search 按条件检索消息，结果按时间倒序
+	Search(ctx context.Context, q SearchQuery) (SearchResult, error)
+}
+
+// SearchQuery 检索条件。MiniAppIDs 为权限范围，nil 表示不限（管理员）
+type SearchQuery struct {
+	Text              string
+	MiniAppIDs        []uint
+	MiniAppID         uint
+	CustomerServiceID uint
+	UserID            uint
+	Type              string
+	From, To          time.Time
+	Offset, Limit     int
+}
+
+// SearchResult 检索结果
+type SearchResult struct {
+	Total    int64            `json:"total"`
+	Messages []models.Message `json:"messages"`
+}
+
+var searchIndex SearchIndex
+
+// mysqlSearchIndex 基于 messages.content 上的 FULLTEXT 索引（WITH PARSER ngram），
+// 少于 ngram_token_size（默认 2）个字的关键词无法通过全文索引匹配，改用 LIKE
+type mysqlSearchIndex struct {
+	db *gorm.DB
+}
+
+func newMySQLSearchIndex(db *gorm.DB) *mysqlSearchIndex {
+	return &mysqlSearchIndex{db: db}
+}
+
+// ErrInvalidSearchQuery 关键词无法解析为检索条件
+var ErrInvalidSearchQuery = errors.New("搜索关键词格式错误")
+
+// searchTerms 按空白和双引号拆分关键词，去掉布尔模式的运算符。
+// 关键词在布尔模式中用双引号包成短语，关键词内部不能再有双引号，否则表达式不完整
+func searchTerms(text string) []string {
+	var terms []string
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '"' || unicode.IsSpace(r) })
+	for _, t := range fields {
+		t = strings.Trim(t, `+-<>()~*"@`)
+		if t != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func (s *mysqlSearchIndex) Search(ctx context.Context, q SearchQuery) (SearchResult, error) {
+	var result SearchResult
+	query := s.db.WithContext(ctx).Model(&models.Message{}).
+		Joins("JOIN users ON users.id = messages.user_id").
+		Where("messages.is_deleted = ? AND messages.recalled_at IS NULL", false)
+
+	var boolean []string
+	for _, t := range searchTerms(q.Text) {
+		if utf8.RuneCountInString(t) < 2 {
+			query = query.Where("messages.content LIKE ?", "%"+escapeLike(t)+"%")
+		} else {
+			boolean = append(boolean, `+"`+t+`"`)
+		}
+	}
+	if len(boolean) > 0 {
+		query = query.Where("MATCH(messages.content) AGAINST(? IN BOOLEAN MODE)", strings.Join(boolean, " "))
+	}
+
+	if q.MiniAppIDs != nil {
+		if len(q.MiniAppIDs) == 0 {
+			return result, nil
+		}
+		query = query.Where("users.mini_app_id IN ?", q.MiniAppIDs)
+	}
+	if q.MiniAppID != 0 {
+		query = query.Where("users.mini_app_id = ?", q.MiniAppID)
+	}
+	if q.CustomerServiceID != 0 {
+		query = query.Where("messages.customer_service_id = ?", q.CustomerServiceID)
+	}
+	if q.UserID != 0 {
+		query = query.Where("messages.user_id = ?", q.UserID)
+	}
+	if q.Type != "" {
+		query = query.Where("messages.type = ?", q.Type)
+	}
+	if !q.From.IsZero() {
+		query = query.Where("messages.created_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("messages.created_at < ?", q.To)
+	}
+
+	if err := query.Count(&result.Total).Error; err != nil {
+		return result, fullTextError(err)
+	}
+	err := query.Select("messages.*").Order("messages.created_at DESC, messages.id DESC").
+		Offset(q.Offset).Limit(q.Limit).Find(&result.Messages).Error
+	return result, fullTextError(err)
+}
+
+// fullTextError 全文检索表达式的语法错误（ER_PARSE_ERROR）属于请求错误，其他错误原样返回
+func fullTextError(err error) error {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == 1064 {
+		return fmt.Errorf("%w: %s", ErrInvalidSearchQuery, me.Message)
+	}
+	return err
+}
+
+// escapeLike 转义 LIKE 通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// highlight 截取第一个关键词附近的内容，HTML 转义后用 <em> 标记关键词
+func highlight(content string, terms []string) string {
+	runes := []rune(content)
+	lower := []rune(strings.ToLower(content))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, t := range terms {
+		tr := []rune(strings.ToLower(t))
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if string(lower[i:i+len(tr)]) != string(tr) {
+				continue
+			}
+			for k := i; k < i+len(tr); k++ {
+				marked[k] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	from := first - 30
+	if from < 0 {
+		from = 0
+	}
+	to := from + 120
+	if to > len(runes) {
+		to = len(runes)
+	}
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("...")
+	}
+	for i := from; i < to; i++ {
+		if marked[i] && (i == from || !marked[i-1]) {
+			b.WriteString("<em>")
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i == to-1 || !marked[i+1]) {
+			b.WriteString("</em>")
+		}
+	}
+	if to < len(runes) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+// searchHit 检索结果中的一条消息
+type searchHit struct {
+	models.Message
+	Highlight   string `json:"Highlight"` // 已 HTML 转义，关键词用 <em> 标记
+	UserName    string `json:"UserName"`
+	MiniAppName string `json:"MiniAppName"`
+}
+
+// searchMessages 检索聊天记录（GET /chat/cs/:csId/search?q=），客服只能检索分配给自己的小程序，管理员不限
+func searchMessages(c *gin.Context, db *gorm.DB) {
+	var cs models.CustomerService
+	if err := db.First(&cs, parseUint(c.Param("csId"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "客服不存在"})
+		return
+	}
+	q := SearchQuery{
+		Text:              strings.TrimSpace(c.Query("q")),
+		MiniAppID:         parseUint(c.Query("miniAppId")),
+		CustomerServiceID: parseUint(c.Query("agentId")),
+		UserID:            parseUint(c.Query("userId")),
+		Type:              c.Query("type"),
+		Limit:             20,
+	}
+	if len(searchTerms(q.Text)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请输入搜索关键词"})
+		return
+	}
+	var ok bool
+	if q.From, q.To, ok = parseDateRange(c); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "日期格式错误，应为 2006-01-02"})
+		return
+	}
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n <= 100 {
+		q.Limit = n
+	}
+	if n, err := strconv.Atoi(c.Query("offset")); err == nil && n > 0 {
+		q.Offset = n
+	}
+	if !cs.IsAdmin {
+		q.MiniAppIDs = []uint{}
+		db.Model(&models.Assignment{}).Where("customer_service_id = ?", cs.ID).Pluck("mini_app_id", &q.MiniAppIDs)
+	}
+
+	result, err := searchIndex.Search(c.Request.Context(), q)
+	if errors.Is(err, ErrInvalidSearchQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidSearchQuery.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("搜索失败: %v", err)})
+		return
+	}
+
+	hits := searchHits(db, result.Messages, searchTerms(q.Text))
+	c.JSON(http.StatusOK, gin.H{"total": result.Total, "offset": q.Offset, "limit": q.Limit, "results": hits})
+}
+
+// searchHits 生成检索结果：消息按返回给客户端的视图处理（私有模式下文件地址为签名地址），并附带用户和小程序名称
+func searchHits(db *gorm.DB, msgs []models.Message, terms []string) []searchHit {
+	var userIDs []uint
+	for _, msg := range msgs {
+		userIDs = append(userIDs, msg.UserID)
+	}
+	users := make(map[uint]models.User)
+	appNames := make(map[uint]string)
+	if len(userIDs) > 0 {
+		var list []models.User
+		db.Where("id IN ?", uniqueIDs(userIDs)).Find(&list)
+		var appIDs []uint
+		for _, u := range list {
+			users[u.ID] = u
+			appIDs = append(appIDs, u.MiniAppID)
+		}
+		var apps []models.MiniApp
+		db.Where("id IN ?", uniqueIDs(appIDs)).Find(&apps)
+		for _, ma := range apps {
+			appNames[ma.ID] = ma.Name
+			if ma.Name == "" {
+				appNames[ma.ID] = ma.AppID
+			}
+		}
+	}
+
+	hits := make([]searchHit, 0, len(msgs))
+	for _, msg := range msgs {
+		user := users[msg.UserID]
+		view := messageView(msg)
+		hits = append(hits, searchHit{
+			Message:     view,
+			Highlight:   highlight(view.Content, terms),
+			UserName:    userDisplayName(user),
+			MiniAppName: appNames[user.MiniAppID],
+		})
+	}
+	return hits
+}
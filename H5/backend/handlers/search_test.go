@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"退款 订单", []string{"退款", "订单"}},
+		{"  +退款  -订单* ", []string{"退款", "订单"}},
+		{`ab"cd`, []string{"ab", "cd"}},
+		{`"ab cd"`, []string{"ab", "cd"}},
+		{`a"""b`, []string{"a", "b"}},
+		{`""`, nil},
+		{"@~()<>", nil},
+		{"a@b", []string{"a@b"}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"50%":    `50\%`,
+		"a_b":    `a\_b`,
+		`C:\tmp`: `C:\\tmp`,
+		"退款":     "退款",
+		`%_\`:    `\%\_\\`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFullTextError(t *testing.T) {
+	parseErr := &mysql.MySQLError{Number: 1064, Message: "syntax error, unexpected '\"'"}
+	if err := fullTextError(parseErr); !errors.Is(err, ErrInvalidSearchQuery) {
+		t.Errorf("parse error should map to ErrInvalidSearchQuery, got %v", err)
+	}
+	other := &mysql.MySQLError{Number: 1146, Message: "table doesn't exist"}
+	if err := fullTextError(other); err != other {
+		t.Errorf("other errors should be returned unchanged, got %v", err)
+	}
+	if err := fullTextError(nil); err != nil {
+		t.Errorf("fullTextError(nil) = %v", err)
+	}
+}
+
+func TestSearchHitsUseMessageView(t *testing.T) {
+	db := newTestDB(t, &models.User{}, &models.MiniApp{})
+	local, err := storage.NewLocal(t.TempDir(), "http://test.local", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := store
+	store = local
+	t.Cleanup(func() { store = prev })
+	t.Setenv("MEDIA_PRIVATE", "true")
+
+	db.Create(&models.MiniApp{Name: "小程序", AppID: "wx1"})
+	db.Create(&models.User{MiniAppID: 1, OpenID: "o1"})
+	url := "http://test.local/uploads/2026/10/a.png"
+	now := time.Now()
+	msgs := []models.Message{
+		{ID: 1, UserID: 1, Content: "退款截图", IsImage: true, ImageURL: url, Payload: []byte(`{"url":"` + url + `"}`)},
+		{ID: 2, UserID: 1, Content: "退款原文", RecalledAt: &now},
+	}
+	hits := searchHits(db, msgs, []string{"退款"})
+	if len(hits) != 2 {
+		t.Fatalf("hits = %d", len(hits))
+	}
+	if !strings.Contains(hits[0].ImageURL, "sig=") || !strings.Contains(string(hits[0].Payload), "sig=") {
+		t.Errorf("私有模式下应返回签名地址: %s %s", hits[0].ImageURL, hits[0].Payload)
+	}
+	if hits[0].MiniAppName != "小程序" {
+		t.Errorf("MiniAppName = %q", hits[0].MiniAppName)
+	}
+	if hits[1].Content != recalledText || strings.Contains(hits[1].Highlight, "原文") {
+		t.Errorf("已撤回的消息不应返回原内容: %q %q", hits[1].Content, hits[1].Highlight)
+	}
+}
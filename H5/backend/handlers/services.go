@@ -0,0 +1,23 @@
+package handlers
+
+import "gorm.io/gorm"
+
+// StartServices 启动消息分发、在线状态、客服空闲检测、会话自动关闭、排队调度等后台服务，并初始化消息检索和文件存储，需在注册路由前调用
+// HUB_BACKEND=db 时通过数据库在多个后端实例之间分发客服消息，默认 memory（单实例）
+func StartServices(db *gorm.DB) {
+	if envString("HUB_BACKEND", "memory") == "db" {
+		hub = newDBHub(db)
+	}
+	hub.Subscribe(deliverToLocalCS)
+	presence.start(db)
+	startAgentIdleCheck(db)
+	startConversationAutoClose(db)
+	startQueueDispatcher(db)
+	searchIndex = newMySQLSearchIndex(db)
+	initStorage()
+	// 旧文件的迁移依赖存储后端，在初始化存储后执行
+	runMigration(db, "migration_legacy_uploads", migrateLegacyUploads)
+	runMigration(db, "migration_legacy_upload_duplicates", migrateLegacyUploadDuplicates)
+	startAttachmentGC(db)
+	startUploadSessionCleanup(db)
+}
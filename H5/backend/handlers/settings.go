@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString 读取字符串环境变量，未设置时返回默认值
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration 读取时长环境变量（如 "90s"、"5m"），格式错误时返回默认值
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
+
+// envBool 读取布尔环境变量（1/true/yes 为真），未设置时返回默认值
+func envBool(key string, def bool) bool {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "":
+		return def
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// envFloat 读取浮点数环境变量，格式错误时返回默认值
+func envFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// parseTagFilter 解析标签筛选条件（逗号分隔的标签ID或名称），返回标签ID，任意一个不存在时 ok 为 false
+func parseTagFilter(db *gorm.DB, q string) (ids []uint, ok bool) {
+	for _, s := range strings.Split(q, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		var tag models.Tag
+		if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+			if db.First(&tag, uint(id)).Error != nil {
+				return nil, false
+			}
+		} else if db.Where("name = ?", s).First(&tag).Error != nil {
+			return nil, false
+		}
+		ids = append(ids, tag.ID)
+	}
+	return ids, len(ids) > 0
+}
+
+// userTagsOf 批量读取用户的标签
+func userTagsOf(db *gorm.DB, userIDs []uint) map[uint][]models.Tag {
+	result := make(map[uint][]models.Tag)
+	if len(userIDs) == 0 {
+		return result
+	}
+	var links []models.UserTag
+	db.Where("user_id IN ?", userIDs).Find(&links)
+	var tagIDs []uint
+	for _, l := range links {
+		tagIDs = append(tagIDs, l.TagID)
+	}
+	tags := tagsByID(db, tagIDs)
+	for _, l := range links {
+		if tag, ok := tags[l.TagID]; ok {
+			result[l.UserID] = append(result[l.UserID], tag)
+		}
+	}
+	return result
+}
+
+// conversationTagsOf 批量读取会话的标签
+func conversationTagsOf(db *gorm.DB, convIDs []uint) map[uint][]models.Tag {
+	result := make(map[uint][]models.Tag)
+	if len(convIDs) == 0 {
+		return result
+	}
+	var links []models.ConversationTag
+	db.Where("conversation_id IN ?", convIDs).Find(&links)
+	var tagIDs []uint
+	for _, l := range links {
+		tagIDs = append(tagIDs, l.TagID)
+	}
+	tags := tagsByID(db, tagIDs)
+	for _, l := range links {
+		if tag, ok := tags[l.TagID]; ok {
+			result[l.ConversationID] = append(result[l.ConversationID], tag)
+		}
+	}
+	return result
+}
+
+func tagsByID(db *gorm.DB, ids []uint) map[uint]models.Tag {
+	tags := make(map[uint]models.Tag)
+	if len(ids) == 0 {
+		return tags
+	}
+	var list []models.Tag
+	db.Where("id IN ?", ids).Order("id ASC").Find(&list)
+	for _, t := range list {
+		tags[t.ID] = t
+	}
+	return tags
+}
+
+// bindTagIDs 读取请求中的标签ID并检查标签是否存在
+func bindTagIDs(c *gin.Context, db *gorm.DB, csID *uint) ([]uint, bool) {
+	var req struct {
+		CustomerServiceID uint   `json:"CustomerServiceID"`
+		TagIDs            []uint `json:"TagIDs"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return nil, false
+	}
+	if len(req.TagIDs) > 0 {
+		var count int64
+		db.Model(&models.Tag{}).Where("id IN ?", req.TagIDs).Count(&count)
+		if int(count) != len(uniqueIDs(req.TagIDs)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "标签不存在"})
+			return nil, false
+		}
+	}
+	if csID != nil {
+		*csID = req.CustomerServiceID
+	}
+	return uniqueIDs(req.TagIDs), true
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool)
+	var out []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// setUserTags 客服设置用户的标签（整体替换）
+func setUserTags(c *gin.Context, db *gorm.DB) {
+	user, ok := loadAgentUser(c, db, parseUint(c.Param("csId")))
+	if !ok {
+		return
+	}
+	tagIDs, ok := bindTagIDs(c, db, nil)
+	if !ok {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.UserTag{}).Error; err != nil {
+			return err
+		}
+		for _, id := range tagIDs {
+			if err := tx.Create(&models.UserTag{UserID: user.ID, TagID: id}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置标签失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "设置成功", "tags": userTagsOf(db, []uint{user.ID})[user.ID]})
+}
+
+// setConversationTags 客服设置会话的标签（整体替换）
+func setConversationTags(c *gin.Context, db *gorm.DB) {
+	var csID uint
+	tagIDs, ok := bindTagIDs(c, db, &csID)
+	if !ok {
+		return
+	}
+	if csID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	conv, ok := loadAgentConversation(c, db, csID)
+	if !ok {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("conversation_id = ?", conv.ID).Delete(&models.ConversationTag{}).Error; err != nil {
+			return err
+		}
+		for _, id := range tagIDs {
+			if err := tx.Create(&models.ConversationTag{ConversationID: conv.ID, TagID: id}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置标签失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "设置成功", "tags": conversationTagsOf(db, []uint{conv.ID})[conv.ID]})
+}
+
+// getTags 获取所有标签
+func getTags(c *gin.Context, db *gorm.DB) {
+	var tags []models.Tag
+	db.Order("id ASC").Find(&tags)
+	c.JSON(http.StatusOK, tags)
+}
+
+// addTag 添加标签
+func addTag(c *gin.Context, db *gorm.DB) {
+	var tag models.Tag
+	if err := c.ShouldBindJSON(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	tag.ID = 0
+	tag.Name = strings.TrimSpace(tag.Name)
+	if tag.Name == "" || strings.Contains(tag.Name, ",") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "标签名称不能为空且不能包含逗号"})
+		return
+	}
+	var count int64
+	db.Model(&models.Tag{}).Where("name = ?", tag.Name).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "标签已存在"})
+		return
+	}
+	if err := db.Create(&tag).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tag)
+}
+
+// updateTag 修改标签名称或颜色
+func updateTag(c *gin.Context, db *gorm.DB) {
+	var tag models.Tag
+	if err := db.First(&tag, parseUint(c.Param("id"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "标签不存在"})
+		return
+	}
+	var req struct {
+		Name  string `json:"Name"`
+		Color string `json:"Color"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || strings.Contains(req.Name, ",") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "标签名称不能为空且不能包含逗号"})
+		return
+	}
+	var count int64
+	db.Model(&models.Tag{}).Where("name = ? AND id <> ?", req.Name, tag.ID).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "标签已存在"})
+		return
+	}
+	tag.Name, tag.Color = req.Name, req.Color
+	if err := db.Save(&tag).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "修改失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tag)
+}
+
+// deleteTag 删除标签及其在用户和会话上的使用（硬删除）
+func deleteTag(c *gin.Context, db *gorm.DB) {
+	tagID := parseUint(c.Param("id"))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("tag_id = ?", tagID).Delete(&models.UserTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("tag_id = ?", tagID).Delete(&models.ConversationTag{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&models.Tag{}, tagID).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+)
+
+// transferEvent 推送给转出和接手客服的转接事件
+type transferEvent struct {
+	Conversation models.Conversation `json:"conversation"`
+	FromCSID     uint                `json:"fromCsId"`
+	ToCSID       uint                `json:"toCsId"`
+	RequestedBy  uint                `json:"requestedBy"` // 发起转接的客服，管理员代为转接时与 fromCsId 不同
+	Note         string              `json:"note"`
+	Direction    string              `json:"direction"` // out：转出，in：接手
+}
+
+// errNotConversationOwner 只有接待客服和管理员可以转接会话
+var errNotConversationOwner = errors.New("只能转接自己接待的会话")
+
+// transferConversation 将会话从当前接待客服转接给指定客服；toCSID 为 0 时转给团队中其他可接待的客服。
+// requesterID 为发起转接的客服，必须是当前接待客服或管理员；尚未分配客服的会话团队成员都可以转接。
+// 会话的历史消息按用户查询，接手客服可以看到完整记录
+func transferConversation(db *gorm.DB, conv models.Conversation, requesterID, toCSID uint, note string) (models.Conversation, error) {
+	if !isActiveConversation(conv) {
+		return conv, errors.New("会话已解决或已关闭，无法转接")
+	}
+	fromCSID := conv.CustomerServiceID
+	if fromCSID != 0 && fromCSID != requesterID {
+		var requester models.CustomerService
+		if err := db.First(&requester, requesterID).Error; err != nil || !requester.IsAdmin {
+			return conv, errNotConversationOwner
+		}
+	}
+
+	var ma models.MiniApp
+	if err := db.First(&ma, conv.MiniAppID).Error; err != nil {
+		return conv, errors.New("小程序不存在")
+	}
+	if toCSID == 0 {
+		toCSID = routeNewChat(db, ma, conv.UserID, fromCSID)
+		if toCSID == 0 {
+			return conv, errors.New("团队中暂无可接待的客服")
+		}
+	} else {
+		var assignment models.Assignment
+		if err := db.Where("mini_app_id = ? AND customer_service_id = ?", conv.MiniAppID, toCSID).First(&assignment).Error; err != nil {
+			return conv, errors.New("目标客服不在该小程序的客服团队中")
+		}
+	}
+	if toCSID == conv.CustomerServiceID {
+		return conv, errors.New("会话已由该客服接待")
+	}
+
+	var toCS models.CustomerService
+	if err := db.First(&toCS, toCSID).Error; err != nil {
+		return conv, errors.New("目标客服不存在")
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&conv).Updates(map[string]interface{}{
+			"customer_service_id": toCSID,
+			"status":              models.ConversationAssigned,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.ConversationTransfer{
+			ConversationID:  conv.ID,
+			FromCSID:        fromCSID,
+			ToCSID:          toCSID,
+			RequestedByCSID: requesterID,
+			Note:            note,
+		}).Error
+	})
+	if err != nil {
+		return conv, err
+	}
+	conv.CustomerServiceID = toCSID
+	conv.Status = models.ConversationAssigned
+
+	// 在聊天记录中添加系统消息（用户可见，不含交接备注）
+	sysMsg := models.Message{
+		UserID:            conv.UserID,
+		CustomerServiceID: toCSID,
+		ConversationID:    conv.ID,
+		Content:           "会话已转接至客服 " + toCS.Name,
+		FromUser:          false,
+		IsSystem:          true,
+	}
+	db.Create(&sysMsg)
+
+	for _, target := range []struct {
+		csID      uint
+		direction string
+	}{{fromCSID, "out"}, {toCSID, "in"}} {
+		if target.csID == 0 {
+			continue
+		}
+		notifyCS(target.csID, wsEvent{Type: "transfer", Data: transferEvent{
+			Conversation: conv,
+			FromCSID:     fromCSID,
+			ToCSID:       toCSID,
+			RequestedBy:  requesterID,
+			Note:         note,
+			Direction:    target.direction,
+		}})
+		notifyCS(target.csID, sysMsg)
+	}
+	if fromCSID != 0 {
+		dispatchForAgent(db, fromCSID)
+	}
+	return conv, nil
+}
+
+// transferConversationHandler 客服转接会话
+func transferConversationHandler(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		CustomerServiceID uint   `json:"CustomerServiceID"` // 发起转接的客服
+		ToCSID            uint   `json:"ToCSID"`            // 接手客服，为 0 时转给团队中其他可接待的客服
+		Note              string `json:"Note"`              // 交接备注
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.CustomerServiceID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	conv, ok := loadAgentConversation(c, db, req.CustomerServiceID)
+	if !ok {
+		return
+	}
+
+	conv, err := transferConversation(db, conv, req.CustomerServiceID, req.ToCSID, req.Note)
+	if err == errNotConversationOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "转接成功", "conversation": conv})
+}
+
+// getConversationTransfers 获取会话的转接记录（含交接备注），只有该小程序的客服团队成员和管理员可以查看
+func getConversationTransfers(c *gin.Context, db *gorm.DB) {
+	var cs models.CustomerService
+	if err := db.First(&cs, parseUint(c.Param("csId"))).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "客服不存在"})
+		return
+	}
+	var conv models.Conversation
+	if cs.IsAdmin {
+		if err := db.First(&conv, parseUint(c.Param("id"))).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+			return
+		}
+	} else {
+		var ok bool
+		if conv, ok = loadAgentConversation(c, db, cs.ID); !ok {
+			return
+		}
+	}
+	var transfers []models.ConversationTransfer
+	db.Where("conversation_id = ?", conv.ID).Order("id ASC").Find(&transfers)
+	c.JSON(http.StatusOK, transfers)
+}
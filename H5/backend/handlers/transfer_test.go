@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"h5-backend/models"
+)
+
+func TestGetConversationTransfersAccess(t *testing.T) {
+	db := newTestDB(t, &models.CustomerService{}, &models.Assignment{}, &models.Conversation{}, &models.ConversationTransfer{})
+	db.Create(&models.CustomerService{Name: "团队成员"})
+	db.Create(&models.CustomerService{Name: "其他客服"})
+	db.Create(&models.CustomerService{Name: "管理员", IsAdmin: true})
+	db.Create(&models.Assignment{MiniAppID: 1, CustomerServiceID: 1})
+	db.Create(&models.Conversation{UserID: 1, MiniAppID: 1, CustomerServiceID: 1})
+	db.Create(&models.ConversationTransfer{ConversationID: 1, FromCSID: 1, ToCSID: 1, Note: "内部交接备注"})
+
+	tests := []struct {
+		name       string
+		csID, conv string
+		wantStatus int
+	}{
+		{"团队成员", "1", "1", http.StatusOK},
+		{"不在团队中的客服", "2", "1", http.StatusForbidden},
+		{"管理员", "3", "1", http.StatusOK},
+		{"客服不存在", "9", "1", http.StatusNotFound},
+		{"会话不存在", "1", "9", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest("GET", "/chat/cs/"+tt.csID+"/conversation/"+tt.conv+"/transfers", nil)
+		c.Params = gin.Params{{Key: "csId", Value: tt.csID}, {Key: "id", Value: tt.conv}}
+		getConversationTransfers(c, db)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d，want %d", tt.name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Code == http.StatusOK {
+			var list []models.ConversationTransfer
+			json.Unmarshal(rec.Body.Bytes(), &list)
+			if len(list) != 1 {
+				t.Errorf("%s: 转接记录 %d 条，want 1", tt.name, len(list))
+			}
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif" // 注册 GIF 解码
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+// 上传文件类型
+const (
+	UploadImage = "image"
+	UploadVoice = "voice"
+	UploadVideo = "video"
+	UploadFile  = "file"
+)
+
+// 上传错误码，客户端可据此提示用户
+const (
+	UploadErrNoFile      = "NO_FILE"
+	UploadErrInvalidKind = "INVALID_KIND"
+	UploadErrTooLarge    = "FILE_TOO_LARGE"
+	UploadErrType        = "UNSUPPORTED_TYPE"
+	UploadErrCorrupt     = "CORRUPT_FILE"
+	UploadErrStorage     = "STORAGE_ERROR"
+	UploadErrChecksum    = "CHECKSUM_MISMATCH"
+)
+
+// uploadType 允许上传的文件格式。扩展名由服务端按检测到的格式决定，不使用客户端文件名中的扩展名；
+// inline 的格式在浏览器中直接显示，其他格式访问时强制下载
+type uploadType struct {
+	mime   string
+	ext    string
+	inline bool
+	kinds  []string
+}
+
+var uploadTypes = []uploadType{
+	{"image/jpeg", ".jpg", true, []string{UploadImage, UploadFile}},
+	{"image/png", ".png", true, []string{UploadImage, UploadFile}},
+	{"image/gif", ".gif", true, []string{UploadImage, UploadFile}},
+	{"image/webp", ".webp", true, []string{UploadImage, UploadFile}},
+	{"audio/mpeg", ".mp3", true, []string{UploadVoice, UploadFile}},
+	{"audio/aac", ".aac", true, []string{UploadVoice, UploadFile}},
+	{"audio/x-m4a", ".m4a", true, []string{UploadVoice, UploadFile}},
+	{"audio/mp4", ".m4a", true, []string{UploadVoice, UploadFile}},
+	{"audio/amr", ".amr", false, []string{UploadVoice, UploadFile}},
+	{"audio/wav", ".wav", true, []string{UploadVoice, UploadFile}},
+	{"video/mp4", ".mp4", true, []string{UploadVideo, UploadFile}},
+	{"video/quicktime", ".mov", true, []string{UploadVideo, UploadFile}},
+	{"video/webm", ".webm", true, []string{UploadVideo, UploadFile}},
+	{"application/pdf", ".pdf", false, []string{UploadFile}},
+	{"application/msword", ".doc", false, []string{UploadFile}},
+	{"application/vnd.ms-excel", ".xls", false, []string{UploadFile}},
+	{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx", false, []string{UploadFile}},
+	{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx", false, []string{UploadFile}},
+	{"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx", false, []string{UploadFile}},
+	{"application/zip", ".zip", false, []string{UploadFile}},
+	{"text/plain", ".txt", false, []string{UploadFile}},
+}
+
+// maxUploadSize 各类型的大小上限（MB），可通过 UPLOAD_MAX_IMAGE_MB 等环境变量调整
+func maxUploadSize(kind string) int64 {
+	defaults := map[string]float64{UploadImage: 10, UploadVoice: 5, UploadVideo: 100, UploadFile: 20}
+	def, ok := defaults[kind]
+	if !ok {
+		return 0
+	}
+	return int64(envFloat("UPLOAD_MAX_"+strings.ToUpper(kind)+"_MB", def) * 1024 * 1024)
+}
+
+// maxImagePixels 图片像素上限，防止解压炸弹。处理时需要解码后的图片和一份旋转后的 NRGBA（每像素 4 字节），
+// 2500 万像素约占 150MB
+const maxImagePixels = 25 * 1000 * 1000
+
+// uploadError 带错误码的上传错误
+type uploadError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *uploadError) Error() string { return e.msg }
+
+func uploadFail(status int, code, format string, args ...interface{}) *uploadError {
+	return &uploadError{status: status, code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeUploadError 返回上传错误及错误码
+func writeUploadError(c *gin.Context, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		c.JSON(ue.status, gin.H{"error": ue.msg, "code": ue.code})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": UploadErrStorage})
+}
+
+// detectUploadType 按文件内容识别格式，并检查是否允许作为 kind 上传
+func detectUploadType(head []byte, kind string) (uploadType, error) {
+	detected := mimetype.Detect(head)
+	for _, t := range uploadTypes {
+		if !detected.Is(t.mime) {
+			continue
+		}
+		for _, k := range t.kinds {
+			if k == kind {
+				return t, nil
+			}
+		}
+	}
+	return uploadType{}, uploadFail(http.StatusUnsupportedMediaType, UploadErrType, "不支持的文件格式: %s", detected.String())
+}
+
+// uploadTypeByExt 按扩展名查找格式，用于访问文件时设置响应头
+func uploadTypeByExt(ext string) (uploadType, bool) {
+	ext = strings.ToLower(ext)
+	for _, t := range uploadTypes {
+		if t.ext == ext {
+			return t, true
+		}
+	}
+	return uploadType{}, false
+}
+
+// markupSignatures 出现在图片开头说明可能是 HTML/脚本与图片的混合文件（polyglot）
+var markupSignatures = [][]byte{[]byte("<html"), []byte("<script"), []byte("<svg"), []byte("<?php"), []byte("<!doctype")}
+
+// validateImage 完整解码图片，拒绝损坏、像素过大或混入 HTML 的文件，返回解码后的图片
+func validateImage(data []byte) (image.Image, error) {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	lower := bytes.ToLower(head)
+	for _, sig := range markupSignatures {
+		if bytes.Contains(lower, sig) {
+			return nil, uploadFail(http.StatusUnprocessableEntity, UploadErrCorrupt, "图片文件包含非法内容")
+		}
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, uploadFail(http.StatusUnprocessableEntity, UploadErrCorrupt, "图片文件已损坏")
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, uploadFail(http.StatusUnprocessableEntity, UploadErrCorrupt, "图片尺寸过大（%dx%d）", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, uploadFail(http.StatusUnprocessableEntity, UploadErrCorrupt, "图片文件已损坏")
+	}
+	return img, nil
+}
+
+// uploadedFile 校验并保存后的文件
+type uploadedFile struct {
+	ID       uint   `json:"id"` // 文件记录 ID
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	Kind     string `json:"kind"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Name     string `json:"name"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+
+	// 图片处理结果（kind 为 image 时）
+	DisplayURL string `json:"displayUrl,omitempty"`
+	ThumbURL   string `json:"thumbUrl,omitempty"`
+	Blurhash   string `json:"blurhash,omitempty"`
+}
+
+// response 上传接口返回的文件信息
+func (f uploadedFile) response() gin.H {
+	return gin.H{
+		"id":         f.ID,
+		"url":        f.URL,
+		"signedUrl":  mediaURL(f.URL),
+		"key":        f.Key,
+		"kind":       f.Kind,
+		"mimeType":   f.MimeType,
+		"size":       f.Size,
+		"name":       f.Name,
+		"width":      f.Width,
+		"height":     f.Height,
+		"displayUrl": f.DisplayURL,
+		"thumbUrl":   f.ThumbURL,
+		"blurhash":   f.Blurhash,
+	}
+}
+
+// saveUpload 校验文件大小和内容后保存到存储后端并记录文件。内容相同的文件只保存一份，直接返回已有的记录
+func saveUpload(c *gin.Context, db *gorm.DB, fh *multipart.FileHeader, kind string) (uploadedFile, error) {
+	out := uploadedFile{Kind: kind, Name: path.Base(strings.ReplaceAll(fh.Filename, "\\", "/"))}
+	limit := maxUploadSize(kind)
+	if fh.Size > limit {
+		return out, uploadFail(http.StatusRequestEntityTooLarge, UploadErrTooLarge, "文件不能超过 %d MB", limit/1024/1024)
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return out, uploadFail(http.StatusBadRequest, UploadErrNoFile, "读取文件失败")
+	}
+	defer src.Close()
+
+	uploaderType, uploaderID := uploaderFromRequest(c, db)
+	a := models.Attachment{Kind: kind, Size: fh.Size, Name: out.Name, UploaderType: uploaderType, UploaderID: uploaderID}
+	return storeUpload(c.Request.Context(), db, src, a, "")
+}
+
+// storeUpload 校验并保存 a.Size 字节的文件内容，a 中需填好类型、文件名和上传者。
+// checksum 不为空时校验内容的 SHA-256，不一致时不保存
+func storeUpload(ctx context.Context, db *gorm.DB, src io.Reader, a models.Attachment, checksum string) (uploadedFile, error) {
+	out := uploadedFile{Kind: a.Kind, Name: a.Name}
+	kind := a.Kind
+	verify := func(hash string) error {
+		if checksum != "" && !strings.EqualFold(hash, checksum) {
+			return uploadFail(http.StatusUnprocessableEntity, UploadErrChecksum, "文件校验值不一致")
+		}
+		return nil
+	}
+
+	// 按文件开头识别格式；图片需要完整解码校验，读入内存，其他类型流式保存
+	head := make([]byte, 3072)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return out, uploadFail(http.StatusBadRequest, UploadErrNoFile, "读取文件失败: %v", err)
+	}
+	if n == 0 {
+		return out, uploadFail(http.StatusBadRequest, UploadErrNoFile, "文件为空")
+	}
+	head = head[:n]
+	t, err := detectUploadType(head, kind)
+	if err != nil {
+		return out, err
+	}
+	a.MimeType = t.mime
+	body := io.LimitReader(io.MultiReader(bytes.NewReader(head), src), maxUploadSize(kind))
+	if strings.HasPrefix(t.mime, "image/") {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return out, uploadFail(http.StatusBadRequest, UploadErrNoFile, "读取文件失败: %v", err)
+		}
+		sum := sha256.Sum256(data)
+		a.Hash = hex.EncodeToString(sum[:])
+		if err := verify(a.Hash); err != nil {
+			return out, err
+		}
+		if existing, ok := reuseAttachment(ctx, db, a.Hash, kind); ok {
+			return attachmentFile(existing, out.Name), nil
+		}
+		img, err := validateImage(data)
+		if err != nil {
+			return out, err
+		}
+		if kind == UploadImage {
+			return saveImageUpload(ctx, db, a, data, img)
+		}
+		b := img.Bounds()
+		a.Width, a.Height = b.Dx(), b.Dy()
+		body, a.Size = bytes.NewReader(data), int64(len(data))
+	}
+
+	// 其他文件边保存边计算哈希，保存后发现重复再删除本次写入的文件
+	h := sha256.New()
+	a.Key = newMediaKey(t.ext)
+	opts := storage.PutOptions{ContentType: t.mime}
+	if !t.inline {
+		opts.ContentDisposition = "attachment"
+	}
+	if err := store.Put(ctx, a.Key, io.TeeReader(body, h), a.Size, opts); err != nil {
+		log.Printf("[上传] 保存文件失败，key=%s, error=%v", a.Key, err)
+		return out, uploadFail(http.StatusInternalServerError, UploadErrStorage, "保存文件失败")
+	}
+	if a.Hash == "" {
+		a.Hash = hex.EncodeToString(h.Sum(nil))
+		if err := verify(a.Hash); err != nil {
+			deleteAttachmentObjects(ctx, a)
+			return out, err
+		}
+		if existing, ok := reuseAttachment(ctx, db, a.Hash, kind); ok {
+			deleteAttachmentObjects(ctx, a)
+			return attachmentFile(existing, out.Name), nil
+		}
+	}
+	a, err = saveAttachment(ctx, db, a)
+	if err != nil {
+		return out, err
+	}
+	return attachmentFile(a, out.Name), nil
+}
+
+// saveImageUpload 保存处理后的图片：去除元数据的原图、显示图和缩略图，文件名为 {key}、{key}_display、{key}_thumb
+func saveImageUpload(ctx context.Context, db *gorm.DB, a models.Attachment, data []byte, img image.Image) (uploadedFile, error) {
+	out := uploadedFile{Kind: a.Kind, Name: a.Name}
+	p, err := processImage(data, a.MimeType, img)
+	if err != nil {
+		return out, uploadFail(http.StatusUnprocessableEntity, UploadErrCorrupt, "图片处理失败: %v", err)
+	}
+	base := newMediaKey("")
+	put := func(suffix string, img encodedImage) (string, error) {
+		key := base + suffix + img.ext
+		if err := store.Put(ctx, key, bytes.NewReader(img.data), int64(len(img.data)), storage.PutOptions{ContentType: img.mime}); err != nil {
+			log.Printf("[上传] 保存图片失败，key=%s, error=%v", key, err)
+			return "", uploadFail(http.StatusInternalServerError, UploadErrStorage, "保存文件失败")
+		}
+		return key, nil
+	}
+
+	if a.Key, err = put("", p.original); err != nil {
+		return out, err
+	}
+	if len(p.display.data) > 0 {
+		if a.DisplayKey, err = put("_display", p.display); err != nil {
+			deleteAttachmentObjects(ctx, a)
+			return out, err
+		}
+	}
+	if a.ThumbKey, err = put("_thumb", p.thumb); err != nil {
+		deleteAttachmentObjects(ctx, a)
+		return out, err
+	}
+	a.MimeType = p.original.mime
+	a.Size = int64(len(p.original.data))
+	a.Width, a.Height = p.width, p.height
+	a.Blurhash = p.blurhash
+	if a, err = saveAttachment(ctx, db, a); err != nil {
+		return out, err
+	}
+	return attachmentFile(a, a.Name), nil
+}
+
+// uploadFile 上传图片、语音、视频或文件（POST /chat/upload）。
+// 兼容旧版客户端的 image 字段；新版使用 file 字段并通过 kind 指定类型。
+// 返回的 url 用于发送消息，私有模式下 signedUrl 为临时访问地址
+func uploadFile(c *gin.Context, db *gorm.DB) {
+	var maxSize int64
+	for _, k := range []string{UploadImage, UploadVoice, UploadVideo, UploadFile} {
+		if s := maxUploadSize(k); s > maxSize {
+			maxSize = s
+		}
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1024*1024)
+
+	kind := c.DefaultPostForm("kind", UploadImage)
+	fh, err := c.FormFile("file")
+	if err != nil {
+		fh, err = c.FormFile("image")
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "文件过大", "code": UploadErrTooLarge})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请选择文件", "code": UploadErrNoFile})
+		return
+	}
+	if maxUploadSize(kind) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的上传类型: " + kind, "code": UploadErrInvalidKind})
+		return
+	}
+
+	file, err := saveUpload(c, db, fh, kind)
+	if err != nil {
+		writeUploadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file.response())
+}
+
@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+// 分片上传错误码
+const (
+	UploadErrSession    = "SESSION_NOT_FOUND"
+	UploadErrOffset     = "OFFSET_MISMATCH"
+	UploadErrIncomplete = "UPLOAD_INCOMPLETE"
+	UploadErrChunkSize  = "INVALID_CHUNK_SIZE"
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// errOffsetChanged 保存分片期间其他请求已写入同一偏移量
+var errOffsetChanged = errors.New("offset changed")
+
+// uploadChunkSize 分片大小，UPLOAD_CHUNK_MB 默认 2MB；除最后一个分片外每个分片必须恰好为该大小，
+// 避免极小的分片产生大量临时文件和记录。分片在服务端读入内存后保存
+func uploadChunkSize() int64 {
+	return int64(envFloat("UPLOAD_CHUNK_MB", 2) * 1024 * 1024)
+}
+
+// uploadSessionTTL 未完成的分片上传保留多久，UPLOAD_SESSION_TTL 默认 24 小时，每次上传分片后顺延
+func uploadSessionTTL() time.Duration {
+	return envDuration("UPLOAD_SESSION_TTL", 24*time.Hour)
+}
+
+// uploadSessionView 分片上传任务的状态，offset 为下一个分片的偏移量
+func uploadSessionView(s models.UploadSession) gin.H {
+	return gin.H{
+		"uploadId":  s.UploadID,
+		"kind":      s.Kind,
+		"name":      s.Name,
+		"size":      s.Size,
+		"offset":    s.Received,
+		"chunkSize": uploadChunkSize(),
+		"status":    s.Status,
+		"expiresAt": s.ExpiresAt,
+	}
+}
+
+// loadUploadSession 按路径中的 uploadId 查找未过期的任务
+func loadUploadSession(c *gin.Context, db *gorm.DB) (models.UploadSession, bool) {
+	var s models.UploadSession
+	if err := db.Where("upload_id = ?", c.Param("uploadId")).First(&s).Error; err != nil || time.Now().After(s.ExpiresAt) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "上传任务不存在或已过期", "code": UploadErrSession})
+		return s, false
+	}
+	return s, true
+}
+
+// createUploadSession 创建分片上传任务（POST /chat/upload/sessions）。
+// sha256 可在创建时提供，也可在完成时提供；上传者与普通上传相同，客服传 csId，小程序用户传 appId 和 openId
+func createUploadSession(c *gin.Context, db *gorm.DB) {
+	var req struct {
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		Size     int64  `json:"size"`
+		Checksum string `json:"sha256"`
+		CSID     uint   `json:"csId"`
+		AppID    string `json:"appId"`
+		OpenID   string `json:"openId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+		return
+	}
+	limit := maxUploadSize(req.Kind)
+	if limit == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的上传类型: " + req.Kind, "code": UploadErrInvalidKind})
+		return
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "文件为空", "code": UploadErrNoFile})
+		return
+	}
+	if req.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("文件不能超过 %d MB", limit/1024/1024), "code": UploadErrTooLarge})
+		return
+	}
+	if req.Checksum != "" && !sha256Hex.MatchString(req.Checksum) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 格式错误"})
+		return
+	}
+
+	s := models.UploadSession{
+		UploadID:  uuid.New().String(),
+		Kind:      req.Kind,
+		Name:      truncateRunes(path.Base(strings.ReplaceAll(req.Name, "\\", "/")), 255),
+		Size:      req.Size,
+		Checksum:  strings.ToLower(req.Checksum),
+		Status:    models.UploadSessionUploading,
+		ExpiresAt: time.Now().Add(uploadSessionTTL()),
+	}
+	s.UploaderType, s.UploaderID = findUploader(db, req.CSID, req.AppID, req.OpenID)
+	if err := db.Create(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建上传任务失败"})
+		return
+	}
+	c.JSON(http.StatusOK, uploadSessionView(s))
+}
+
+// getUploadSession 查询上传进度（GET /chat/upload/sessions/:uploadId），断线重连后从返回的 offset 继续上传
+func getUploadSession(c *gin.Context, db *gorm.DB) {
+	s, ok := loadUploadSession(c, db)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, uploadSessionView(s))
+}
+
+// uploadPart 上传一个分片（PUT /chat/upload/sessions/:uploadId?offset=N），请求体为分片的原始内容。
+// 分片必须按顺序上传，offset 与已接收的字节数不一致时返回 409 和当前 offset；除最后一个分片外大小必须等于 chunkSize；
+// 可选的 X-Chunk-Sha256 请求头用于校验分片在传输中没有损坏
+func uploadPart(c *gin.Context, db *gorm.DB) {
+	s, ok := loadUploadSession(c, db)
+	if !ok {
+		return
+	}
+	if s.Status != models.UploadSessionUploading {
+		c.JSON(http.StatusConflict, gin.H{"error": "上传任务已完成", "code": UploadErrOffset, "offset": s.Received})
+		return
+	}
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset != s.Received {
+		c.JSON(http.StatusConflict, gin.H{"error": "分片偏移量不一致", "code": UploadErrOffset, "offset": s.Received})
+		return
+	}
+
+	chunkSize := uploadChunkSize()
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, chunkSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "读取分片失败", "code": UploadErrNoFile})
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "分片为空", "code": UploadErrNoFile})
+		return
+	}
+	if int64(len(data)) > chunkSize || offset+int64(len(data)) > s.Size {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "分片过大", "code": UploadErrTooLarge})
+		return
+	}
+	if int64(len(data)) != chunkSize && offset+int64(len(data)) != s.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("除最后一个分片外，分片大小必须为 %d 字节", chunkSize), "code": UploadErrChunkSize, "offset": s.Received})
+		return
+	}
+	if want := c.GetHeader("X-Chunk-Sha256"); want != "" {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), want) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "分片校验值不一致", "code": UploadErrChecksum, "offset": s.Received})
+			return
+		}
+	}
+
+	// 分片保存为临时文件，文件名带随机后缀，避免同一偏移量的重试请求互相覆盖
+	ctx := c.Request.Context()
+	part := models.UploadPart{
+		SessionID: s.ID,
+		Offset:    offset,
+		Size:      int64(len(data)),
+		Key:       fmt.Sprintf("tmp/%s/%d-%s", s.UploadID, offset, uuid.New().String()),
+	}
+	if err := store.Put(ctx, part.Key, bytes.NewReader(data), part.Size, storage.PutOptions{ContentType: "application/octet-stream"}); err != nil {
+		log.Printf("[上传] 保存分片失败，key=%s, error=%v", part.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存分片失败", "code": UploadErrStorage})
+		return
+	}
+
+	// 只有 received 仍等于 offset 时才记录分片，并发重试时只有一个请求成功
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.UploadSession{}).
+			Where("id = ? AND received = ? AND status = ?", s.ID, offset, models.UploadSessionUploading).
+			Updates(map[string]interface{}{"received": gorm.Expr("received + ?", part.Size), "expires_at": time.Now().Add(uploadSessionTTL())})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errOffsetChanged
+		}
+		return tx.Create(&part).Error
+	})
+	if err != nil {
+		store.Delete(ctx, part.Key)
+		db.First(&s, s.ID)
+		if err == errOffsetChanged {
+			c.JSON(http.StatusConflict, gin.H{"error": "分片偏移量不一致", "code": UploadErrOffset, "offset": s.Received})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存分片失败", "code": UploadErrStorage})
+		return
+	}
+	s.Received += part.Size
+	c.JSON(http.StatusOK, uploadSessionView(s))
+}
+
+// completeUploadSession 合并分片并保存文件（POST /chat/upload/sessions/:uploadId/complete）。
+// 必须提供整个文件的 sha256（创建时已提供的可省略），校验通过后与普通上传一样检查格式、去重并处理图片，
+// 返回内容与 /chat/upload 相同。重复调用返回已保存的文件
+func completeUploadSession(c *gin.Context, db *gorm.DB) {
+	s, ok := loadUploadSession(c, db)
+	if !ok {
+		return
+	}
+	var req struct {
+		Checksum string `json:"sha256"`
+	}
+	c.ShouldBindJSON(&req)
+
+	if s.Status == models.UploadSessionCompleted {
+		var a models.Attachment
+		if err := db.First(&a, s.AttachmentID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在", "code": UploadErrSession})
+			return
+		}
+		c.JSON(http.StatusOK, attachmentFile(a, s.Name).response())
+		return
+	}
+
+	checksum := strings.ToLower(req.Checksum)
+	if checksum == "" {
+		checksum = s.Checksum
+	}
+	if !sha256Hex.MatchString(checksum) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请提供文件的 sha256 校验值"})
+		return
+	}
+	if s.Checksum != "" && checksum != s.Checksum {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "文件校验值与创建任务时不一致", "code": UploadErrChecksum})
+		return
+	}
+
+	var parts []models.UploadPart
+	db.Where("session_id = ?", s.ID).Order("`offset`").Find(&parts)
+	next := int64(0)
+	for _, p := range parts {
+		if p.Offset != next {
+			break
+		}
+		next += p.Size
+	}
+	if s.Received != s.Size || next != s.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": "文件尚未上传完成", "code": UploadErrIncomplete, "offset": s.Received})
+		return
+	}
+
+	ctx := c.Request.Context()
+	src := &partsReader{ctx: ctx, parts: parts}
+	a := models.Attachment{Kind: s.Kind, Size: s.Size, Name: s.Name, UploaderType: s.UploaderType, UploaderID: s.UploaderID}
+	file, err := storeUpload(ctx, db, src, a, checksum)
+	src.Close()
+	if err != nil {
+		// 内容校验不通过时分片已无法使用，删除任务，客户端需要重新上传
+		if ue, ok := err.(*uploadError); ok && ue.code != UploadErrStorage {
+			discardUploadSession(ctx, db, s)
+		}
+		writeUploadError(c, err)
+		return
+	}
+
+	// 保留记录到过期，客户端没收到响应而重试时返回同一个文件
+	db.Model(&s).Updates(map[string]interface{}{"status": models.UploadSessionCompleted, "attachment_id": file.ID, "expires_at": time.Now().Add(uploadSessionTTL())})
+	deleteUploadParts(ctx, db, s.ID)
+	c.JSON(http.StatusOK, file.response())
+}
+
+// abortUploadSession 取消上传并删除已上传的分片（DELETE /chat/upload/sessions/:uploadId）
+func abortUploadSession(c *gin.Context, db *gorm.DB) {
+	s, ok := loadUploadSession(c, db)
+	if !ok {
+		return
+	}
+	discardUploadSession(c.Request.Context(), db, s)
+	c.JSON(http.StatusOK, gin.H{"message": "已取消上传"})
+}
+
+// partsReader 按顺序读取各分片的临时文件
+type partsReader struct {
+	ctx   context.Context
+	parts []models.UploadPart
+	cur   io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			rc, _, err := store.Get(r.ctx, r.parts[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.parts = rc, r.parts[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// deleteUploadParts 删除任务的分片文件和记录
+func deleteUploadParts(ctx context.Context, db *gorm.DB, sessionID uint) {
+	var parts []models.UploadPart
+	db.Where("session_id = ?", sessionID).Find(&parts)
+	for _, p := range parts {
+		if err := store.Delete(ctx, p.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("[上传] 删除分片失败，key=%s, error=%v", p.Key, err)
+		}
+	}
+	db.Where("session_id = ?", sessionID).Delete(&models.UploadPart{})
+}
+
+// discardUploadSession 删除任务及其分片。先删除任务记录，多实例同时清理时只有一个实例删除分片
+func discardUploadSession(ctx context.Context, db *gorm.DB, s models.UploadSession) {
+	if res := db.Unscoped().Delete(&models.UploadSession{}, s.ID); res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	deleteUploadParts(ctx, db, s.ID)
+}
+
+// collectUploadSessions 删除过期的上传任务：未完成的任务删除分片，已完成的只删除记录。返回清理的数量
+func collectUploadSessions(db *gorm.DB) int {
+	now := time.Now()
+	count := 0
+	lastID := uint(0)
+	for {
+		var sessions []models.UploadSession
+		db.Where("id > ? AND expires_at < ?", lastID, now).Order("id").Limit(500).Find(&sessions)
+		for _, s := range sessions {
+			lastID = s.ID
+			discardUploadSession(context.Background(), db, s)
+		}
+		count += len(sessions)
+		if len(sessions) < 500 {
+			return count
+		}
+	}
+}
+
+// startUploadSessionCleanup 每小时清理过期的上传任务
+func startUploadSessionCleanup(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := collectUploadSessions(db); n > 0 {
+				log.Printf("[上传] 已清理 %d 个过期的上传任务", n)
+			}
+		}
+	}()
+}
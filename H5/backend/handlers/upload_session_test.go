@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+func TestCollectUploadSessions(t *testing.T) {
+	db := setupUploadStore(t)
+	db.AutoMigrate(&models.UploadSession{}, &models.UploadPart{})
+
+	// 超过两批的过期任务，以及尚未过期的任务
+	expired, active := 1203, 3
+	var sessions []models.UploadSession
+	for i := 0; i < expired+active; i++ {
+		s := models.UploadSession{UploadID: fmt.Sprintf("u-%d", i), ExpiresAt: time.Now().Add(-time.Hour)}
+		if i >= expired {
+			s.ExpiresAt = time.Now().Add(time.Hour)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := db.CreateInBatches(&sessions, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 最后一个过期任务和第一个未过期任务各有一个分片
+	var keys []string
+	for _, s := range []models.UploadSession{sessions[expired-1], sessions[expired]} {
+		key := fmt.Sprintf("parts/%d", s.ID)
+		if err := store.Put(t.Context(), key, bytes.NewReader([]byte("part")), 4, storage.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		db.Create(&models.UploadPart{SessionID: s.ID, Size: 4, Key: key})
+		keys = append(keys, key)
+	}
+
+	if n := collectUploadSessions(db); n != expired {
+		t.Errorf("collectUploadSessions = %d, want %d", n, expired)
+	}
+	var left int64
+	db.Model(&models.UploadSession{}).Count(&left)
+	if left != int64(active) {
+		t.Errorf("剩余任务 %d，want %d", left, active)
+	}
+	if _, err := store.Stat(t.Context(), keys[0]); err == nil {
+		t.Error("过期任务的分片应被删除")
+	}
+	if _, err := store.Stat(t.Context(), keys[1]); err != nil {
+		t.Errorf("未过期任务的分片不应删除: %v", err)
+	}
+	var parts int64
+	db.Model(&models.UploadPart{}).Count(&parts)
+	if parts != 1 {
+		t.Errorf("剩余分片 %d，want 1", parts)
+	}
+	if n := collectUploadSessions(db); n != 0 {
+		t.Errorf("再次清理 = %d，want 0", n)
+	}
+}
+
+// sessionRequest 调用分片上传接口，返回状态码和响应内容
+func sessionRequest(t *testing.T, handler func(*gin.Context), method, uploadID, query string, body []byte) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(method, "/chat/upload/sessions/"+uploadID+query, bytes.NewReader(body))
+	c.Params = gin.Params{{Key: "uploadId", Value: uploadID}}
+	handler(c)
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+// newUploadSession 创建分片上传任务，分片大小为 100 字节
+func newUploadSession(t *testing.T, size int, checksum string) (*gorm.DB, string) {
+	t.Helper()
+	t.Setenv("UPLOAD_CHUNK_MB", strconv.FormatFloat(100.0/1024/1024, 'f', -1, 64))
+	db := setupUploadStore(t)
+	db.AutoMigrate(&models.UploadSession{}, &models.UploadPart{})
+	body, _ := json.Marshal(gin.H{"kind": UploadFile, "name": "a.txt", "size": size, "sha256": checksum})
+	code, resp := sessionRequest(t, func(c *gin.Context) { createUploadSession(c, db) }, "POST", "", "", body)
+	if code != http.StatusOK || resp["chunkSize"] != float64(100) {
+		t.Fatalf("创建任务失败: %d %v", code, resp)
+	}
+	return db, resp["uploadId"].(string)
+}
+
+func sha256Of(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadPart(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 25) // 250 字节：100 + 100 + 50
+	db, id := newUploadSession(t, len(content), "")
+	put := func(offset int, data []byte) (int, map[string]interface{}) {
+		return sessionRequest(t, func(c *gin.Context) { uploadPart(c, db) }, "PUT", id, "?offset="+strconv.Itoa(offset), data)
+	}
+
+	steps := []struct {
+		name       string
+		offset     int
+		data       []byte
+		wantStatus int
+		wantCode   string
+		wantOffset float64
+	}{
+		{"偏移量不是 0", 100, content[100:200], http.StatusConflict, UploadErrOffset, 0},
+		{"分片小于 chunkSize", 0, content[:1], http.StatusBadRequest, UploadErrChunkSize, 0},
+		{"分片大于 chunkSize", 0, content[:101], http.StatusRequestEntityTooLarge, UploadErrTooLarge, 0},
+		{"第一个分片", 0, content[:100], http.StatusOK, "", 100},
+		{"重试已接收的分片", 0, content[:100], http.StatusConflict, UploadErrOffset, 100},
+		{"跳过分片", 200, content[200:], http.StatusConflict, UploadErrOffset, 100},
+		{"第二个分片", 100, content[100:200], http.StatusOK, "", 200},
+		{"最后一个分片超出文件大小", 200, append(append([]byte{}, content[200:]...), 'x'), http.StatusRequestEntityTooLarge, UploadErrTooLarge, 0},
+		{"最后一个分片可以小于 chunkSize", 200, content[200:], http.StatusOK, "", 250},
+	}
+	for _, st := range steps {
+		status, resp := put(st.offset, st.data)
+		if status != st.wantStatus || (st.wantCode != "" && resp["code"] != st.wantCode) {
+			t.Fatalf("%s: status %d %v，want %d %s", st.name, status, resp, st.wantStatus, st.wantCode)
+		}
+		if st.wantOffset != 0 && resp["offset"] != st.wantOffset {
+			t.Errorf("%s: offset %v，want %v", st.name, resp["offset"], st.wantOffset)
+		}
+	}
+
+	var parts []models.UploadPart
+	db.Order("`offset`").Find(&parts)
+	if len(parts) != 3 || parts[0].Size != 100 || parts[2].Offset != 200 || parts[2].Size != 50 {
+		t.Errorf("分片记录 %+v", parts)
+	}
+	// 被拒绝的请求不应留下临时文件
+	var files int
+	store.(*storage.Local).Walk(func(key string, info storage.ObjectInfo) error {
+		files++
+		return nil
+	})
+	if files != 3 {
+		t.Errorf("临时文件 %d 个，want 3", files)
+	}
+}
+
+func TestCompleteUploadSession(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 15) // 150 字节
+	db, id := newUploadSession(t, len(content), "")
+	put := func(offset int, data []byte) {
+		if status, resp := sessionRequest(t, func(c *gin.Context) { uploadPart(c, db) }, "PUT", id, "?offset="+strconv.Itoa(offset), data); status != http.StatusOK {
+			t.Fatalf("上传分片失败: %d %v", status, resp)
+		}
+	}
+	complete := func(checksum string) (int, map[string]interface{}) {
+		body, _ := json.Marshal(gin.H{"sha256": checksum})
+		return sessionRequest(t, func(c *gin.Context) { completeUploadSession(c, db) }, "POST", id, "", body)
+	}
+
+	put(0, content[:100])
+	if status, resp := complete(sha256Of(content)); status != http.StatusConflict || resp["code"] != UploadErrIncomplete || resp["offset"] != float64(100) {
+		t.Fatalf("未上传完成: %d %v", status, resp)
+	}
+	if status, _ := complete(""); status != http.StatusBadRequest {
+		t.Errorf("缺少校验值: status %d，want 400", status)
+	}
+	put(100, content[100:])
+
+	status, first := complete(sha256Of(content))
+	if status != http.StatusOK || first["key"] == nil || first["size"] != float64(len(content)) {
+		t.Fatalf("完成上传: %d %v", status, first)
+	}
+	var parts int64
+	db.Model(&models.UploadPart{}).Count(&parts)
+	if parts != 0 {
+		t.Errorf("完成后应删除分片记录，剩余 %d", parts)
+	}
+
+	// 客户端没收到响应而重试时返回同一个文件
+	status, again := complete("")
+	if status != http.StatusOK || again["key"] != first["key"] || again["id"] != first["id"] {
+		t.Errorf("重复完成: %d %v，want %v", status, again, first)
+	}
+	var count int64
+	db.Model(&models.Attachment{}).Count(&count)
+	if count != 1 {
+		t.Errorf("attachments = %d，want 1", count)
+	}
+}
+
+func TestCompleteUploadSessionChecksum(t *testing.T) {
+	content := []byte("short file")
+	created := sha256Of([]byte("other content"))
+	db, id := newUploadSession(t, len(content), created)
+	sessionRequest(t, func(c *gin.Context) { uploadPart(c, db) }, "PUT", id, "?offset=0", content)
+	complete := func(checksum string) (int, map[string]interface{}) {
+		body, _ := json.Marshal(gin.H{"sha256": checksum})
+		return sessionRequest(t, func(c *gin.Context) { completeUploadSession(c, db) }, "POST", id, "", body)
+	}
+
+	// 与创建时提供的校验值不一致，任务保留
+	if status, resp := complete(sha256Of(content)); status != http.StatusUnprocessableEntity || resp["code"] != UploadErrChecksum {
+		t.Fatalf("校验值与创建时不一致: %d %v", status, resp)
+	}
+	// 内容与校验值不一致，分片无法使用，任务和分片删除
+	if status, resp := complete(""); status != http.StatusUnprocessableEntity || resp["code"] != UploadErrChecksum {
+		t.Fatalf("内容校验失败: %d %v", status, resp)
+	}
+	var sessions, parts, attachments int64
+	db.Model(&models.UploadSession{}).Count(&sessions)
+	db.Model(&models.UploadPart{}).Count(&parts)
+	db.Model(&models.Attachment{}).Count(&attachments)
+	if sessions != 0 || parts != 0 || attachments != 0 {
+		t.Errorf("校验失败后剩余 任务 %d 分片 %d 文件 %d", sessions, parts, attachments)
+	}
+	if status, resp := complete(""); status != http.StatusNotFound || resp["code"] != UploadErrSession {
+		t.Errorf("任务删除后: %d %v", status, resp)
+	}
+}
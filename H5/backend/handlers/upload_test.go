@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"h5-backend/models"
+	"h5-backend/storage"
+)
+
+func pngFixture(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 40), uint8(y * 40), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader 只有文件头和 IHDR 的 PNG，用于构造声明尺寸很大的图片
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8], ihdr[9] = 8, 6 // 8 位 RGBA
+	chunk := append([]byte("IHDR"), ihdr...)
+	var buf bytes.Buffer
+	buf.Write([]byte("\x89PNG\r\n\x1a\n"))
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func uploadCode(err error) string {
+	if ue, ok := err.(*uploadError); ok {
+		return ue.code
+	}
+	return ""
+}
+
+func TestDetectUploadType(t *testing.T) {
+	pngData := pngFixture(t, 2, 2)
+	tests := []struct {
+		name     string
+		data     []byte
+		kind     string
+		wantExt  string
+		wantCode string
+	}{
+		{"PNG 图片", pngData, UploadImage, ".png", ""},
+		{"PNG 作为文件", pngData, UploadFile, ".png", ""},
+		{"PNG 不能作为视频", pngData, UploadVideo, "", UploadErrType},
+		{"PDF", []byte("%PDF-1.4\n%âãÏÓ\n1 0 obj\n"), UploadFile, ".pdf", ""},
+		{"PDF 不能作为图片", []byte("%PDF-1.4\n"), UploadImage, "", UploadErrType},
+		{"纯文本", []byte("hello world\n"), UploadFile, ".txt", ""},
+		{"HTML", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), UploadFile, "", UploadErrType},
+		{"SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"></svg>`), UploadImage, "", UploadErrType},
+		{"PHP", []byte("<?php echo 1; ?>"), UploadFile, "", UploadErrType},
+		{"Windows 可执行文件", append([]byte("MZ\x90\x00\x03\x00\x00\x00"), make([]byte, 64)...), UploadFile, "", UploadErrType},
+		{"ELF 可执行文件", append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 64)...), UploadFile, "", UploadErrType},
+	}
+	for _, tt := range tests {
+		got, err := detectUploadType(tt.data, tt.kind)
+		if code := uploadCode(err); code != tt.wantCode {
+			t.Errorf("%s: code = %q (%v), want %q", tt.name, code, err, tt.wantCode)
+			continue
+		}
+		if err == nil && got.ext != tt.wantExt {
+			t.Errorf("%s: ext = %q, want %q", tt.name, got.ext, tt.wantExt)
+		}
+	}
+}
+
+func TestUploadTypeByExt(t *testing.T) {
+	tests := []struct {
+		ext        string
+		wantOK     bool
+		wantInline bool
+	}{
+		{".png", true, true},
+		{".PNG", true, true},
+		{".mp4", true, true},
+		{".pdf", true, false},
+		{".txt", true, false},
+		{".html", false, false},
+		{".svg", false, false},
+		{".php", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		got, ok := uploadTypeByExt(tt.ext)
+		if ok != tt.wantOK || got.inline != tt.wantInline {
+			t.Errorf("uploadTypeByExt(%q) = inline %v, ok %v; want inline %v, ok %v", tt.ext, got.inline, ok, tt.wantInline, tt.wantOK)
+		}
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	pngData := pngFixture(t, 4, 3)
+	gifPolyglot := append([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), []byte("<script>alert(1)</script>")...)
+	pngWithHTML := append(append([]byte{}, pngData[:33]...), []byte("<HTML><body>x</body></HTML>")...)
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCode string
+	}{
+		{"正常图片", pngData, ""},
+		{"GIF 混入脚本", gifPolyglot, UploadErrCorrupt},
+		{"PNG 混入 HTML（大写）", pngWithHTML, UploadErrCorrupt},
+		{"截断的图片", pngData[:len(pngData)/2], UploadErrCorrupt},
+		{"像素过多", pngHeader(10000, 10000), UploadErrCorrupt},
+		{"超过 2500 万像素", pngHeader(6000, 5000), UploadErrCorrupt},
+		{"尺寸为零", pngHeader(0, 10), UploadErrCorrupt},
+		{"不是图片", []byte("not an image at all"), UploadErrCorrupt},
+	}
+	for _, tt := range tests {
+		img, err := validateImage(tt.data)
+		if code := uploadCode(err); code != tt.wantCode {
+			t.Errorf("%s: code = %q (%v), want %q", tt.name, code, err, tt.wantCode)
+			continue
+		}
+		if err == nil && (img.Bounds().Dx() != 4 || img.Bounds().Dy() != 3) {
+			t.Errorf("%s: bounds = %v", tt.name, img.Bounds())
+		}
+	}
+}
+
+// setupUploadStore 使用临时目录作为存储后端
+func setupUploadStore(t *testing.T) *gorm.DB {
+	t.Helper()
+	local, err := storage.NewLocal(t.TempDir(), "http://test.local", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := store
+	store = local
+	t.Cleanup(func() { store = prev })
+	return newTestDB(t, &models.Attachment{}, &models.CustomerService{}, &models.User{}, &models.MiniApp{})
+}
+
+// postUpload 以 multipart 表单调用上传接口
+func postUpload(t *testing.T, db *gorm.DB, field, filename, kind string, data []byte) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if kind != "" {
+		w.WriteField("kind", kind)
+	}
+	fw, _ := w.CreateFormFile(field, filename)
+	fw.Write(data)
+	w.Close()
+
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest("POST", "/chat/upload", &body)
+	c.Request.Header.Set("Content-Type", w.FormDataContentType())
+	uploadFile(c, db)
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestUploadFileForcesExtension(t *testing.T) {
+	db := setupUploadStore(t)
+	tests := []struct {
+		name     string
+		filename string
+		kind     string
+		data     []byte
+		wantExt  string
+	}{
+		{"图片伪装成 PHP", "shell.php", UploadFile, pngFixture(t, 8, 8), ".png"},
+		{"PNG 图片保持 PNG", "photo.php", UploadImage, pngFixture(t, 8, 8), ".png"},
+		{"文本伪装成 HTML", "page.html", UploadFile, []byte("just some text\n"), ".txt"},
+		{"没有扩展名", "noext", UploadFile, []byte("%PDF-1.4\n%âãÏÓ\n"), ".pdf"},
+	}
+	for _, tt := range tests {
+		rec, resp := postUpload(t, db, "file", tt.filename, tt.kind, tt.data)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, body %s", tt.name, rec.Code, rec.Body.String())
+			continue
+		}
+		key, _ := resp["key"].(string)
+		if path.Ext(key) != tt.wantExt {
+			t.Errorf("%s: key = %q, want extension %q", tt.name, key, tt.wantExt)
+		}
+		if strings.Contains(key, tt.filename) {
+			t.Errorf("%s: key %q 不应包含客户端文件名", tt.name, key)
+		}
+		if _, err := store.Stat(t.Context(), key); err != nil {
+			t.Errorf("%s: 文件未保存: %v", tt.name, err)
+		}
+	}
+}
+
+func TestUploadFileRejects(t *testing.T) {
+	db := setupUploadStore(t)
+	t.Setenv("UPLOAD_MAX_FILE_MB", "0.001") // 约 1KB
+
+	tests := []struct {
+		name       string
+		field      string
+		filename   string
+		kind       string
+		data       []byte
+		wantStatus int
+		wantCode   string
+	}{
+		{"超过大小上限", "file", "big.txt", UploadFile, bytes.Repeat([]byte("a"), 4096), http.StatusRequestEntityTooLarge, UploadErrTooLarge},
+		{"HTML 伪装成图片", "file", "a.png", UploadImage, []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType, UploadErrType},
+		{"混入脚本的 GIF", "image", "a.gif", "", append([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), []byte("<script>x</script>")...), http.StatusUnprocessableEntity, UploadErrCorrupt},
+		{"未知类型", "file", "a.txt", "exe", []byte("hello"), http.StatusBadRequest, UploadErrInvalidKind},
+		{"空文件", "file", "a.txt", UploadFile, nil, http.StatusBadRequest, UploadErrNoFile},
+		{"缺少文件", "other", "a.txt", UploadFile, []byte("hello"), http.StatusBadRequest, UploadErrNoFile},
+	}
+	for _, tt := range tests {
+		rec, resp := postUpload(t, db, tt.field, tt.filename, tt.kind, tt.data)
+		if rec.Code != tt.wantStatus || resp["code"] != tt.wantCode {
+			t.Errorf("%s: status %d code %v, want %d %s", tt.name, rec.Code, resp["code"], tt.wantStatus, tt.wantCode)
+		}
+	}
+	var count int64
+	db.Model(&models.Attachment{}).Count(&count)
+	if count != 0 {
+		t.Errorf("被拒绝的上传不应保存记录，got %d", count)
+	}
+}
+
+func TestUploadFileDeduplicates(t *testing.T) {
+	db := setupUploadStore(t)
+	data := []byte("same content\n")
+	_, first := postUpload(t, db, "file", "a.txt", UploadFile, data)
+	_, second := postUpload(t, db, "file", "b.txt", UploadFile, data)
+	if first["key"] == nil || first["key"] != second["key"] || first["id"] != second["id"] {
+		t.Errorf("相同内容应返回同一个文件: %v %v", first, second)
+	}
+	if second["name"] != "b.txt" {
+		t.Errorf("name = %v, want 本次上传的文件名", second["name"])
+	}
+	var count int64
+	db.Model(&models.Attachment{}).Count(&count)
+	if count != 1 {
+		t.Errorf("attachments = %d, want 1", count)
+	}
+}
+
+func TestStoreUploadChecksum(t *testing.T) {
+	db := setupUploadStore(t)
+	data := []byte("checksum content\n")
+	a := models.Attachment{Kind: UploadFile, Size: int64(len(data)), Name: "a.txt"}
+	wrong := strings.Repeat("0", 64)
+	if _, err := storeUpload(t.Context(), db, bytes.NewReader(data), a, wrong); uploadCode(err) != UploadErrChecksum {
+		t.Fatalf("校验值不一致应失败，got %v", err)
+	}
+	// 校验失败时不应留下文件，同样的内容随后可以正常上传
+	file, err := storeUpload(t.Context(), db, bytes.NewReader(data), a, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(t.Context(), file.Key); err != nil {
+		t.Errorf("文件未保存: %v", err)
+	}
+	var count int64
+	db.Model(&models.Attachment{}).Count(&count)
+	if count != 1 {
+		t.Errorf("attachments = %d, want 1", count)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"h5-backend/models"
+)
+
+// accessTokenCache 各小程序的 access_token 缓存，微信限制每日获取次数，有效期内复用
+var accessTokenCache = struct {
+	sync.Mutex
+	tokens map[string]cachedToken
+}{tokens: make(map[string]cachedToken)}
+
+type cachedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// fetchAccessToken 获取小程序的 access_token，提前 5 分钟过期以免临界时失效
+func fetchAccessToken(ma models.MiniApp) (string, error) {
+	accessTokenCache.Lock()
+	cached, ok := accessTokenCache.tokens[ma.AppID]
+	accessTokenCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	resp, err := http.Get("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" + ma.AppID + "&secret=" + ma.Secret)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		ErrCode     int    `json:"errcode"`
+		ErrMsg      string `json:"errmsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.ErrCode != 0 || tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("errCode=%d, errMsg=%s", tokenResp.ErrCode, tokenResp.ErrMsg)
+	}
+
+	ttl := time.Duration(tokenResp.ExpiresIn)*time.Second - 5*time.Minute
+	if ttl > 0 {
+		accessTokenCache.Lock()
+		accessTokenCache.tokens[ma.AppID] = cachedToken{token: tokenResp.AccessToken, expiresAt: time.Now().Add(ttl)}
+		accessTokenCache.Unlock()
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// invalidateAccessToken access_token 失效（如错误码 40001）时清除缓存，下次重新获取
+func invalidateAccessToken(appID string) {
+	accessTokenCache.Lock()
+	delete(accessTokenCache.tokens, appID)
+	accessTokenCache.Unlock()
+}
+
+// phoneInfo getuserphonenumber 返回的手机号信息
+type phoneInfo struct {
+	PhoneNumber     string `json:"phoneNumber"`
+	PurePhoneNumber string `json:"purePhoneNumber"`
+	CountryCode     string `json:"countryCode"`
+}
+
+// exchangePhoneCode 用小程序 getPhoneNumber 返回的 code 换取用户手机号
+func exchangePhoneCode(ma models.MiniApp, code string) (phoneInfo, error) {
+	var result struct {
+		ErrCode   int       `json:"errcode"`
+		ErrMsg    string    `json:"errmsg"`
+		PhoneInfo phoneInfo `json:"phone_info"`
+	}
+	token, err := fetchAccessToken(ma)
+	if err != nil {
+		return result.PhoneInfo, fmt.Errorf("获取 access_token 失败: %v", err)
+	}
+	body, _ := json.Marshal(map[string]string{"code": code})
+	resp, err := http.Post("https://api.weixin.qq.com/wxa/business/getuserphonenumber?access_token="+token, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return result.PhoneInfo, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result.PhoneInfo, err
+	}
+	if result.ErrCode == 40001 || result.ErrCode == 42001 {
+		invalidateAccessToken(ma.AppID)
+	}
+	if result.ErrCode != 0 {
+		return result.PhoneInfo, fmt.Errorf("errCode=%d, errMsg=%s", result.ErrCode, result.ErrMsg)
+	}
+	return result.PhoneInfo, nil
+}
@@ -20,7 +20,13 @@ func main() {
 	}
 
 	// Auto-migrate models
-	db.AutoMigrate(&models.MiniApp{}, &models.CustomerService{}, &models.Assignment{}, &models.User{}, &models.Message{}, &models.Config{})
+	db.AutoMigrate(&models.MiniApp{}, &models.CustomerService{}, &models.Assignment{}, &models.User{}, &models.Message{}, &models.Config{}, &models.HubEvent{}, &models.Conversation{}, &models.ConversationTransfer{}, &models.BusinessHours{}, &models.BusinessHoliday{}, &models.AutoReplyRule{}, &models.FAQEntry{}, &models.CannedResponse{}, &models.Tag{}, &models.UserTag{}, &models.ConversationTag{}, &models.InternalNote{}, &models.Rating{}, &models.MessageRevision{}, &models.Attachment{}, &models.MessageAttachment{}, &models.UploadSession{}, &models.UploadPart{})
+
+	// 数据迁移（只执行一次）
+	handlers.RunMigrations(db)
+
+	// 启动后台服务（多实例消息分发等）
+	handlers.StartServices(db)
 
 	r := gin.Default()
 	
@@ -28,8 +34,9 @@ func main() {
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Chunk-Sha256")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Has-More, X-Sync-Time, X-Sync-Id")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -39,7 +46,8 @@ func main() {
 		c.Next()
 	})
 	
-	r.Static("/uploads", "./uploads") // Serve images from /uploads
+	// 上传文件访问（本地存储），私有模式下校验签名
+	handlers.SetupMediaRoutes(r)
 
 	// Setup admin routes
 	handlers.SetupAdminRoutes(r, db)
@@ -2,8 +2,9 @@ package models
 
 import "gorm.io/gorm"
 
+// Assignment 小程序与客服的分配关系（多对多：一个小程序可由多个客服组成的团队接待）
 type Assignment struct {
 	gorm.Model
-	MiniAppID         uint `json:"MiniAppID"`
-	CustomerServiceID uint `json:"CustomerServiceID"`
+	MiniAppID         uint `gorm:"index:idx_assignment_miniapp_cs,priority:1" json:"MiniAppID"`
+	CustomerServiceID uint `gorm:"index:idx_assignment_miniapp_cs,priority:2;index" json:"CustomerServiceID"`
 }
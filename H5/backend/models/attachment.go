@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 上传者类型
+const (
+	UploaderUser = "user" // 小程序用户
+	UploaderCS   = "cs"   // 客服
+)
+
+// Attachment 上传的文件。相同内容（按 SHA-256）和类型只保存一份，
+// 没有消息或自动回复引用、且超过保留期的文件由清理任务删除
+type Attachment struct {
+	gorm.Model
+	Hash         string     `gorm:"size:64;uniqueIndex:idx_attachments_hash_kind,priority:1" json:"Hash"` // 上传内容的 SHA-256
+	Kind         string     `gorm:"size:20;uniqueIndex:idx_attachments_hash_kind,priority:2" json:"Kind"` // image/voice/video/file
+	Key          string     `gorm:"size:191;uniqueIndex" json:"Key"`                                      // 存储后端中的路径
+	DisplayKey   string     `gorm:"size:191" json:"DisplayKey"`                                           // 图片的显示图，未缩放时为空
+	ThumbKey     string     `gorm:"size:191" json:"ThumbKey"`                                             // 图片的缩略图
+	MimeType     string     `gorm:"size:100" json:"MimeType"`
+	Size         int64      `json:"Size"`                 // 字节
+	Name         string     `gorm:"size:255" json:"Name"` // 首次上传时的文件名
+	Width        int        `json:"Width"`
+	Height       int        `json:"Height"`
+	Blurhash     string     `gorm:"size:100" json:"Blurhash"`
+	UploaderType string     `gorm:"size:10" json:"UploaderType"` // 首次上传者，未知时为空
+	UploaderID   uint       `json:"UploaderID"`
+	LastUsedAt   *time.Time `gorm:"index" json:"LastUsedAt"` // 最近一次上传或被消息引用的时间，清理任务按此计算保留期
+}
+
+// MessageAttachment 消息引用的文件，一条消息可以引用多个文件（如视频和封面）
+type MessageAttachment struct {
+	ID           uint `gorm:"primarykey"`
+	MessageID    uint `gorm:"uniqueIndex:idx_message_attachments,priority:1"`
+	AttachmentID uint `gorm:"uniqueIndex:idx_message_attachments,priority:2;index"`
+	UserID       uint `gorm:"index"` // 消息所属用户，删除用户时一并删除
+}
@@ -0,0 +1,26 @@
+package models
+
+import "gorm.io/gorm"
+
+// 关键词匹配方式
+const (
+	MatchExact    = "exact"    // 完全匹配（忽略大小写和首尾空格）
+	MatchContains = "contains" // 包含关键词
+	MatchRegex    = "regex"    // 正则表达式
+)
+
+// AutoReplyRule 小程序的关键词自动回复规则
+type AutoReplyRule struct {
+	gorm.Model
+	MiniAppID     uint   `gorm:"index" json:"MiniAppID"`
+	Name          string `json:"Name"`
+	MatchType     string `json:"MatchType"` // exact / contains / regex
+	Keyword       string `json:"Keyword"`
+	Priority      int    `json:"Priority"`                      // 数值越大越优先匹配
+	ReplyType     string `json:"ReplyType"`                     // text / image / miniprogram
+	ReplyContent  string `gorm:"type:text" json:"ReplyContent"` // 文本内容，小程序卡片时为标题
+	ReplyImageURL string `json:"ReplyImageURL"`                 // 图片地址，小程序卡片时为封面图
+	ReplyPagePath string `json:"ReplyPagePath"`                 // 小程序卡片跳转页面
+	SkipHuman     bool   `json:"SkipHuman"`                     // 命中后不再分配人工客服
+	Enabled       bool   `gorm:"default:true" json:"Enabled"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "gorm.io/gorm"
+
+// BusinessHours 小程序的工作时间，未配置或未启用时视为全天工作
+type BusinessHours struct {
+	gorm.Model
+	MiniAppID       uint   `gorm:"uniqueIndex" json:"MiniAppID"`
+	Enabled         bool   `json:"Enabled"`
+	TimeZone        string `gorm:"default:Asia/Shanghai" json:"TimeZone"`
+	WeeklySchedule  string `gorm:"type:text" json:"WeeklySchedule"`  // JSON，如 {"mon":[{"start":"09:00","end":"18:00"}]}
+	AfterHoursReply string `gorm:"type:text" json:"AfterHoursReply"` // 非工作时间自动回复，每个会话只发送一次
+}
+
+// BusinessHoliday 节假日及调休等例外日期，优先于每周工作时间
+type BusinessHoliday struct {
+	gorm.Model
+	MiniAppID uint   `gorm:"index" json:"MiniAppID"`
+	Date      string `gorm:"size:10" json:"Date"` // 2006-01-02（按小程序时区）
+	Name      string `json:"Name"`
+	Closed    bool   `json:"Closed"` // true：全天休息；false：按 Start/End 工作（如调休上班）
+	Start     string `json:"Start"`  // 15:04
+	End       string `json:"End"`    // 15:04，可为 24:00
+}
@@ -0,0 +1,21 @@
+package models
+
+import "gorm.io/gorm"
+
+// 快捷回复范围
+const (
+	CannedShared   = "shared"   // 小程序共享，所有负责该小程序的客服可用
+	CannedPersonal = "personal" // 客服个人
+)
+
+// CannedResponse 客服快捷回复，内容中可使用 {{nickname}}、{{agent}}、{{miniapp}} 变量
+type CannedResponse struct {
+	gorm.Model
+	Scope             string `gorm:"size:20;index" json:"Scope"`     // shared / personal
+	MiniAppID         uint   `gorm:"index" json:"MiniAppID"`         // 共享快捷回复所属小程序
+	CustomerServiceID uint   `gorm:"index" json:"CustomerServiceID"` // 个人快捷回复所属客服
+	Folder            string `gorm:"size:100" json:"Folder"`         // 分组，为空表示未分组
+	Shortcut          string `gorm:"size:50;index" json:"Shortcut"`  // 快捷码，客服输入 /快捷码 时搜索
+	Title             string `json:"Title"`
+	Content           string `gorm:"type:text" json:"Content"`
+}
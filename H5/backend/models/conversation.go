@@ -0,0 +1,36 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// 会话状态
+const (
+	ConversationOpen        = "open"         // 用户发起，尚未分配客服
+	ConversationBot         = "bot"          // 机器人应答中，尚未转人工
+	ConversationQueued      = "queued"       // 暂无可接待的客服，排队等待分配
+	ConversationAssigned    = "assigned"     // 已分配客服，等待客服回复
+	ConversationPendingUser = "pending_user" // 客服已回复，等待用户
+	ConversationResolved    = "resolved"     // 客服标记为已解决
+	ConversationClosed      = "closed"       // 已关闭（客服关闭或超时自动关闭）
+)
+
+// Conversation 用户与客服的一次会话，用户首次发消息时创建，关闭后用户再次发消息时重新打开
+type Conversation struct {
+	gorm.Model
+	UserID            uint       `gorm:"index" json:"UserID"`
+	MiniAppID         uint       `gorm:"index" json:"MiniAppID"`
+	CustomerServiceID uint       `gorm:"index" json:"CustomerServiceID"` // 当前接待的客服，0 表示未分配
+	Status            string     `gorm:"index;default:open" json:"Status"`
+	LastMessageAt     *time.Time `json:"LastMessageAt"`
+	QueuedAt          *time.Time `gorm:"index" json:"QueuedAt"` // 进入排队的时间
+	ResolvedAt        *time.Time `json:"ResolvedAt"`
+	ClosedAt          *time.Time `json:"ClosedAt"`
+	ClosedBy          string     `json:"ClosedBy"`    // agent（客服关闭）或 auto（超时自动关闭）
+	ReopenCount       int        `json:"ReopenCount"` // 重新打开次数
+	AfterHoursReplied bool       `json:"AfterHoursReplied"`  // 是否已发送非工作时间自动回复
+	FirstResponseDueAt *time.Time `json:"FirstResponseDueAt"` // 首次响应截止时间（按工作时间计算）
+	FirstResponseAt    *time.Time `json:"FirstResponseAt"`    // 客服首次回复时间
+	RatingRequestedAt  *time.Time `json:"RatingRequestedAt"`  // 发送满意度评价邀请的时间
+}
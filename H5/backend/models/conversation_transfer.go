@@ -0,0 +1,13 @@
+package models
+
+import "gorm.io/gorm"
+
+// ConversationTransfer 会话转接记录
+type ConversationTransfer struct {
+	gorm.Model
+	ConversationID uint   `gorm:"index" json:"ConversationID"`
+	FromCSID       uint   `json:"FromCSID"` // 转出客服
+	ToCSID         uint   `json:"ToCSID"`   // 接手客服
+	RequestedByCSID uint  `json:"RequestedByCSID"` // 发起转接的客服（管理员代为转接时不是转出客服）
+	Note           string `gorm:"type:text" json:"Note"` // 交接备注，仅客服可见
+}
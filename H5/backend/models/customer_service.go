@@ -1,6 +1,17 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// 客服在线状态
+const (
+	CSStatusOnline  = "online"  // 在线，可接待新会话
+	CSStatusAway    = "away"    // 离开，不分配新会话
+	CSStatusBusy    = "busy"    // 忙碌，不分配新会话
+	CSStatusOffline = "offline" // 离线
+)
 
 type CustomerService struct {
 	gorm.Model
@@ -9,4 +20,7 @@ type CustomerService struct {
 	IsAdmin       bool   `json:"IsAdmin"` // true if admin, false if customer service
 	QRCodePath    string `json:"QRCodePath"` // 小程序二维码路径，用于生成二维码
 	WelcomeMessage string `json:"WelcomeMessage"` // 欢迎语，用户首次发送消息时自动发送
+	LastActiveTime *time.Time `json:"LastActiveTime"` // 最后活动时间（WebSocket 连接或发送消息）
+	Status        string `gorm:"default:offline" json:"Status"` // 在线状态：online/away/busy/offline
+	MaxConcurrent int    `gorm:"default:10" json:"MaxConcurrent"` // 最大同时接待会话数，0 表示不限
 }
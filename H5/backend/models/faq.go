@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// FAQEntry 常见问题库条目，机器人按相似度匹配用户问题
+type FAQEntry struct {
+	gorm.Model
+	MiniAppID uint   `gorm:"index" json:"MiniAppID"`
+	Question  string `json:"Question"`
+	Aliases   string `gorm:"type:text" json:"Aliases"` // 其他问法，每行一个
+	Answer    string `gorm:"type:text" json:"Answer"`
+	Enabled   bool   `gorm:"default:true" json:"Enabled"`
+	HitCount  int    `json:"HitCount"` // 机器人使用该条目回答的次数
+}
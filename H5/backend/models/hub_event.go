@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// HubEvent 跨实例分发的客服事件（数据库 Hub 使用，定期清理）
+type HubEvent struct {
+	ID                uint      `gorm:"primarykey"`
+	CreatedAt         time.Time `gorm:"index"`
+	Origin            string    `gorm:"size:64"` // 发布事件的实例ID，本实例已直接投递，轮询时跳过
+	CustomerServiceID uint      // 目标客服ID
+	Payload           string    `gorm:"type:text"` // WebSocket 推送内容（JSON）
+}
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// InternalNote 客服内部备注，只在客服端显示，不会发送给用户
+type InternalNote struct {
+	gorm.Model
+	UserID            uint   `gorm:"index" json:"UserID"`
+	ConversationID    uint   `gorm:"index" json:"ConversationID"` // 关联的会话，0 表示针对用户
+	CustomerServiceID uint   `json:"CustomerServiceID"`           // 备注作者
+	Content           string `gorm:"type:text" json:"Content"`
+}
@@ -1,11 +1,38 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"encoding/json"
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// 消息类型，除文本外的类型在 Payload 中保存结构化内容
+const (
+	MessageTypeText        = "text"        // 文本
+	MessageTypeImage       = "image"       // 图片
+	MessageTypeFile        = "file"        // 文件
+	MessageTypeVoice       = "voice"       // 语音（含时长）
+	MessageTypeVideo       = "video"       // 视频
+	MessageTypeLocation    = "location"    // 位置
+	MessageTypeLink        = "link"        // 链接卡片
+	MessageTypeMiniProgram = "miniprogram" // 小程序页面卡片
+	MessageTypeProduct     = "product"     // 商品卡片
+	MessageTypeOrder       = "order"       // 订单卡片
+	MessageTypeSystem      = "system"      // 系统事件（如转接、排队提示）
+	MessageTypeRating      = "rating"      // 满意度评价邀请
+)
+
+// Message 聊天消息。未使用 gorm.Model，以便把 created_at/updated_at 放进复合索引：
+// 聊天记录按 (user_id, created_at) 分页，增量同步按 (user_id, updated_at) 查询
 type Message struct {
-	gorm.Model
-	UserID            uint
-	CustomerServiceID uint
+	ID                uint           `gorm:"primarykey"`
+	CreatedAt         time.Time      `gorm:"index:idx_messages_user_created,priority:2;index:idx_messages_cs_user_created,priority:3"`
+	UpdatedAt         time.Time      `gorm:"index:idx_messages_user_updated,priority:2"`
+	DeletedAt         gorm.DeletedAt `gorm:"index"`
+	UserID            uint           `gorm:"index:idx_messages_user_created,priority:1;index:idx_messages_cs_user_created,priority:2;index:idx_messages_user_updated,priority:1"`
+	CustomerServiceID uint           `gorm:"index:idx_messages_cs_user_created,priority:1"`
+	ConversationID    uint `gorm:"index"` // 所属会话
 	Content           string
 	FromUser          bool // true if from user, false if from CS
 	IsImage           bool // true if message is an image
@@ -13,4 +40,26 @@ type Message struct {
 	IsRead            bool `gorm:"default:false"` // true if CS has read this message (from user)
 	UserRead          bool `gorm:"default:false"` // true if user has read this message (from CS)
 	IsDeleted         bool `gorm:"default:false"` // true if message is deleted
+	IsSystem          bool `gorm:"default:false"` // true if message is a system event (e.g. conversation transferred)
+	IsBot             bool `gorm:"default:false"` // true if message is sent by an auto-reply rule or the bot responder
+	Type              string `gorm:"size:20;default:text"` // message type, see MessageType* constants
+	Payload           json.RawMessage `gorm:"type:json"` // structured content for non-text types (e.g. mini-program card)
+	EditedAt          *time.Time // last time the sender edited the message, nil if never edited
+	RecalledAt        *time.Time // time the sender recalled the message; content is kept for admin audit only
+	ReplyToID         uint       `gorm:"index"` // quoted parent message, 0 if not a reply
+}
+
+// BeforeCreate 未指定类型时按旧字段推断：系统消息、图片或文本
+func (m *Message) BeforeCreate(tx *gorm.DB) error {
+	if m.Type == "" {
+		switch {
+		case m.IsSystem:
+			m.Type = MessageTypeSystem
+		case m.IsImage:
+			m.Type = MessageTypeImage
+		default:
+			m.Type = MessageTypeText
+		}
+	}
+	return nil
 }
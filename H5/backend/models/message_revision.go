@@ -0,0 +1,25 @@
+package models
+
+import (
+	"encoding/json"
+
+	"gorm.io/gorm"
+)
+
+// 消息修改记录的操作类型
+const (
+	RevisionEdit   = "edit"   // 编辑
+	RevisionRecall = "recall" // 撤回
+)
+
+// MessageRevision 消息被编辑或撤回前的内容，只供管理员审计，不会返回给用户和客服
+type MessageRevision struct {
+	gorm.Model
+	MessageID         uint            `gorm:"index" json:"MessageID"`
+	UserID            uint            `gorm:"index" json:"UserID"` // 消息所属用户，删除用户时一并删除
+	Action            string          `gorm:"size:20" json:"Action"`
+	Content           string          `gorm:"type:text" json:"Content"` // 修改前的内容
+	Payload           json.RawMessage `gorm:"type:json" json:"Payload"`
+	FromUser          bool            `json:"FromUser"`          // 由用户还是客服操作
+	CustomerServiceID uint            `json:"CustomerServiceID"` // 操作的客服，用户操作时为 0
+}
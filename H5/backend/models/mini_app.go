@@ -2,10 +2,29 @@ package models
 
 import "gorm.io/gorm"
 
+// 新会话分配策略
+const (
+	RoutingRoundRobin  = "round_robin"  // 轮流分配
+	RoutingLeastActive = "least_active" // 分配给当前接待会话最少的客服
+	RoutingSticky      = "sticky"       // 优先分配给上次接待该用户的客服
+)
+
+// 机器人应答方式（转人工前先由机器人应答）
+const (
+	ResponderNone    = ""        // 不使用机器人，直接分配人工客服
+	ResponderFAQ     = "faq"     // 内置常见问题库相似度匹配
+	ResponderWebhook = "webhook" // 调用外部 HTTP 接口
+)
+
 type MiniApp struct {
 	gorm.Model
 	Name       string `json:"Name"`       // 小程序名称
 	AppID      string `gorm:"unique" json:"AppID"`
 	Secret     string `json:"Secret"`     // Optional, for API access if needed
 	TemplateID string `json:"TemplateID"` // WeChat subscription message template ID
+	RoutingStrategy  string `gorm:"default:round_robin" json:"RoutingStrategy"` // 新会话分配策略
+	RoundRobinCursor uint   `json:"-"`                                          // 轮流分配：上次分配的客服ID
+	ResponderType    string `json:"ResponderType"`                              // 机器人应答方式，为空表示不使用
+	ResponderURL     string `json:"ResponderURL"`                               // webhook 地址
+	ResponderSecret  string `json:"-"`                                          // webhook 签名密钥
 }
@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// Rating 用户对一次会话的满意度评价（1~5 星），每个会话只能评价一次
+type Rating struct {
+	gorm.Model
+	ConversationID    uint   `gorm:"uniqueIndex" json:"ConversationID"`
+	UserID            uint   `gorm:"index" json:"UserID"`
+	MiniAppID         uint   `gorm:"index" json:"MiniAppID"`
+	CustomerServiceID uint   `gorm:"index" json:"CustomerServiceID"` // 被评价的客服（会话解决时的接待客服）
+	Score             int    `json:"Score"`
+	Comment           string `gorm:"type:text" json:"Comment"`
+}
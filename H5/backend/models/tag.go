@@ -0,0 +1,24 @@
+package models
+
+import "gorm.io/gorm"
+
+// Tag 标签，由管理员维护，客服可以给用户和会话打标签（如 VIP、退款中）
+type Tag struct {
+	gorm.Model
+	Name  string `gorm:"size:50;unique" json:"Name"`
+	Color string `gorm:"size:20" json:"Color"` // 显示颜色，如 #ff9900
+}
+
+// UserTag 用户标签
+type UserTag struct {
+	gorm.Model
+	UserID uint `gorm:"uniqueIndex:idx_user_tag" json:"UserID"`
+	TagID  uint `gorm:"uniqueIndex:idx_user_tag;index" json:"TagID"`
+}
+
+// ConversationTag 会话标签
+type ConversationTag struct {
+	gorm.Model
+	ConversationID uint `gorm:"uniqueIndex:idx_conversation_tag" json:"ConversationID"`
+	TagID          uint `gorm:"uniqueIndex:idx_conversation_tag;index" json:"TagID"`
+}
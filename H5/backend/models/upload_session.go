@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 分片上传状态
+const (
+	UploadSessionUploading = "uploading" // 上传中
+	UploadSessionCompleted = "completed" // 已合并保存
+)
+
+// UploadSession 分片上传任务。分片按顺序上传，Received 为已接收的字节数，即下一个分片的偏移量
+type UploadSession struct {
+	gorm.Model
+	UploadID     string    `gorm:"size:36;uniqueIndex" json:"UploadID"` // 客户端使用的任务 ID
+	Kind         string    `gorm:"size:20" json:"Kind"`
+	Name         string    `gorm:"size:255" json:"Name"`
+	Size         int64     `json:"Size"`                    // 文件总大小
+	Received     int64     `json:"Received"`                // 已接收的字节数
+	Checksum     string    `gorm:"size:64" json:"Checksum"` // 创建时提供的 SHA-256，可在完成时再提供
+	Status       string    `gorm:"size:20;default:uploading" json:"Status"`
+	UploaderType string    `gorm:"size:10" json:"UploaderType"`
+	UploaderID   uint      `json:"UploaderID"`
+	AttachmentID uint      `json:"AttachmentID"`           // 完成后保存的文件
+	ExpiresAt    time.Time `gorm:"index" json:"ExpiresAt"` // 超过该时间未完成的任务由清理任务删除，每次上传分片后顺延
+}
+
+// UploadPart 已接收的分片，保存为存储后端中的临时文件，完成或过期后删除
+type UploadPart struct {
+	ID        uint  `gorm:"primarykey"`
+	SessionID uint  `gorm:"uniqueIndex:idx_upload_parts_offset,priority:1"`
+	Offset    int64 `gorm:"uniqueIndex:idx_upload_parts_offset,priority:2"`
+	Size      int64
+	Key       string `gorm:"size:191"`
+}
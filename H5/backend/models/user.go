@@ -1,14 +1,24 @@
 package models
 
 import (
+	"encoding/json"
 	"gorm.io/gorm"
 	"time"
 )
 
+// User 小程序用户，以 (MiniAppID, OpenID) 唯一标识；同一个人在不同小程序中是不同的用户，通过 UnionID 关联
 type User struct {
 	gorm.Model
-	OpenID        string     `gorm:"unique"`
-	MiniAppID     uint
+	OpenID        string     `gorm:"size:191;uniqueIndex:idx_user_miniapp_openid,priority:2"`
+	MiniAppID     uint       `gorm:"uniqueIndex:idx_user_miniapp_openid,priority:1"`
 	Subscribed    bool       // Whether user has authorized subscription messages
 	LastActiveTime *time.Time `json:"LastActiveTime"` // 最后活动时间，用于判断在线状态
+	UnionID       string          `gorm:"size:64;index" json:"UnionID"` // 微信 UnionID（小程序绑定开放平台时返回）
+	Nickname      string          `gorm:"size:100" json:"Nickname"`     // 昵称（用户在小程序内填写）
+	AvatarURL     string          `json:"AvatarURL"`                    // 头像地址
+	Phone         string          `gorm:"size:32" json:"Phone"`         // 手机号（通过 getPhoneNumber 授权绑定）
+	PhoneCountryCode string       `gorm:"size:8" json:"PhoneCountryCode"`
+	Scene         int             `json:"Scene"`                        // 首次进入的场景值（wx.getLaunchOptionsSync().scene）
+	Source        string          `gorm:"size:100" json:"Source"`       // 首次进入的来源（如渠道参数）
+	Attributes    json.RawMessage `gorm:"type:json" json:"Attributes"`  // 小程序上报的自定义属性
 }
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local 本地磁盘存储，文件通过后端的 /uploads 路由访问。
+// 多个后端副本时需要挂载同一个共享目录，否则请使用 S3 兼容存储
+type Local struct {
+	dir        string
+	baseURL    string
+	signingKey []byte
+}
+
+// NewLocal 创建本地存储，dir 不存在时自动创建
+func NewLocal(dir, publicBaseURL, signingKey string) (*Local, error) {
+	if dir == "" {
+		dir = "./uploads"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建上传目录失败: %v", err)
+	}
+	return &Local{
+		dir:        dir,
+		baseURL:    strings.TrimRight(publicBaseURL, "/") + "/uploads/",
+		signingKey: []byte(signingKey),
+	}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("无效的文件路径: %s", key)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+// Put 先写入临时文件再重命名，避免读到写了一半的文件。本地文件不保存元数据，访问时按扩展名设置响应头
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	p, _ := l.path(key)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, info, err
+	}
+	return f, info, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size:         fi.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(p)),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) URL(key string) string {
+	return l.baseURL + key
+}
+
+// Walk 遍历目录中的文件，跳过以 . 开头的文件（写入中的临时文件），key 为相对路径
+func (l *Local) Walk(fn func(key string, info ObjectInfo) error) error {
+	return filepath.WalkDir(l.dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), ObjectInfo{
+			Size:         fi.Size(),
+			ContentType:  mime.TypeByExtension(filepath.Ext(p)),
+			LastModified: fi.ModTime(),
+		})
+	})
+}
+
+// SignedURL 在地址后附加过期时间和 HMAC 签名，由 Verify 校验
+func (l *Local) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if len(l.signingKey) == 0 {
+		return "", errors.New("未配置签名密钥")
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	return l.URL(key) + "?expires=" + expires + "&sig=" + l.sign(key, expires), nil
+}
+
+// Verify 校验临时访问地址的签名和有效期
+func (l *Local) Verify(key, expires, sig string) bool {
+	if len(l.signingKey) == 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(l.sign(key, expires)))
+}
+
+func (l *Local) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 S3 兼容的对象存储。未配置 PublicBaseURL 时使用 endpoint/bucket 作为访问地址（path-style）
+type S3 struct {
+	client  *minio.Client
+	presign *minio.Client // 使用 PublicEndpoint 签名，签名包含主机名，必须与浏览器访问的地址一致
+	bucket  string
+	baseURL string
+}
+
+// NewS3 创建 S3 存储，bucket 不存在时自动创建；非私有模式下设置 bucket 内文件公开可读，
+// 设置失败（如云厂商不允许通过 API 修改权限）时需要在控制台手动把 bucket 设为公共读
+func NewS3(cfg Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 存储需要配置 endpoint 和 bucket")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("创建 S3 客户端失败: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("检查 bucket 失败: %v", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("创建 bucket 失败: %v", err)
+		}
+	}
+
+	if !cfg.Private {
+		if err := client.SetBucketPolicy(ctx, cfg.Bucket, publicReadPolicy(cfg.Bucket)); err != nil {
+			log.Printf("[存储] 设置 bucket %s 公开读权限失败，文件地址可能无法访问，请在对象存储控制台设置: %v", cfg.Bucket, err)
+		}
+	}
+
+	presign := client
+	if cfg.PublicEndpoint != "" {
+		u, err := url.Parse(cfg.PublicEndpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("S3 公开地址格式错误: %s", cfg.PublicEndpoint)
+		}
+		// 指定 region，签名时不需要通过公开地址查询 bucket 所在区域
+		region := cfg.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		presign, err = minio.New(u.Host, &minio.Options{
+			Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+			Secure: u.Scheme == "https",
+			Region: region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("创建 S3 签名客户端失败: %v", err)
+		}
+	}
+
+	baseURL := strings.TrimRight(cfg.PublicBaseURL, "/")
+	if baseURL == "" {
+		baseURL = presign.EndpointURL().String() + "/" + cfg.Bucket
+	}
+	return &S3{client: client, presign: presign, bucket: cfg.Bucket, baseURL: baseURL + "/"}, nil
+}
+
+// publicReadPolicy 允许匿名读取 bucket 内的文件（不允许列出文件）
+func publicReadPolicy(bucket string) string {
+	return `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},` +
+		`"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::` + bucket + `/*"]}]}`
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error {
+	if !validKey(key) {
+		return fmt.Errorf("无效的文件路径: %s", key)
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, info, err
+	}
+	return obj, info, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	st, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: st.Size, ContentType: st.ContentType, LastModified: st.LastModified}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) URL(key string) string {
+	return s.baseURL + key
+}
+
+func (s *S3) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.presign.PresignedGetObject(ctx, s.bucket, key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
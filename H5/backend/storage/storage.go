@@ -0,0 +1,102 @@
+// Package storage 上传文件的存储后端：本地磁盘或 S3 兼容的对象存储（MinIO、阿里云 OSS、腾讯云 COS 等）
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound 文件不存在
+var ErrNotFound = errors.New("文件不存在")
+
+// ObjectInfo 文件信息
+type ObjectInfo struct {
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// PutOptions 保存文件时的元数据，S3 存储在访问文件时作为响应头返回
+type PutOptions struct {
+	ContentType        string
+	ContentDisposition string // 如 "attachment"，为空时由浏览器决定是否直接显示
+}
+
+// Storage 存储后端。key 为相对路径（如 "2026/10/uuid.jpg"），由调用方生成
+type Storage interface {
+	// Put 保存文件，size 未知时传 -1
+	Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) error
+	// Get 读取文件，调用方负责关闭
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Stat 获取文件信息
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete 删除文件，文件不存在时不报错
+	Delete(ctx context.Context, key string) error
+	// URL 公开访问地址
+	URL(key string) string
+	// SignedURL 有效期为 expiry 的临时访问地址，用于私有文件
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Config 存储配置
+type Config struct {
+	Backend       string // local（默认）或 s3
+	PublicBaseURL string // 对外访问的基础地址，如 https://kefu.example.com 或 CDN 域名
+
+	// 本地存储
+	LocalDir   string // 保存目录，默认 ./uploads
+	SigningKey string // 本地临时访问地址的签名密钥
+
+	// S3 兼容存储
+	Endpoint  string // 如 minio:9000、oss-cn-hangzhou.aliyuncs.com
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
+	// PublicEndpoint 浏览器可以访问的 S3 地址（如 https://oss.example.com），用于生成临时访问地址；
+	// Endpoint 为容器内部地址（如 minio:9000）时必须配置，为空时使用 Endpoint
+	PublicEndpoint string
+	// Private 为 true 时文件只能通过临时地址访问，否则创建 bucket 后设置公开读权限
+	Private bool
+}
+
+// New 按配置创建存储后端
+func New(cfg Config) (Storage, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocal(cfg.LocalDir, cfg.PublicBaseURL, cfg.SigningKey)
+	case "s3":
+		return NewS3(cfg)
+	}
+	return nil, errors.New("不支持的存储后端: " + cfg.Backend)
+}
+
+// KeyFromURL 从 URL 解析出 key，不是该存储的地址时返回 false
+func KeyFromURL(s Storage, url string) (string, bool) {
+	prefix := s.URL("")
+	if prefix == "" || !strings.HasPrefix(url, prefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(url, prefix)
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		key = key[:i]
+	}
+	return key, key != ""
+}
+
+// validKey key 只能是相对路径，不能包含 ".." 等路径跳转
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
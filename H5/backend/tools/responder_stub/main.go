@@ -0,0 +1,80 @@
+// responder_stub 本地调试用的 webhook 机器人，代替真实的外部机器人服务。
+//
+//	go run ./tools/responder_stub -addr :9090 -secret xxx
+//
+// 然后把小程序的机器人设置为 {"ResponderType":"webhook","ResponderURL":"http://localhost:9090/respond","ResponderSecret":"xxx"}。
+// 消息包含“你好”时回答，包含“价格”时请用户澄清，其余转人工。
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type request struct {
+	ConversationID uint     `json:"conversationId"`
+	Content        string   `json:"content"`
+	Suggestions    []string `json:"suggestions"`
+}
+
+type reply struct {
+	Action      string   `json:"action"`
+	Text        string   `json:"text,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	secret := flag.String("secret", "", "shared secret for X-Responder-Signature (empty to skip verification)")
+	flag.Parse()
+
+	http.HandleFunc("/respond", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *secret != "" {
+			mac := hmac.New(sha256.New, []byte(*secret))
+			mac.Write(body)
+			if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.Header.Get("X-Responder-Signature"))) {
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			}
+		}
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := respond(req)
+		log.Printf("conversation=%d content=%q -> %s", req.ConversationID, req.Content, resp.Action)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+	log.Printf("responder stub listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func respond(req request) reply {
+	content := strings.TrimSpace(req.Content)
+	if n, err := strconv.Atoi(content); err == nil && n >= 1 && n <= len(req.Suggestions) {
+		return reply{Action: "answer", Text: "关于「" + req.Suggestions[n-1] + "」：这是桩服务的示例回答。"}
+	}
+	switch {
+	case strings.Contains(content, "你好"):
+		return reply{Action: "answer", Text: "你好，我是机器人助手，有什么可以帮您？"}
+	case strings.Contains(content, "价格"):
+		suggestions := []string{"会员价格", "运费价格"}
+		return reply{Action: "clarify", Text: "您想了解哪种价格？\n1. 会员价格\n2. 运费价格", Suggestions: suggestions}
+	}
+	return reply{Action: "handoff", Text: "正在为您转接人工客服，请稍候"}
+}
@@ -43,10 +43,11 @@ CREATE TABLE IF NOT EXISTS users (
     created_at DATETIME,
     updated_at DATETIME,
     deleted_at DATETIME,
-    open_id VARCHAR(255) UNIQUE,
+    open_id VARCHAR(191),
     mini_app_id INT UNSIGNED,
     subscribed TINYINT(1),
-    last_active_time DATETIME
+    last_active_time DATETIME,
+    UNIQUE KEY idx_user_miniapp_openid (mini_app_id, open_id)
 );
 
 -- Message 表
@@ -61,7 +62,12 @@ CREATE TABLE IF NOT EXISTS messages (
     from_user TINYINT(1),
     is_image TINYINT(1) DEFAULT 0,
     image_url VARCHAR(500),
-    is_read TINYINT(1) DEFAULT 0
+    is_read TINYINT(1) DEFAULT 0,
+    KEY idx_messages_user_created (user_id, created_at),
+    KEY idx_messages_cs_user_created (customer_service_id, user_id, created_at),
+    KEY idx_messages_user_updated (user_id, updated_at),
+    KEY idx_messages_deleted_at (deleted_at),
+    FULLTEXT KEY ft_messages_content (content) WITH PARSER ngram
 );
 
 -- 可选初始数据（示例）
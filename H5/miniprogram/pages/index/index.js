@@ -6,10 +6,15 @@ Page({
     messages: [], // Array to hold chat history
     templateId: '', // 订阅消息模板ID
     hasRequestedAuth: false, // 是否已请求过授权
+    queuePosition: 0, // 排队位置，0 表示未排队
+    syncTime: '', // 增量同步时间（服务端返回的 X-Sync-Time）
+    syncId: '', // 增量同步游标消息 ID（服务端返回的 X-Sync-Id）
+    hasMore: false, // 是否还有更早的消息
     appId: '' // 小程序AppID
   },
-  onLoad: function() {
+  onLoad: function(options) {
     const app = getApp();
+    const launch = wx.getLaunchOptionsSync();
     const appId = app.globalData.appId || 'your-app-id'; // 从全局获取或使用占位符
     this.setData({ appId: appId });
     
@@ -18,7 +23,8 @@ Page({
         wx.request({
           url: 'https://kefu.chacaitx.cn/api/chat/login',
           method: 'POST',
-          data: { code: res.code, appId: appId },
+          // 进入场景和来源（如 ?source=xxx 渠道参数）仅在首次登录时记录
+          data: { code: res.code, appId: appId, scene: launch.scene, source: (options && options.source) || '' },
           success: res => {
             if (res.data.openId) {
               this.setData({ 
@@ -36,6 +42,9 @@ Page({
     // Poll for new messages every 5 seconds
     this.messageTimer = setInterval(() => {
       this.fetchHistory();
+      if (this.data.queuePosition > 0) {
+        this.fetchQueue();
+      }
     }, 5000);
     // 每30秒发送一次心跳
     this.heartbeatTimer = setInterval(() => {
@@ -75,16 +84,156 @@ Page({
     if (!this.data.openId || !this.data.appId) {
       return; // 如果还没有openId，不请求历史记录
     }
+    // 首次加载最新一页，之后只拉取 syncTime 之后新增或变更的消息，按 ID 合并
+    const data = { openId: this.data.openId, appId: this.data.appId };
+    if (this.data.syncTime) {
+      data.since = this.data.syncTime;
+      if (this.data.syncId) {
+        data.sinceId = this.data.syncId;
+      }
+    }
     wx.request({
       url: 'https://kefu.chacaitx.cn/api/chat/history',
+      data: data,
+      success: res => {
+        if (res.statusCode !== 200 || !res.data) return;
+        const syncTime = res.header['X-Sync-Time'] || res.header['x-sync-time'] || this.data.syncTime;
+        const syncId = res.header['X-Sync-Id'] || res.header['x-sync-id'] || '';
+        if (!data.since) {
+          const hasMore = (res.header['X-Has-More'] || res.header['x-has-more']) === 'true';
+          this.setData({ messages: res.data, syncTime: syncTime, hasMore: hasMore });
+          return;
+        }
+        this.setData({ messages: this.mergeMessages(this.data.messages, res.data), syncTime: syncTime, syncId: syncId });
+      }
+    });
+  },
+  // 下拉加载更早的消息
+  fetchOlder: function() {
+    if (!this.data.hasMore || !this.data.messages.length) return;
+    wx.request({
+      url: 'https://kefu.chacaitx.cn/api/chat/history',
+      data: { openId: this.data.openId, appId: this.data.appId, before: this.data.messages[0].ID },
+      success: res => {
+        if (res.statusCode !== 200 || !res.data) return;
+        const hasMore = (res.header['X-Has-More'] || res.header['x-has-more']) === 'true';
+        this.setData({ messages: res.data.concat(this.data.messages), hasMore: hasMore });
+      }
+    });
+  },
+  // 按 ID 合并消息：已有的替换（编辑、撤回、已读），新的按时间追加
+  mergeMessages: function(list, updates) {
+    const merged = list.slice();
+    updates.forEach(msg => {
+      const i = merged.findIndex(m => m.ID === msg.ID);
+      if (i >= 0) {
+        merged[i] = msg;
+      } else {
+        merged.push(msg);
+      }
+    });
+    merged.sort((a, b) => new Date(a.CreatedAt) - new Date(b.CreatedAt) || a.ID - b.ID);
+    return merged;
+  },
+  // 查询排队位置
+  fetchQueue: function() {
+    wx.request({
+      url: 'https://kefu.chacaitx.cn/api/chat/queue',
       data: { openId: this.data.openId, appId: this.data.appId },
       success: res => {
         if (res.statusCode === 200 && res.data) {
-          this.setData({ messages: res.data });
+          this.setData({ queuePosition: res.data.position || 0 });
         }
       }
     });
   },
+  // 发送成功后根据返回结果更新排队位置
+  updateQueue: function(data) {
+    this.setData({ queuePosition: data && data.status === 'queued' ? data.position : 0 });
+  },
+  // 满意度评价：点击星级后可填写评价内容
+  submitRating: function(e) {
+    const score = e.currentTarget.dataset.score;
+    const conversationId = e.currentTarget.dataset.conversation;
+    wx.showModal({
+      title: '评价 ' + score + ' 星',
+      editable: true,
+      placeholderText: '说说您的感受（选填）',
+      success: res => {
+        if (!res.confirm) return;
+        wx.request({
+          url: 'https://kefu.chacaitx.cn/api/chat/rating',
+          method: 'POST',
+          data: {
+            appId: this.data.appId,
+            openId: this.data.openId,
+            conversationId: conversationId,
+            score: score,
+            comment: res.content || ''
+          },
+          success: res => {
+            wx.showToast({ title: res.statusCode === 200 ? '感谢您的评价' : (res.data.error || '评价失败'), icon: 'none' });
+          }
+        });
+      }
+    });
+  },
+  // 长按自己发送的消息撤回（发送后 2 分钟内）
+  recallMessage: function(e) {
+    if (!e.currentTarget.dataset.mine) return;
+    const id = e.currentTarget.dataset.id;
+    wx.showModal({
+      title: '撤回这条消息？',
+      success: res => {
+        if (!res.confirm) return;
+        wx.request({
+          url: 'https://kefu.chacaitx.cn/api/chat/message/' + id + '?appId=' + this.data.appId + '&openId=' + this.data.openId,
+          method: 'DELETE',
+          success: res => {
+            if (res.statusCode !== 200) {
+              wx.showToast({ title: res.data.error || '撤回失败', icon: 'none' });
+              return;
+            }
+            this.fetchHistory();
+          }
+        });
+      }
+    });
+  },
+  // 点击语音消息播放，点击位置消息打开地图
+  openPayload: function(e) {
+    const type = e.currentTarget.dataset.type;
+    const payload = e.currentTarget.dataset.payload;
+    if (type === 'voice') {
+      const audio = wx.createInnerAudioContext();
+      audio.src = payload.url;
+      audio.play();
+    } else if (type === 'location') {
+      wx.openLocation({ latitude: payload.latitude, longitude: payload.longitude, name: payload.name, address: payload.address });
+    }
+  },
+  // 用户填写昵称（type="nickname" 输入框）
+  updateNickname: function(e) {
+    const nickname = (e.detail.value || '').trim();
+    if (!nickname || !this.data.openId) return;
+    wx.request({
+      url: 'https://kefu.chacaitx.cn/api/chat/profile',
+      method: 'POST',
+      data: { appId: this.data.appId, openId: this.data.openId, nickname: nickname }
+    });
+  },
+  // 授权手机号（open-type="getPhoneNumber" 按钮）
+  bindPhone: function(e) {
+    if (!e.detail.code || !this.data.openId) return;
+    wx.request({
+      url: 'https://kefu.chacaitx.cn/api/chat/phone',
+      method: 'POST',
+      data: { appId: this.data.appId, openId: this.data.openId, code: e.detail.code },
+      success: res => {
+        wx.showToast({ title: res.statusCode === 200 ? '已绑定手机号' : '绑定失败', icon: 'none' });
+      }
+    });
+  },
   bindMessage: function(e) {
     this.setData({ message: e.detail.value });
   },
@@ -104,7 +253,7 @@ Page({
           wx.request({
             url: 'https://kefu.chacaitx.cn/api/chat/subscribe',
             method: 'POST',
-            data: { openId: this.data.openId },
+            data: { openId: this.data.openId, appId: this.data.appId },
             success: res => {
               console.log('订阅状态已更新');
               wx.showToast({
@@ -166,6 +315,7 @@ Page({
       },
       success: res => {
         if (res.statusCode === 200) {
+          this.updateQueue(res.data);
           this.setData({ message: '' }); // 清空输入框
           this.fetchHistory(); // 刷新消息列表
           // 发送消息时也会更新活动时间，但再发送一次心跳确保及时更新
@@ -201,6 +351,7 @@ Page({
           url: 'https://kefu.chacaitx.cn/api/chat/upload',
           filePath: res.tempFilePaths[0],
           name: 'image',
+          formData: { appId: that.data.appId, openId: that.data.openId },
           success: uploadRes => {
             const data = JSON.parse(uploadRes.data);
             if (data.url) {
@@ -210,10 +361,19 @@ Page({
                 data: {
                   appId: that.data.appId,
                   openId: that.data.openId,
-                  imageUrl: data.url
+                  type: 'image',
+                  payload: {
+                    url: data.url,
+                    width: data.width,
+                    height: data.height,
+                    displayUrl: data.displayUrl,
+                    thumbUrl: data.thumbUrl,
+                    blurhash: data.blurhash
+                  }
                 },
                 success: res => {
                   if (res.statusCode === 200) {
+                    that.updateQueue(res.data);
                     that.fetchHistory(); // 刷新消息列表
                     // 发送图片时也会更新活动时间，但再发送一次心跳确保及时更新
                     that.sendHeartbeat();